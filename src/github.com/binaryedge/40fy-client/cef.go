@@ -0,0 +1,224 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"gopkg.in/BurntSushi/toml.v0"
+)
+
+func init() {
+	registerFormat("cef", newCEFFormatter)
+	registerFormat("leef", newLEEFFormatter)
+}
+
+const (
+	siem_vendor  = "BinaryEdge"
+	siem_product = "40fy-client"
+	siem_version = "1.0"
+)
+
+// fieldMapping maps a CEF or LEEF extension key to the event paths it is
+// read from, separated by "|" and tried in order. A value starting with "="
+// is used as it is, for the labels of custom fields.
+type fieldMapping struct {
+	key   string
+	paths [][]string
+	value string
+}
+
+func newFieldMapping(key, spec string) fieldMapping {
+	m := fieldMapping{key: key}
+	if strings.HasPrefix(spec, "=") {
+		m.value = spec[1:]
+		return m
+	}
+	for _, p := range strings.Split(spec, "|") {
+		if path := splitPath(strings.TrimSpace(p)); len(path) > 0 {
+			m.paths = append(m.paths, path)
+		}
+	}
+	return m
+}
+
+func (m fieldMapping) get(e event) (string, bool) {
+	if len(m.paths) == 0 {
+		return m.value, true
+	}
+	for _, path := range m.paths {
+		if v, ok := lookup(e, path); ok && v != nil {
+			return valueString(v), true
+		}
+	}
+	return "", false
+}
+
+var defaultCEFMapping = [][2]string{
+	{"dst", "target.ip"},
+	{"dpt", "target.port"},
+	{"app", "origin.type|origin.module"},
+	{"rt", "origin.ts"},
+	{"cs1Label", "=jobId"},
+	{"cs1", "origin.job_id"},
+	{"cs2Label", "=banner"},
+	{"cs2", "result.data.banner|result.data.service.banner"},
+	{"cs3Label", "=service"},
+	{"cs3", "result.data.service.name"},
+}
+
+var defaultLEEFMapping = [][2]string{
+	{"dst", "target.ip"},
+	{"dstPort", "target.port"},
+	{"proto", "target.protocol"},
+	{"devTime", "origin.ts"},
+	{"module", "origin.type|origin.module"},
+	{"jobId", "origin.job_id"},
+	{"banner", "result.data.banner|result.data.service.banner"},
+	{"service", "result.data.service.name"},
+}
+
+// loadFieldMapping returns the default mapping of a format with the entries
+// of the [cef] or [leef] table of the TOML file at path applied, an empty
+// value removes a key. Keys not in the defaults are added in sorted order.
+func loadFieldMapping(format string, defaults [][2]string, path string) ([]fieldMapping, error) {
+	overrides := map[string]string{}
+	if len(path) > 0 {
+		var file map[string]map[string]string
+		if _, err := toml.DecodeFile(path, &file); err != nil {
+			return nil, fmt.Errorf("invalid field map %s: %s", path, err.Error())
+		}
+		overrides = file[format]
+	}
+	var mapping []fieldMapping
+	seen := map[string]bool{}
+	for _, d := range defaults {
+		seen[d[0]] = true
+		spec, ok := overrides[d[0]]
+		if !ok {
+			spec = d[1]
+		}
+		if len(spec) > 0 {
+			mapping = append(mapping, newFieldMapping(d[0], spec))
+		}
+	}
+	var extra []string
+	for k, spec := range overrides {
+		if !seen[k] && len(spec) > 0 {
+			extra = append(extra, k)
+		}
+	}
+	sort.Strings(extra)
+	for _, k := range extra {
+		mapping = append(mapping, newFieldMapping(k, overrides[k]))
+	}
+	return mapping, nil
+}
+
+// cefFormatter writes events as ArcSight Common Event Format lines. The
+// signature id is the module that produced the event. Labels of custom
+// fields, such as cs3Label, are left out with the field when the event has
+// no value for it.
+type cefFormatter struct {
+	w       io.Writer
+	mapping []fieldMapping
+}
+
+func newCEFFormatter(w io.Writer, opts formatOptions) (formatter, error) {
+	mapping, err := loadFieldMapping("cef", defaultCEFMapping, opts.fieldMap)
+	if err != nil {
+		return nil, err
+	}
+	return &cefFormatter{w, mapping}, nil
+}
+
+var (
+	cefHeaderEscaper = strings.NewReplacer("\\", "\\\\", "|", "\\|", "\n", " ", "\r", " ")
+	cefValueEscaper  = strings.NewReplacer("\\", "\\\\", "=", "\\=", "\n", "\\n", "\r", "\\r")
+)
+
+func (f *cefFormatter) format(e event) string {
+	module := e.module()
+	if len(module) == 0 {
+		module = "unknown"
+	}
+	values := make(map[string]string, len(f.mapping))
+	for _, m := range f.mapping {
+		if v, ok := m.get(e); ok {
+			values[m.key] = v
+		}
+	}
+	ext := make([]string, 0, len(f.mapping))
+	for _, m := range f.mapping {
+		v, ok := values[m.key]
+		if !ok {
+			continue
+		}
+		// the label of a custom field only goes with its value
+		if field := strings.TrimSuffix(m.key, "Label"); field != m.key {
+			if _, ok := values[field]; !ok {
+				continue
+			}
+		}
+		ext = append(ext, m.key+"="+cefValueEscaper.Replace(v))
+	}
+	return strings.Join([]string{
+		"CEF:0",
+		siem_vendor,
+		siem_product,
+		siem_version,
+		cefHeaderEscaper.Replace(module),
+		cefHeaderEscaper.Replace(module + " result"),
+		"3",
+		strings.Join(ext, " "),
+	}, "|")
+}
+
+func (f *cefFormatter) write(e event, line []byte) error {
+	_, err := io.WriteString(f.w, f.format(e)+"\n")
+	return err
+}
+
+// leefFormatter writes events as IBM QRadar LEEF 1.0 lines, attributes are
+// separated by tabs.
+type leefFormatter struct {
+	w       io.Writer
+	mapping []fieldMapping
+}
+
+func newLEEFFormatter(w io.Writer, opts formatOptions) (formatter, error) {
+	mapping, err := loadFieldMapping("leef", defaultLEEFMapping, opts.fieldMap)
+	if err != nil {
+		return nil, err
+	}
+	return &leefFormatter{w, mapping}, nil
+}
+
+var leefValueEscaper = strings.NewReplacer("\t", "\\t", "\n", "\\n", "\r", "\\r")
+
+func (f *leefFormatter) format(e event) string {
+	module := e.module()
+	if len(module) == 0 {
+		module = "unknown"
+	}
+	attrs := make([]string, 0, len(f.mapping))
+	for _, m := range f.mapping {
+		if v, ok := m.get(e); ok {
+			attrs = append(attrs, m.key+"="+leefValueEscaper.Replace(v))
+		}
+	}
+	return strings.Join([]string{
+		"LEEF:1.0",
+		siem_vendor,
+		siem_product,
+		siem_version,
+		cefHeaderEscaper.Replace(module),
+		strings.Join(attrs, "\t"),
+	}, "|")
+}
+
+func (f *leefFormatter) write(e event, line []byte) error {
+	_, err := io.WriteString(f.w, f.format(e)+"\n")
+	return err
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	checkpoint_dir_name = "checkpoints"
+	checkpoint_interval = 5 * time.Second
+	// checkpoint_max_recent bounds the dedupe keys kept of the events
+	// written last
+	checkpoint_max_recent = 100000
+)
+
+// checkpoint is how far a subscription to the stream got: the time of the
+// latest event written and the dedupe keys of the events written within
+// the dedupe window, kept so a restarted stream picks up from there.
+type checkpoint struct {
+	Subscription string    `json:"subscription"`
+	URL          string    `json:"url"`
+	Jobs         []string  `json:"jobs,omitempty"`
+	LastEvent    time.Time `json:"last_event"`
+	DedupeKey    string    `json:"dedupe_key,omitempty"`
+	Recent       []recent  `json:"recent,omitempty"`
+	Events       uint64    `json:"events"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// recent is the dedupe key of an event written and when, in seconds.
+type recent struct {
+	Key uint64 `json:"k"`
+	At  int64  `json:"t"`
+}
+
+// subscription names the subscription to streamURL for the given jobs, in
+// any order, and returns the path of its checkpoint.
+func subscription(streamURL string, jobs []string) (string, string) {
+	ids := append([]string{}, jobs...)
+	sort.Strings(ids)
+	name := "all jobs"
+	if len(ids) > 0 {
+		name = "jobs " + strings.Join(ids, ",")
+	}
+	sum := sha1.Sum([]byte(streamURL + "\x00" + strings.Join(ids, ",")))
+	path := filepath.Join(configHome(), checkpoint_dir_name, "stream-"+hex.EncodeToString(sum[:6])+".json")
+	return name, path
+}
+
+// loadCheckpoint reads the checkpoint at path, nil when there is none yet.
+func loadCheckpoint(path string) (*checkpoint, error) {
+	byts, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	cp := &checkpoint{}
+	if err := json.Unmarshal(byts, cp); err != nil {
+		return nil, fmt.Errorf("corrupt checkpoint %s: %s", path, err.Error())
+	}
+	return cp, nil
+}
+
+func saveCheckpoint(path string, cp checkpoint) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	byts, err := json.MarshalIndent(cp, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, byts, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// resumeURL asks streamURL for the events from the checkpoint on with the
+// query parameter param, in milliseconds like origin.ts.
+func resumeURL(streamURL, param string, cp *checkpoint) (string, error) {
+	u, err := url.Parse(streamURL)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	q.Set(param, strconv.FormatInt(cp.LastEvent.UnixNano()/int64(time.Millisecond), 10))
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// overlap returns a filter dropping the events a stream that can't start
+// from the checkpoint sends again: those with the dedupe key, computed by
+// key, of an event written before the restart. The window of the dedupe
+// is widened to start at the restart, so the events are dropped for window
+// from now on, or for as long as the stream runs when window is 0.
+func (cp *checkpoint) overlap(key func(e event) uint64, window time.Duration, now func() time.Time) predicate {
+	keys := make(map[uint64]bool, len(cp.Recent))
+	for _, r := range cp.Recent {
+		keys[r.Key] = true
+	}
+	until := now().Add(window)
+	return func(e event) bool {
+		if len(keys) == 0 || window > 0 && now().After(until) {
+			return true
+		}
+		return !keys[key(e)]
+	}
+}
+
+// checkpointer keeps the checkpoint of a subscription up to date with the
+// events written, saving it every interval and when closed.
+type checkpointer struct {
+	path   string
+	report io.Writer
+	key    func(e event) uint64
+	window time.Duration
+	now    func() time.Time
+
+	mu    sync.Mutex
+	cp    checkpoint
+	keys  map[uint64]bool
+	dirty bool
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// newCheckpointer keeps the dedupe keys, computed by key, of the events
+// written within window, all of them when window is 0.
+func newCheckpointer(path string, cp checkpoint, key func(e event) uint64, window, interval time.Duration, report io.Writer) *checkpointer {
+	c := &checkpointer{
+		path:   path,
+		report: report,
+		key:    key,
+		window: window,
+		now:    time.Now,
+		cp:     cp,
+		keys:   map[uint64]bool{},
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	c.cp.Recent = append([]recent{}, cp.Recent...)
+	for _, r := range c.cp.Recent {
+		c.keys[r.Key] = true
+	}
+	go func() {
+		defer close(c.done)
+		tick := time.NewTicker(interval)
+		defer tick.Stop()
+		for {
+			select {
+			case <-c.stop:
+				return
+			case <-tick.C:
+				if err := c.save(); err != nil {
+					fmt.Fprintln(c.report, "Failed to save checkpoint", err.Error())
+				}
+			}
+		}
+	}()
+	return c
+}
+
+// observe is called with every event written, it moves the checkpoint to
+// e when it is the latest event and remembers its dedupe key.
+func (c *checkpointer) observe(e event) {
+	t := e.time()
+	now := c.now()
+	c.mu.Lock()
+	if t.After(c.cp.LastEvent) {
+		c.cp.LastEvent = t
+	}
+	if k := c.key(e); !c.keys[k] {
+		c.keys[k] = true
+		c.cp.Recent = append(c.cp.Recent, recent{k, now.Unix()})
+	}
+	// forget the keys written before the window
+	n := 0
+	for n < len(c.cp.Recent) && (len(c.cp.Recent)-n > checkpoint_max_recent ||
+		c.window > 0 && now.Sub(time.Unix(c.cp.Recent[n].At, 0)) > c.window) {
+		delete(c.keys, c.cp.Recent[n].Key)
+		n++
+	}
+	c.cp.Recent = c.cp.Recent[n:]
+	c.cp.Events++
+	c.dirty = true
+	c.mu.Unlock()
+}
+
+func (c *checkpointer) save() error {
+	c.mu.Lock()
+	if !c.dirty {
+		c.mu.Unlock()
+		return nil
+	}
+	c.cp.UpdatedAt = time.Now().UTC()
+	cp := c.cp
+	cp.Recent = append([]recent{}, c.cp.Recent...)
+	c.dirty = false
+	c.mu.Unlock()
+	return saveCheckpoint(c.path, cp)
+}
+
+func (c *checkpointer) Close() error {
+	select {
+	case <-c.stop:
+		return nil
+	default:
+	}
+	close(c.stop)
+	<-c.done
+	return c.save()
+}
+
+// showCheckpoint prints the checkpoint of a subscription.
+func showCheckpoint(w io.Writer, name, path string, cp *checkpoint, now time.Time) {
+	if cp == nil {
+		fmt.Fprintf(w, "No checkpoint for the stream of %s\n", name)
+		return
+	}
+	fmt.Fprintf(w, "Subscription: stream of %s\n", name)
+	fmt.Fprintf(w, "URL:          %s\n", cp.URL)
+	fmt.Fprintf(w, "Last event:   %s (%s ago)\n", cp.LastEvent.Format(time.RFC3339), now.Sub(cp.LastEvent)/time.Second*time.Second)
+	fmt.Fprintf(w, "Events:       %d\n", cp.Events)
+	fmt.Fprintf(w, "Updated:      %s\n", cp.UpdatedAt.Format(time.RFC3339))
+	fmt.Fprintf(w, "File:         %s\n", path)
+}
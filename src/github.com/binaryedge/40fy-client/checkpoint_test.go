@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckpointOverlap(t *testing.T) {
+	e := func(ts int, port int) event {
+		ev, _ := decodeEvent([]byte(fmt.Sprintf(`{"origin":{"ts":%d},"target":{"ip":"10.0.0.1","port":%d}}`, ts, port)))
+		return ev
+	}
+	key, _ := dedupeKeyOf("ip,port")
+	now := time.Unix(1000, 0)
+	c := newCheckpointer(os.DevNull, checkpoint{}, key, time.Minute, time.Hour, ioutil.Discard)
+	c.now = func() time.Time { return now }
+	c.observe(e(1000, 21))
+	now = now.Add(2 * time.Minute)
+	c.observe(e(1000, 80))
+	c.observe(e(2000, 22))
+	c.observe(e(2000, 22))
+	c.observe(e(1500, 443))
+	if len(c.cp.Recent) != 3 || c.cp.LastEvent != time.Unix(2, 0).UTC() || c.cp.Events != 5 {
+		t.Fatal("unexpected checkpoint", c.cp)
+	}
+	overlap := c.cp.overlap(key, time.Minute, func() time.Time { return now })
+	for _, tc := range []struct {
+		e    event
+		want bool
+	}{
+		{e(1000, 21), true},
+		{e(1000, 80), false},
+		{e(2000, 22), false},
+		{e(1500, 443), false},
+		// late events that were not written before the restart
+		{e(1999, 8080), true},
+		{e(2001, 8443), true},
+	} {
+		if overlap(tc.e) != tc.want {
+			t.Error("unexpected filter of", tc.e)
+		}
+	}
+	now = now.Add(2 * time.Minute)
+	if !overlap(e(1000, 80)) {
+		t.Error("event dropped after the window")
+	}
+}
+
+func TestCmdResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoint")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	os.Setenv(CONFIG_PATH, dir)
+	defer os.Unsetenv(CONFIG_PATH)
+
+	result := []byte(`{"origin":{"job_id":"1234","ts":1500000000000},"target":{"ip":"8.8.8.8","port":80}}` + "\n")
+	var (
+		since string
+		late  []byte
+	)
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		since = r.URL.Query().Get("since")
+		w.Write(result)
+		w.Write(result)
+		w.Write(late)
+	}
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+	config := testConfig(server.URL, token)
+
+	run := func(args ...string) string {
+		var out bytes.Buffer
+		c := StreamCommand{http.Client{}, &out, config, false}
+		if status := c.Run(args); status != 0 {
+			t.Fatal("Status not 0", status)
+		}
+		return out.String()
+	}
+	if out := run("-show-checkpoint", "-job-id=1234"); !strings.Contains(out, "No checkpoint for the stream of jobs 1234") {
+		t.Fatal("unexpected checkpoint", out)
+	}
+	if out := run("-resume", "-job-id=1234"); out != string(result)+string(result) {
+		t.Fatal("unexpected output", out)
+	}
+	out := run("-show-checkpoint", "-job-id=1234")
+	if !strings.Contains(out, "Last event:   2017-07-14T02:40:00Z") || !strings.Contains(out, "Events:       2") {
+		t.Fatal("unexpected checkpoint", out)
+	}
+
+	// the stream can't start at the checkpoint, what was written is dropped
+	// while a late event still passes
+	late = []byte(`{"origin":{"job_id":"1234","ts":1499999999000},"target":{"ip":"8.8.4.4","port":80}}` + "\n")
+	if out := run("-resume", "-job-id=1234"); out != string(late) || len(since) > 0 {
+		t.Fatal("duplicates not dropped", out, since)
+	}
+	if out := run("-resume", "-job-id=1234"); out != "" {
+		t.Fatal("duplicates not dropped", out)
+	}
+	late = nil
+
+	config["stream_resume_param"] = "since"
+	if out := run("-resume", "-job-id=1234"); out != string(result)+string(result) || since != "1500000000000" {
+		t.Fatal("stream not resumed from the checkpoint", out, since)
+	}
+	if out := run("-show-checkpoint", "-job-id=1234"); !strings.Contains(out, "Events:       5") {
+		t.Fatal("unexpected checkpoint", out)
+	}
+}
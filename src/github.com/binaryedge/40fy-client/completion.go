@@ -0,0 +1,292 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// completion_grace is how long results are still awaited after the platform
+// reports a job finished, for those already on their way.
+const completion_grace = 5 * time.Second
+
+// finishedStatuses are the job statuses after which a job sends no more
+// results.
+var finishedStatuses = map[string]bool{
+	"finished": true, "completed": true, "complete": true, "done": true, "success": true,
+	"failed": true, "error": true, "cancelled": true, "canceled": true,
+}
+
+type completionOptions struct {
+	sample     int
+	maxResults int
+	idle       time.Duration
+	timeout    time.Duration
+	poll       time.Duration
+}
+
+// completion decides when following a job is finished: when the platform
+// reports it finished, once sample or maxResults results were received, or
+// after idle without results. timeout ends it as a failure.
+type completion struct {
+	opts   completionOptions
+	jobID  string
+	status func() (string, error)
+	now    func() time.Time
+
+	mu       sync.Mutex
+	count    int
+	started  time.Time
+	last     time.Time
+	finished bool
+	errs     []string
+	reason   string
+	failed   bool
+	done     chan struct{}
+}
+
+func newCompletion(jobID string, opts completionOptions, status func() (string, error)) *completion {
+	c := &completion{opts: opts, jobID: jobID, status: status, now: time.Now, done: make(chan struct{})}
+	c.started = c.now()
+	c.last = c.started
+	return c
+}
+
+// observe counts an event that passed the filters. Once the job is done no
+// more events are passed.
+func (c *completion) observe(e event) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.reason) > 0 {
+		return false
+	}
+	c.count++
+	c.last = c.now()
+	switch {
+	case c.opts.maxResults > 0 && c.count >= c.opts.maxResults:
+		c.finishLocked("max results received", false)
+	case c.opts.sample > 0 && c.count >= c.opts.sample:
+		c.finishLocked("sample received", false)
+	}
+	return true
+}
+
+func (c *completion) finish(reason string, failed bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.finishLocked(reason, failed)
+}
+
+func (c *completion) finishLocked(reason string, failed bool) {
+	if len(c.reason) > 0 {
+		return
+	}
+	c.reason, c.failed = reason, failed
+	close(c.done)
+}
+
+func (c *completion) addError(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.errs = append(c.errs, err.Error())
+}
+
+// check finishes on the idle timeout, the overall timeout or the end of the
+// grace period after the job was reported finished.
+func (c *completion) check() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	switch {
+	case c.opts.timeout > 0 && now.Sub(c.started) >= c.opts.timeout:
+		c.finishLocked("timed out after "+c.opts.timeout.String(), true)
+	case c.finished && now.Sub(c.last) >= completion_grace:
+		c.finishLocked("job finished", false)
+	case c.opts.idle > 0 && now.Sub(c.last) >= c.opts.idle:
+		c.finishLocked("no results for "+c.opts.idle.String(), false)
+	}
+}
+
+func (c *completion) poll() {
+	status, err := c.status()
+	if err != nil {
+		c.addError(fmt.Errorf("job status: %s", err.Error()))
+		return
+	}
+	if finishedStatuses[strings.ToLower(status)] {
+		c.mu.Lock()
+		if !c.finished {
+			c.finished = true
+			// results sent before the job finished may still be on the way
+			if c.last.Before(c.now()) {
+				c.last = c.now()
+			}
+		}
+		c.mu.Unlock()
+	}
+}
+
+// run checks for completion until done, then calls stop to end the stream.
+func (c *completion) run(stop func()) {
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+	var poll <-chan time.Time
+	if c.status != nil && c.opts.poll > 0 {
+		t := time.NewTicker(c.opts.poll)
+		defer t.Stop()
+		poll = t.C
+		go c.poll()
+	}
+	for {
+		select {
+		case <-c.done:
+			stop()
+			return
+		case <-tick.C:
+			c.check()
+		case <-poll:
+			go c.poll()
+		}
+	}
+}
+
+// summary describes how following the job ended.
+func (c *completion) summary() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	what := "the stream"
+	if len(c.jobID) > 0 {
+		what = "job " + c.jobID
+	}
+	reason := c.reason
+	if len(reason) == 0 {
+		reason = "stream ended"
+	}
+	s := fmt.Sprintf("Received %d results for %s in %s, %s", c.count, what,
+		c.now().Sub(c.started)/time.Second*time.Second, reason)
+	if c.opts.sample > 0 {
+		s += fmt.Sprintf(" (sample %d)", c.opts.sample)
+	}
+	s += "\n"
+	for _, e := range c.errs {
+		s += "Error: " + e + "\n"
+	}
+	return s
+}
+
+func (c *completion) succeeded() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return !c.failed
+}
+
+// jobStatus returns a function fetching the status of the job id from the
+// tasks endpoint.
+func jobStatus(j *jobCommand, token, id string) func() (string, error) {
+	url := strings.TrimRight(j.config["job_url"].(string), "/") + "/" + id
+	return func() (string, error) {
+		bdy, err := j.do("GET", url, token)
+		if err != nil {
+			return "", err
+		}
+		var t taskStatus
+		if err := json.Unmarshal(bdy, &t); err != nil {
+			return "", err
+		}
+		return t.Status, nil
+	}
+}
+
+// completionGroup follows the completion of several jobs independently, it
+// is done once every job is done. Events of jobs not in the group go to the
+// completion of the whole stream, when there is one under the empty id.
+type completionGroup struct {
+	ids  []string
+	jobs map[string]*completion
+	done chan struct{}
+}
+
+// newCompletionGroup creates a completion for every id, or a single one for
+// the whole stream when there are none. status, when set, returns the status
+// function of a job.
+func newCompletionGroup(ids []string, opts completionOptions, status func(id string) func() (string, error)) *completionGroup {
+	if len(ids) == 0 {
+		ids = []string{""}
+	}
+	g := &completionGroup{ids: ids, jobs: map[string]*completion{}, done: make(chan struct{})}
+	for _, id := range ids {
+		var st func() (string, error)
+		if status != nil && len(id) > 0 {
+			st = status(id)
+		}
+		g.jobs[id] = newCompletion(id, opts, st)
+	}
+	return g
+}
+
+func (g *completionGroup) observe(e event) bool {
+	c, ok := g.jobs[e.jobID()]
+	if !ok {
+		if c, ok = g.jobs[""]; !ok {
+			return false
+		}
+	}
+	return c.observe(e)
+}
+
+// run runs the completion of every job and calls stop once all are done.
+func (g *completionGroup) run(stop func()) {
+	for _, c := range g.jobs {
+		go c.run(func() {})
+	}
+	for _, c := range g.jobs {
+		<-c.done
+	}
+	close(g.done)
+	stop()
+}
+
+// finish ends the jobs not done yet, for example when the stream ended.
+func (g *completionGroup) finish(reason string, failed bool, err error) {
+	for _, id := range g.ids {
+		c := g.jobs[id]
+		select {
+		case <-c.done:
+			continue
+		default:
+		}
+		if err != nil {
+			c.addError(err)
+		}
+		c.finish(reason, failed)
+	}
+}
+
+// stopped reports whether every job is done and the stream was stopped.
+func (g *completionGroup) stopped() bool {
+	select {
+	case <-g.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (g *completionGroup) summary() string {
+	s := ""
+	for _, id := range g.ids {
+		s += g.jobs[id].summary()
+	}
+	return s
+}
+
+func (g *completionGroup) succeeded() bool {
+	for _, c := range g.jobs {
+		if !c.succeeded() {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCompletion(t *testing.T) {
+	now := time.Unix(0, 0)
+	clock := func() time.Time { return now }
+
+	c := newCompletion("j1", completionOptions{maxResults: 2, sample: 3}, nil)
+	if !c.observe(nil) || !c.observe(nil) || c.observe(nil) {
+		t.Fatal("max results not applied")
+	}
+	if !strings.Contains(c.summary(), "Received 2 results for job j1") || !c.succeeded() {
+		t.Fatal("unexpected summary", c.summary())
+	}
+
+	c = newCompletion("j1", completionOptions{idle: time.Minute, timeout: time.Hour}, nil)
+	c.now = clock
+	c.started, c.last = now, now
+	now = now.Add(30 * time.Second)
+	c.observe(nil)
+	now = now.Add(59 * time.Second)
+	c.check()
+	if c.reason != "" {
+		t.Fatal("finished before idle timeout", c.reason)
+	}
+	now = now.Add(time.Second)
+	c.check()
+	if c.reason != "no results for 1m0s" || !c.succeeded() {
+		t.Fatal("idle timeout not applied", c.reason)
+	}
+
+	status := "running"
+	c = newCompletion("j1", completionOptions{timeout: time.Hour}, func() (string, error) { return status, nil })
+	c.now = clock
+	c.started, c.last = now, now
+	c.poll()
+	now = now.Add(time.Minute)
+	c.check()
+	if c.reason != "" {
+		t.Fatal("finished while running", c.reason)
+	}
+	status = "Finished"
+	c.poll()
+	now = now.Add(completion_grace)
+	c.check()
+	if c.reason != "job finished" {
+		t.Fatal("finished job not noticed", c.reason)
+	}
+
+	c = newCompletion("", completionOptions{timeout: time.Hour}, nil)
+	c.now = clock
+	c.started = now
+	now = now.Add(time.Hour)
+	c.check()
+	if c.succeeded() || !strings.Contains(c.summary(), "timed out after 1h0m0s") {
+		t.Fatal("timeout not applied", c.summary())
+	}
+}
+
+func TestCompletionGroup(t *testing.T) {
+	g := newCompletionGroup([]string{"1234", "4321"}, completionOptions{maxResults: 1}, nil)
+	e, _ := decodeEvent(jobResult)
+	if !g.observe(e) || g.observe(e) {
+		t.Fatal("max results not applied per job")
+	}
+	stopped := make(chan struct{})
+	go g.run(func() { close(stopped) })
+	select {
+	case <-stopped:
+		t.Fatal("stopped before every job was done")
+	case <-time.After(10 * time.Millisecond):
+	}
+	other, _ := decodeEvent(otherResult)
+	if !g.observe(other) {
+		t.Fatal("result of the second job dropped")
+	}
+	<-stopped
+	g.finish("stream ended", false, nil)
+	if !g.succeeded() || strings.Count(g.summary(), "max results received") != 2 {
+		t.Fatal("unexpected summary", g.summary())
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -10,15 +11,21 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/mitchellh/cli"
 )
 
 type createJobCommand struct {
+	client  http.Client
 	config  map[string]interface{}
 	output  io.Writer
-	verbose bool
+	history string
+	// retryDelay is the first wait before submitting again
+	retryDelay time.Duration
+	verbose    bool
 }
 
 type jobRequest struct {
@@ -77,6 +84,15 @@ func (l *createJobCommand) Run(args []string) int {
 	modules := create.String("modules", "", "modules of scan, example: ssh, ftp, service")
 	targets := create.String("targets", "", "target of scan, example: 8.8.8.8")
 	redirect := create.Bool("redirect", false, "flag shows stream of job created by command")
+	watch := create.Bool("watch", false, "watch the results of the job created in a full-screen dashboard")
+	labels := create.String("labels", "", "comma separated labels recorded with the job in the local history")
+	key := create.String("idempotency-key", "", "key identifying this submission, generated when empty")
+	retries := create.Int("retries", 3, "number of times a submission is retried on connection errors and server errors")
+	format := create.String("format", "", "output format of the stream when redirecting")
+	fields := create.String("fields", "", "comma separated fields of the stream to show when redirecting")
+	timeout := create.Duration("timeout", 0, "when redirecting, give up after this long")
+	maxResults := create.Int("max-results", 0, "when redirecting, stop after this many results")
+	idle := create.Duration("idle-timeout", 10*time.Minute, "when redirecting, stop when no results arrive for this long")
 	verbose := create.Bool("verbose", false, "show request and response")
 	if err := create.Parse(args); err != nil {
 		return -1
@@ -125,47 +141,82 @@ func (l *createJobCommand) Run(args []string) int {
 	}
 	byts, err := json.Marshal(job)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to make request ", err)
+		fmt.Fprintln(os.Stderr, "Failed to make request ", err)
 		return -1
 	}
 
-	url := l.config["job_url"].(string)
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(byts))
+	h, err := openHistory(l.history)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to make request ", err.Error())
+		fmt.Fprintln(os.Stderr, "Failed to read job history", err.Error())
 		return -1
 	}
-	req.Header.Add("X-Token", *token)
-	cl := http.Client{}
-	resp, err := cl.Do(req)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to make request ", err)
-		return -1
+	if len(*key) == 0 {
+		*key = newIdempotencyKey()
 	}
-	bdy, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed reading response ", err)
+	record := h.byKey(*key)
+	if record != nil && !sameRequest(record.Request, byts) {
+		fmt.Fprintf(os.Stderr, "The idempotency key %s was used for another job, use a new key\n", *key)
 		return -1
 	}
-	defer resp.Body.Close()
-	s := struct {
-		StreamURL string `json:"stream_url"`
-		JobID     string `json:"job_id"`
-		Message   string `json:"message"`
-	}{}
-	l.print("%v\n", string(bdy))
-	if err = json.Unmarshal(bdy, &s); err != nil {
-		fmt.Fprintf(os.Stderr, "Received invalid json %s", err.Error())
-		return -1
+	if record != nil && len(record.ID) == 0 {
+		// an earlier run with this key may have reached the server without
+		// hearing back, ask before submitting again
+		if s, ok := l.findSubmitted(*token, *key); ok {
+			record.ID, record.StreamURL = s.JobID, s.StreamURL
+			l.record(record, "created", "")
+		}
 	}
-	if len(s.JobID) == 0 {
-		fmt.Fprintf(os.Stderr, "Error in creating job, %s", s.Message)
-		return -1
+	if record == nil {
+		record = &jobRecord{
+			IdempotencyKey: *key,
+			Request:        byts,
+			Profile:        l.profile(),
+			Labels:         splitList(*labels),
+			CreatedAt:      time.Now().UTC(),
+		}
+	}
+	var s jobResponse
+	if len(record.ID) > 0 {
+		l.print("Job was already created with key %s\n", *key)
+		s.JobID, s.StreamURL = record.ID, record.StreamURL
+	} else {
+		l.record(record, "submitting", "")
+		if s, err = l.submit(record.Request, *token, *key, *retries); err != nil {
+			l.record(record, "failed", err.Error())
+			if err == errInvalidCredentials {
+				fmt.Println(err.Error())
+			} else {
+				fmt.Fprintf(os.Stderr, "Error in creating job, %s\n", err.Error())
+			}
+			return -1
+		}
+		record.ID = s.JobID
+		record.StreamURL = s.StreamURL
+		l.record(record, "created", s.Message)
+	}
+	if *watch {
+		cmd, _ := WatchCommandFactory()
+		return cmd.Run([]string{"-token=" + *token, "-job-id=" + s.JobID, "-sample=" + strconv.Itoa(*sample)})
 	}
 	if *redirect {
 		l.print("Redirecting to stream %s\n", l.config["stream_url"].(string))
 		cmd, _ := StreamCommandFactory()
-		return cmd.Run([]string{"-token=" + *token, "-job-id=" + s.JobID})
+		streamArgs := []string{
+			"-token=" + *token,
+			"-job-id=" + s.JobID,
+			"-wait",
+			"-sample=" + strconv.Itoa(*sample),
+			"-max-results=" + strconv.Itoa(*maxResults),
+			"-idle-timeout=" + idle.String(),
+			"-timeout=" + timeout.String(),
+		}
+		if len(*format) > 0 {
+			streamArgs = append(streamArgs, "-format="+*format)
+		}
+		if len(*fields) > 0 {
+			streamArgs = append(streamArgs, "-fields="+*fields)
+		}
+		return cmd.Run(streamArgs)
 	} else {
 		fmt.Println("You can connect to your stream with: ", s.StreamURL)
 		fmt.Println("The identifier of the job is: ", s.JobID)
@@ -173,6 +224,114 @@ func (l *createJobCommand) Run(args []string) int {
 	return 0
 }
 
+// sameRequest reports whether two job requests are the same, as recorded
+// in the history they may be indented differently.
+func sameRequest(a, b []byte) bool {
+	var ca, cb bytes.Buffer
+	if json.Compact(&ca, a) != nil || json.Compact(&cb, b) != nil {
+		return false
+	}
+	return bytes.Equal(ca.Bytes(), cb.Bytes())
+}
+
+type jobResponse struct {
+	StreamURL string `json:"stream_url"`
+	JobID     string `json:"job_id"`
+	Message   string `json:"message"`
+}
+
+// submit posts the job, retrying with backoff on connection errors and server
+// errors. Before every retry the platform is asked whether a job with the
+// same idempotency key already exists so a submission that reached the
+// server before the connection dropped is not created twice.
+func (l *createJobCommand) submit(byts []byte, token, key string, retries int) (jobResponse, error) {
+	b := newBackoff(l.retryDelay, 30*time.Second)
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			if s, ok := l.findSubmitted(token, key); ok {
+				l.print("Found job %s submitted by a previous attempt\n", s.JobID)
+				return s, nil
+			}
+		}
+		s, retry, err := l.post(byts, token, key)
+		if err == nil || !retry || attempt >= retries {
+			return s, err
+		}
+		wait := b.next()
+		fmt.Fprintf(os.Stderr, "Failed to submit job (%s), retrying in %s\n", err.Error(), wait)
+		time.Sleep(wait)
+	}
+}
+
+// post makes a single submission and reports whether a failure is worth
+// retrying.
+func (l *createJobCommand) post(byts []byte, token, key string) (s jobResponse, retry bool, err error) {
+	req, err := http.NewRequest("POST", l.config["job_url"].(string), bytes.NewBuffer(byts))
+	if err != nil {
+		return
+	}
+	req.Header.Add("X-Token", token)
+	req.Header.Add("Idempotency-Key", key)
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return s, true, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == 401 {
+		return s, false, errInvalidCredentials
+	}
+	bdy, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return s, true, err
+	}
+	l.print("%v\n", string(bdy))
+	if resp.StatusCode >= 500 {
+		return s, true, errors.New(resp.Status)
+	}
+	if err = json.Unmarshal(bdy, &s); err != nil {
+		return s, false, fmt.Errorf("received invalid json %s", err.Error())
+	}
+	if len(s.JobID) == 0 {
+		return s, false, errors.New(s.Message)
+	}
+	return s, false, nil
+}
+
+// findSubmitted looks for a job created with key in the remote job list.
+func (l *createJobCommand) findSubmitted(token, key string) (jobResponse, bool) {
+	j := &jobCommand{client: l.client, output: l.output, config: l.config, verbose: l.verbose}
+	bdy, err := j.do("GET", strings.TrimRight(l.config["job_url"].(string), "/"), token)
+	if err != nil {
+		return jobResponse{}, false
+	}
+	tasks, err := decodeTaskList(bdy)
+	if err != nil {
+		return jobResponse{}, false
+	}
+	for _, t := range tasks {
+		if t.IdempotencyKey == key && len(t.id()) > 0 {
+			return jobResponse{JobID: t.id(), StreamURL: t.StreamURL}, true
+		}
+	}
+	return jobResponse{}, false
+}
+
+// record stores the job in the local history, failing to do so is reported
+// but does not fail the command since the job itself was submitted.
+func (l *createJobCommand) record(r *jobRecord, outcome, message string) {
+	r.Outcome = outcome
+	r.Message = message
+	r.UpdatedAt = time.Now().UTC()
+	err := updateHistory(l.history, func(h *jobHistory) { h.put(r) })
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to record job in history", err.Error())
+	}
+}
+
+func (l *createJobCommand) profile() string {
+	return configProfile(l.config)
+}
+
 func (l *createJobCommand) print(pattern string, v interface{}) {
 	if l.verbose {
 		fmt.Fprintf(l.output, pattern, v)
@@ -183,29 +342,32 @@ func (l *createJobCommand) Synopsis() string { return "Create a job in the platf
 
 func (l *createJobCommand) Help() string {
 	return `
-Usage: 40fy-client create-job -token=TOKEN -targets=TARGETS -modules=MODULES -port=PORT [-redirect]
+Usage: 40fy-client create-job -token=TOKEN -targets=TARGETS -modules=MODULES -port=PORT [-labels=LABELS] [-idempotency-key=KEY] [-retries=N] [-redirect [-format=FORMAT] [-fields=FIELDS] [-timeout=DURATION] [-max-results=N] [-idle-timeout=DURATION] | -watch]
 
  The TOKEN parameter is the token given to you by BinaryEdge, it is used as authentication.
  The TARGETS parameter lists the hosts that will be targeted. Targets are a list of IPs or CIDRs.
  The MODULES parameter lists the modules used in the job.
  The PORT parameter is the port of the hosts that will be targeted in the job.
+ The LABELS parameter is an optional comma separated list of labels stored with the job in the local history.
+ The KEY parameter identifies the submission, a job already recorded in the local history with the same key is not submitted again.
+ Using a key again with other targets, modules or port is an error.
+ The N parameter is how many times a submission is retried on connection errors and server errors, defaults to 3.
  The redirect is an optional flag that sets the command to retrieve the job output from the stream after creating the job.
+ The FORMAT and FIELDS parameters set how the stream is shown when redirecting, see the help of stream.
+ When redirecting the command exits with 0 once the platform reports the job finished, the -sample results were
+ received, MAX-RESULTS were shown or no results arrived for IDLE-TIMEOUT (default 10m), and with an error after
+ TIMEOUT. A summary with the number of results, the time taken and any errors is printed to stderr.
+ The watch is an optional flag that shows the results of the job in a full-screen dashboard instead, see the help of watch.
 	`
 }
 
 func CreateJobCommandFactory() (cli.Command, error) {
 	j := &createJobCommand{
-		output: os.Stdout,
-	}
-	if contents, err := GetConfigContents(config_file_name); err == nil {
-		j.config = contents
-	} else {
-		j.config = DefaultConfig
-	}
-	for k, v := range DefaultConfig {
-		if _, ok := j.config[k]; !ok {
-			j.config[k] = v
-		}
+		client:     http.Client{},
+		output:     os.Stdout,
+		history:    historyPath(),
+		retryDelay: time.Second,
 	}
+	j.config = loadConfig()
 	return j, nil
 }
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"time"
+)
+
+const defaultDedupeKey = "ip,port,module,hash"
+
+// dedupeSet remembers event keys for a time window. seen reports whether
+// key was already added within the window and adds it otherwise.
+type dedupeSet interface {
+	seen(key uint64, now time.Time) bool
+}
+
+type dedupeOptions struct {
+	key    string
+	window time.Duration
+	mode   string
+	size   int
+	fpRate float64
+}
+
+// newDedupe returns a predicate passing only the first event of every key
+// within the window. The key is a list of fields, with the aliases of
+// filters, and hash for a hash of the result of the event.
+func newDedupe(opts dedupeOptions) (predicate, error) {
+	key, err := dedupeKeyOf(opts.key)
+	if err != nil {
+		return nil, err
+	}
+	if opts.size <= 0 {
+		return nil, fmt.Errorf("dedupe size must be positive")
+	}
+	var set dedupeSet
+	switch opts.mode {
+	case "", "lru":
+		set = newLRUSet(opts.size, opts.window)
+	case "bloom":
+		if opts.fpRate <= 0 || opts.fpRate >= 1 {
+			return nil, fmt.Errorf("dedupe false positive rate must be between 0 and 1")
+		}
+		set = newBloomSet(opts.size, opts.fpRate, opts.window)
+	default:
+		return nil, fmt.Errorf("unknown dedupe mode %q, use lru or bloom", opts.mode)
+	}
+	return func(e event) bool {
+		return !set.seen(key(e), time.Now())
+	}, nil
+}
+
+// dedupeKeyOf returns the function hashing the comma separated fields of
+// an event into its dedupe key, the default key when fields is empty. The
+// hash of an event does not change between runs.
+func dedupeKeyOf(fields string) (func(e event) uint64, error) {
+	if len(fields) == 0 {
+		fields = defaultDedupeKey
+	}
+	var accessors []accessor
+	for _, name := range splitList(fields) {
+		if name == "hash" {
+			accessors = append(accessors, resultHash)
+			continue
+		}
+		if len(splitPath(name)) == 0 {
+			return nil, fmt.Errorf("invalid dedupe field %q", name)
+		}
+		accessors = append(accessors, compilePath(name))
+	}
+	if len(accessors) == 0 {
+		return nil, fmt.Errorf("no dedupe fields given")
+	}
+	return func(e event) uint64 {
+		h := fnv.New64a()
+		for _, f := range accessors {
+			v, _ := f(e)
+			h.Write([]byte(valueString(v)))
+			h.Write([]byte{0})
+		}
+		return mix64(h.Sum64())
+	}, nil
+}
+
+// resultHash hashes the result of an event, which unlike origin does not
+// change when the same result is delivered again.
+func resultHash(e event) (interface{}, bool) {
+	v, ok := e["result"]
+	if !ok {
+		return "", false
+	}
+	byts, err := json.Marshal(v)
+	if err != nil {
+		return "", false
+	}
+	sum := sha1.Sum(byts)
+	return string(sum[:]), true
+}
+
+type lruEntry struct {
+	key  uint64
+	seen time.Time
+}
+
+// lruSet keeps the last size keys with the time they were first seen. A
+// key seen again after the window counts as new.
+type lruSet struct {
+	size   int
+	window time.Duration
+	keys   map[uint64]*list.Element
+	order  *list.List
+}
+
+func newLRUSet(size int, window time.Duration) *lruSet {
+	return &lruSet{size: size, window: window, keys: map[uint64]*list.Element{}, order: list.New()}
+}
+
+func (s *lruSet) seen(key uint64, now time.Time) bool {
+	if el, ok := s.keys[key]; ok {
+		entry := el.Value.(*lruEntry)
+		if s.window <= 0 || now.Sub(entry.seen) < s.window {
+			s.order.MoveToFront(el)
+			return true
+		}
+		entry.seen = now
+		s.order.MoveToFront(el)
+		return false
+	}
+	s.keys[key] = s.order.PushFront(&lruEntry{key, now})
+	if s.order.Len() > s.size {
+		oldest := s.order.Back()
+		s.order.Remove(oldest)
+		delete(s.keys, oldest.Value.(*lruEntry).key)
+	}
+	return false
+}
+
+type bloomFilter struct {
+	bits []uint64
+	k    int
+	n    int
+}
+
+func newBloomFilter(size int, fpRate float64) *bloomFilter {
+	m := math.Ceil(-float64(size) * math.Log(fpRate) / (math.Ln2 * math.Ln2))
+	k := int(math.Max(1, math.Floor(m/float64(size)*math.Ln2+0.5)))
+	return &bloomFilter{bits: make([]uint64, (int(m)+63)/64), k: k}
+}
+
+// test reports whether key may have been added, adding it when add is set.
+func (b *bloomFilter) test(key uint64, add bool) bool {
+	m := uint64(len(b.bits) * 64)
+	h1, h2 := key, mix64(key^0x9e3779b97f4a7c15)|1
+	found := true
+	for i := 0; i < b.k; i++ {
+		bit := (h1 + uint64(i)*h2) % m
+		if b.bits[bit/64]&(1<<(bit%64)) == 0 {
+			found = false
+			if !add {
+				return false
+			}
+			b.bits[bit/64] |= 1 << (bit % 64)
+		}
+	}
+	if add && !found {
+		b.n++
+	}
+	return found
+}
+
+// bloomSet keeps two generations of Bloom filters each sized for size keys
+// at the false positive rate. The current generation is retired after the
+// window, or once it holds size keys, so keys are remembered for between
+// one and two windows in constant memory.
+type bloomSet struct {
+	size     int
+	fpRate   float64
+	window   time.Duration
+	current  *bloomFilter
+	previous *bloomFilter
+	started  time.Time
+}
+
+func newBloomSet(size int, fpRate float64, window time.Duration) *bloomSet {
+	return &bloomSet{size: size, fpRate: fpRate, window: window, current: newBloomFilter(size, fpRate)}
+}
+
+func (s *bloomSet) seen(key uint64, now time.Time) bool {
+	if s.started.IsZero() {
+		s.started = now
+	}
+	if s.window > 0 && now.Sub(s.started) >= s.window || s.current.n >= s.size {
+		s.previous, s.current, s.started = s.current, newBloomFilter(s.size, s.fpRate), now
+	}
+	if s.previous != nil && s.previous.test(key, false) {
+		return true
+	}
+	return s.current.test(key, true)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestDedupe(t *testing.T) {
+	for _, mode := range []string{"lru", "bloom"} {
+		pred, err := newDedupe(dedupeOptions{window: time.Hour, mode: mode, size: 100, fpRate: 0.01})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		var passed []string
+		for _, l := range []string{
+			`{"origin":{"type":"ssh","ts":1},"target":{"ip":"10.0.0.1","port":22},"result":{"data":{"banner":"a"}}}`,
+			`{"origin":{"type":"ssh","ts":2},"target":{"ip":"10.0.0.1","port":22},"result":{"data":{"banner":"a"}}}`,
+			`{"origin":{"type":"ssh","ts":3},"target":{"ip":"10.0.0.1","port":22},"result":{"data":{"banner":"b"}}}`,
+			`{"origin":{"type":"ssh","ts":4},"target":{"ip":"10.0.0.2","port":22},"result":{"data":{"banner":"a"}}}`,
+		} {
+			e, _ := decodeEvent([]byte(l))
+			if pred(e) {
+				passed = append(passed, e.getString("origin.ts"))
+			}
+		}
+		if fmt.Sprint(passed) != "[1 3 4]" {
+			t.Error(mode, "passed", passed)
+		}
+	}
+}
+
+func TestLRUSetWindow(t *testing.T) {
+	s := newLRUSet(2, time.Minute)
+	now := time.Unix(0, 0)
+	if s.seen(1, now) || !s.seen(1, now.Add(time.Second)) {
+		t.Fatal("key not remembered")
+	}
+	if s.seen(1, now.Add(time.Minute)) {
+		t.Fatal("key remembered after the window")
+	}
+	s.seen(2, now)
+	s.seen(3, now)
+	if s.seen(1, now.Add(time.Minute)) || len(s.keys) != 2 {
+		t.Fatal("oldest key not evicted", len(s.keys))
+	}
+}
+
+func TestBloomSet(t *testing.T) {
+	s := newBloomSet(10000, 0.01, time.Minute)
+	now := time.Unix(0, 0)
+	for i := uint64(0); i < 10000; i++ {
+		s.seen(mix64(i), now)
+	}
+	falsePositives := 0
+	for i := uint64(10000); i < 20000; i++ {
+		if s.seen(mix64(i), now) {
+			falsePositives++
+		}
+	}
+	if falsePositives > 200 {
+		t.Error("false positives", falsePositives)
+	}
+
+	s = newBloomSet(100, 0.01, time.Minute)
+	s.seen(mix64(1), now)
+	if !s.seen(mix64(1), now.Add(90*time.Second)) {
+		t.Fatal("key forgotten within two windows")
+	}
+	if s.seen(mix64(1), now.Add(3*time.Minute)) {
+		t.Fatal("key remembered after two windows")
+	}
+}
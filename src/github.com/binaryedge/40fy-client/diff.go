@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/mitchellh/cli"
+)
+
+const results_dir_name = "results"
+
+// resultsPath is where stream -save keeps the results of a job.
+func resultsPath(jobID string) string {
+	return filepath.Join(configHome(), results_dir_name, jobID+".ndjson")
+}
+
+// openResults opens the saved results of a job for appending.
+func openResults(jobID string) (*os.File, error) {
+	path := resultsPath(jobID)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	return os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+}
+
+// resultKey identifies the same result across two runs of a job.
+type resultKey struct {
+	IP     string `json:"ip"`
+	Port   string `json:"port"`
+	Module string `json:"module"`
+}
+
+func (k resultKey) String() string {
+	return k.IP + ":" + k.Port + "/" + k.Module
+}
+
+type byResultKey []resultKey
+
+func (b byResultKey) Len() int           { return len(b) }
+func (b byResultKey) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byResultKey) Less(i, j int) bool { return b[i].String() < b[j].String() }
+
+type fieldChange struct {
+	Field string      `json:"field"`
+	Old   interface{} `json:"old,omitempty"`
+	New   interface{} `json:"new,omitempty"`
+}
+
+type resultChange struct {
+	resultKey
+	Fields []fieldChange `json:"fields"`
+}
+
+type resultDiff struct {
+	Old     string         `json:"old"`
+	New     string         `json:"new"`
+	Added   []resultKey    `json:"added"`
+	Removed []resultKey    `json:"removed"`
+	Changed []resultChange `json:"changed"`
+}
+
+// loadResults reads a file of NDJSON results and indexes the flattened
+// "result" of each by ip, port and module. Later results for the same key
+// replace earlier ones.
+func loadResults(path string) (map[resultKey]map[string]interface{}, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	results := map[resultKey]map[string]interface{}{}
+	buf := bufio.NewReader(f)
+	for n := 1; ; n++ {
+		byts, err := buf.ReadBytes('\n')
+		if len(strings.TrimSpace(string(byts))) > 0 {
+			e, derr := decodeEvent(byts)
+			if derr != nil {
+				return nil, fmt.Errorf("%s line %d: %s", path, n, derr.Error())
+			}
+			k := resultKey{e.getString("target.ip"), e.getString("target.port"), e.module()}
+			fields := map[string]interface{}{}
+			if r, ok := e["result"]; ok {
+				flatten("", r, fields)
+			}
+			results[k] = fields
+		}
+		if err == io.EOF {
+			return results, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func diffResults(old, new map[resultKey]map[string]interface{}) *resultDiff {
+	d := &resultDiff{}
+	for k, nf := range new {
+		of, ok := old[k]
+		if !ok {
+			d.Added = append(d.Added, k)
+			continue
+		}
+		if changes := diffFields(of, nf); len(changes) > 0 {
+			d.Changed = append(d.Changed, resultChange{k, changes})
+		}
+	}
+	for k := range old {
+		if _, ok := new[k]; !ok {
+			d.Removed = append(d.Removed, k)
+		}
+	}
+	sort.Sort(byResultKey(d.Added))
+	sort.Sort(byResultKey(d.Removed))
+	sort.Sort(byChangeKey(d.Changed))
+	return d
+}
+
+type byChangeKey []resultChange
+
+func (b byChangeKey) Len() int           { return len(b) }
+func (b byChangeKey) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byChangeKey) Less(i, j int) bool { return b[i].String() < b[j].String() }
+
+func diffFields(old, new map[string]interface{}) []fieldChange {
+	var names []string
+	for f := range old {
+		names = append(names, f)
+	}
+	for f := range new {
+		if _, ok := old[f]; !ok {
+			names = append(names, f)
+		}
+	}
+	sort.Strings(names)
+	var changes []fieldChange
+	for _, f := range names {
+		o, inOld := old[f]
+		n, inNew := new[f]
+		if inOld && inNew && valueString(o) == valueString(n) {
+			continue
+		}
+		changes = append(changes, fieldChange{f, o, n})
+	}
+	return changes
+}
+
+func (d *resultDiff) writeText(w io.Writer) {
+	fmt.Fprintf(w, "--- %s\n+++ %s\n", d.Old, d.New)
+	for _, k := range d.Added {
+		fmt.Fprintf(w, "+ %s\n", k)
+	}
+	for _, k := range d.Removed {
+		fmt.Fprintf(w, "- %s\n", k)
+	}
+	for _, c := range d.Changed {
+		fmt.Fprintf(w, "~ %s\n", c.resultKey)
+		for _, f := range c.Fields {
+			fmt.Fprintf(w, "    %s: %q -> %q\n", f.Field, valueString(f.Old), valueString(f.New))
+		}
+	}
+	fmt.Fprintf(w, "%d added, %d removed, %d changed\n", len(d.Added), len(d.Removed), len(d.Changed))
+}
+
+func (d *resultDiff) writeMarkdown(w io.Writer) {
+	cell := func(s string) string {
+		return "`" + strings.Replace(strings.Replace(s, "|", "\\|", -1), "`", "'", -1) + "`"
+	}
+	fmt.Fprintf(w, "# Changes from %s to %s\n\n", d.Old, d.New)
+	fmt.Fprintf(w, "%d added, %d removed, %d changed\n", len(d.Added), len(d.Removed), len(d.Changed))
+	if len(d.Added) > 0 {
+		fmt.Fprintf(w, "\n## Added\n\n")
+		for _, k := range d.Added {
+			fmt.Fprintf(w, "* %s\n", cell(k.String()))
+		}
+	}
+	if len(d.Removed) > 0 {
+		fmt.Fprintf(w, "\n## Removed\n\n")
+		for _, k := range d.Removed {
+			fmt.Fprintf(w, "* %s\n", cell(k.String()))
+		}
+	}
+	if len(d.Changed) > 0 {
+		fmt.Fprintf(w, "\n## Changed\n\n| Result | Field | Old | New |\n|---|---|---|---|\n")
+		for _, c := range d.Changed {
+			for _, f := range c.Fields {
+				fmt.Fprintf(w, "| %s | %s | %s | %s |\n", cell(c.String()), cell(f.Field), cell(valueString(f.Old)), cell(valueString(f.New)))
+			}
+		}
+	}
+}
+
+type diffCommand struct {
+	output io.Writer
+}
+
+func (d *diffCommand) Run(args []string) int {
+	diff := flag.NewFlagSet("diff", flag.ContinueOnError)
+	format := diff.String("format", "text", "output format: text, json or markdown")
+	if err := diff.Parse(args); err != nil {
+		return -1
+	}
+	if diff.NArg() != 2 {
+		fmt.Println(d.Help())
+		return -1
+	}
+	var runs [2]map[resultKey]map[string]interface{}
+	var names [2]string
+	for i, ref := range diff.Args() {
+		path, err := resultsFile(ref)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to find results", err.Error())
+			return -1
+		}
+		if runs[i], err = loadResults(path); err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to read results", err.Error())
+			return -1
+		}
+		names[i] = ref
+	}
+	res := diffResults(runs[0], runs[1])
+	res.Old, res.New = names[0], names[1]
+	switch *format {
+	case "text":
+		res.writeText(d.output)
+	case "markdown", "md":
+		res.writeMarkdown(d.output)
+	case "json":
+		byts, err := json.MarshalIndent(res, "", "  ")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			return -1
+		}
+		fmt.Fprintln(d.output, string(byts))
+	default:
+		fmt.Println(d.Help())
+		return -1
+	}
+	return 0
+}
+
+// resultsFile returns ref itself when it names a file and the saved results
+// of the job it refers to otherwise. Results are only known when they were
+// saved, the platform does not keep them to be fetched again.
+func resultsFile(ref string) (string, error) {
+	if _, err := os.Stat(ref); err == nil {
+		return ref, nil
+	}
+	id, err := resolveJobID(historyPath(), ref)
+	if err != nil {
+		return "", err
+	}
+	path := resultsPath(id)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return "", fmt.Errorf("no file %s and no results saved for job %s, save them with 40fy-client stream -job-id=%s -save", ref, id, id)
+	}
+	return path, nil
+}
+
+func (d *diffCommand) Synopsis() string { return "Compare the results of two runs of a job" }
+
+func (d *diffCommand) Help() string {
+	return `
+Usage: 40fy-client diff [-format=FORMAT] OLD NEW
+
+ OLD and NEW are files of results, one JSON object per line, or job ids whose results were saved with stream -save.
+ A job whose results were not saved is an error, they can't be fetched again.
+ Job ids can also be "last" or a label from the local job history.
+ Results are matched by ip, port and module and reported as added, removed or changed with the fields that changed.
+ The FORMAT parameter is one of text (default), json or markdown.
+	`
+}
+
+func DiffCommandFactory() (cli.Command, error) {
+	return &diffCommand{output: os.Stdout}, nil
+}
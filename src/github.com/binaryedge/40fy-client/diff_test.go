@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func writeResults(t *testing.T, lines string) string {
+	f, err := ioutil.TempFile("", "results")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer f.Close()
+	f.WriteString(lines)
+	return f.Name()
+}
+
+func TestDiffResults(t *testing.T) {
+	old := writeResults(t, `{"origin":{"type":"ssh"},"target":{"ip":"10.0.0.1","port":22},"result":{"data":{"banner":"OpenSSH_6.6"}}}
+{"origin":{"type":"http"},"target":{"ip":"10.0.0.1","port":80},"result":{"data":{"status":200}}}
+`)
+	defer os.Remove(old)
+	new := writeResults(t, `{"origin":{"type":"ssh"},"target":{"ip":"10.0.0.1","port":22},"result":{"data":{"banner":"OpenSSH_7.2"}}}
+{"origin":{"type":"ssh"},"target":{"ip":"10.0.0.2","port":22},"result":{"data":{"banner":"OpenSSH_7.2"}}}
+`)
+	defer os.Remove(new)
+
+	o, err := loadResults(old)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	n, err := loadResults(new)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	d := diffResults(o, n)
+	if len(d.Added) != 1 || d.Added[0].String() != "10.0.0.2:22/ssh" {
+		t.Fatal("added", d.Added)
+	}
+	if len(d.Removed) != 1 || d.Removed[0].String() != "10.0.0.1:80/http" {
+		t.Fatal("removed", d.Removed)
+	}
+	if len(d.Changed) != 1 || len(d.Changed[0].Fields) != 1 {
+		t.Fatal("changed", d.Changed)
+	}
+	f := d.Changed[0].Fields[0]
+	if f.Field != "data.banner" || valueString(f.Old) != "OpenSSH_6.6" || valueString(f.New) != "OpenSSH_7.2" {
+		t.Fatal("field change", f)
+	}
+}
+
+func TestCmdDiffUnsaved(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diff")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	os.Setenv(CONFIG_PATH, dir)
+	defer os.Unsetenv(CONFIG_PATH)
+	f, err := openResults("saved")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	f.WriteString(`{"origin":{"type":"ssh"},"target":{"ip":"10.0.0.1","port":22}}` + "\n")
+	f.Close()
+
+	if _, err := resultsFile("unsaved"); err == nil {
+		t.Fatal("expected an error for a job without saved results")
+	}
+	var out bytes.Buffer
+	d := &diffCommand{output: &out}
+	if status := d.Run([]string{"saved", "unsaved"}); status == 0 || out.Len() > 0 {
+		t.Fatal("diffed against results never saved", out.String())
+	}
+	if status := d.Run([]string{"saved", "saved"}); status != 0 {
+		t.Fatal("Status not 0", status)
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func init() {
+	registerSink("elasticsearch", newElasticsearchSink)
+}
+
+// esItem is one document of a bulk request, kept with its action line so
+// it can be sent again on its own.
+type esItem struct {
+	action []byte
+	doc    []byte
+	// ack, when set, is told whether the document was indexed
+	ack func(err error)
+}
+
+// esSink indexes events into Elasticsearch with the _bulk API. Events are
+// sent in batches of batch events, or when the oldest pending event is
+// flushAge old. Items the cluster rejects with a retriable status are sent
+// again on their own, up to retries times.
+//
+//	elasticsearch://[user:password@]host:9200/index-%Y.%m.%d[?batch=500&flush=5s&retries=5&api_key=KEY]
+//
+// Use elasticsearch+https to connect with TLS. The index name is formatted
+// with the time of the event. Document ids are derived from the origin job
+// id, ip, port and module so replaying events does not create duplicates.
+type esSink struct {
+	client   http.Client
+	endpoint string
+	index    string
+	user     *url.Userinfo
+	apiKey   string
+	batch    int
+	flushAge time.Duration
+	retries  int
+	batcher  *batcher
+}
+
+func newElasticsearchSink(u *url.URL) (sink, error) {
+	q := u.Query()
+	s := &esSink{
+		endpoint: transport(u, "http") + "://" + u.Host + "/_bulk",
+		index:    strings.Trim(u.Path, "/"),
+		user:     u.User,
+		apiKey:   q.Get("api_key"),
+		batch:    500,
+		flushAge: 5 * time.Second,
+		retries:  5,
+	}
+	if len(u.Host) == 0 {
+		return nil, fmt.Errorf("elasticsearch sink needs a host")
+	}
+	if len(s.index) == 0 {
+		s.index = "binaryedge-%Y.%m.%d"
+	}
+	var err error
+	if v := q.Get("batch"); len(v) > 0 {
+		if s.batch, err = strconv.Atoi(v); err != nil || s.batch <= 0 {
+			return nil, fmt.Errorf("invalid batch %q", v)
+		}
+	}
+	if v := q.Get("flush"); len(v) > 0 {
+		if s.flushAge, err = time.ParseDuration(v); err != nil {
+			return nil, err
+		}
+	}
+	if v := q.Get("retries"); len(v) > 0 {
+		if s.retries, err = strconv.Atoi(v); err != nil {
+			return nil, fmt.Errorf("invalid retries %q", v)
+		}
+	}
+	s.batcher = newBatcher(s.batch, s.flushAge, s.flush)
+	return s, nil
+}
+
+func (s *esSink) send(e event, line []byte) error {
+	return s.sendAck(e, line, nil)
+}
+
+// sendAck queues the event and calls ack once it was indexed or rejected for
+// good, or with the error once the retries are exhausted.
+func (s *esSink) sendAck(e event, line []byte, ack func(err error)) error {
+	action, err := json.Marshal(map[string]interface{}{
+		"index": map[string]string{
+			"_index": strftime(s.index, e.time()),
+			"_id":    e.id(),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	doc := bytes.TrimRight(line, "\r\n")
+	s.batcher.add(esItem{action, append([]byte(nil), doc...), ack})
+	return nil
+}
+
+// ackItems tells the senders of items the outcome of their delivery.
+func ackItems(items []esItem, err error) {
+	for _, it := range items {
+		if it.ack != nil {
+			it.ack(err)
+		}
+	}
+}
+
+// flush sends a batch of items. Failed requests are retried as a whole,
+// items rejected with 429 or 5xx are retried on their own and anything
+// still failing after the retries is reported and dropped, or left to its
+// queue to send again.
+func (s *esSink) flush(batch []interface{}) {
+	items := make([]esItem, len(batch))
+	for i, it := range batch {
+		items[i] = it.(esItem)
+	}
+	b := newBackoff(500*time.Millisecond, 30*time.Second)
+	for attempt := 0; len(items) > 0; attempt++ {
+		retry, err := s.bulk(items)
+		var failed, done []esItem
+		for i, it := range items {
+			if err != nil || retry[i] {
+				failed = append(failed, it)
+			} else {
+				done = append(done, it)
+			}
+		}
+		ackItems(done, nil)
+		if len(failed) == 0 {
+			return
+		}
+		if attempt >= s.retries {
+			msg := "rejected"
+			if err != nil {
+				msg = err.Error()
+			}
+			var queued []esItem
+			for _, it := range failed {
+				if it.ack != nil {
+					queued = append(queued, it)
+				}
+			}
+			if dropped := len(failed) - len(queued); dropped > 0 {
+				fmt.Fprintf(os.Stderr, "Elasticsearch: dropped %d event(s) after %d retries: %s\n", dropped, s.retries, msg)
+			}
+			ackItems(queued, fmt.Errorf("%s", msg))
+			return
+		}
+		time.Sleep(b.next())
+		items = failed
+	}
+}
+
+// bulk posts items and returns the indexes of the ones that should be
+// retried. A response other than 2xx fails all of them, items rejected
+// one by one for good, such as mapping errors, are reported and dropped.
+func (s *esSink) bulk(items []esItem) (map[int]bool, error) {
+	var body bytes.Buffer
+	for _, it := range items {
+		body.Write(it.action)
+		body.WriteByte('\n')
+		body.Write(it.doc)
+		body.WriteByte('\n')
+	}
+	req, err := http.NewRequest("POST", s.endpoint, &body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	if s.user != nil {
+		pass, _ := s.user.Password()
+		req.SetBasicAuth(s.user.Username(), pass)
+	}
+	if len(s.apiKey) > 0 {
+		req.Header.Set("Authorization", "ApiKey "+s.apiKey)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	bdy, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == 429 || resp.StatusCode >= 500 {
+		return nil, fmt.Errorf("%s", resp.Status)
+	}
+	if resp.StatusCode >= 300 {
+		// credentials, size or cluster problems, none of the events is in
+		return nil, fmt.Errorf("%s %s", resp.Status, strings.TrimSpace(string(bdy)))
+	}
+	r := struct {
+		Errors bool `json:"errors"`
+		Items  []map[string]struct {
+			Status int             `json:"status"`
+			Error  json.RawMessage `json:"error"`
+		} `json:"items"`
+	}{}
+	if err := json.Unmarshal(bdy, &r); err != nil {
+		return nil, fmt.Errorf("invalid bulk response: %s", err.Error())
+	}
+	if !r.Errors {
+		return nil, nil
+	}
+	retry := map[int]bool{}
+	for i, res := range r.Items {
+		if i >= len(items) {
+			break
+		}
+		for _, st := range res {
+			switch {
+			case st.Status == 429 || st.Status >= 500:
+				retry[i] = true
+			case st.Status >= 300:
+				fmt.Fprintf(os.Stderr, "Elasticsearch: rejected event: %s\n", string(st.Error))
+			}
+		}
+	}
+	return retry, nil
+}
+
+func (s *esSink) close() error {
+	s.batcher.close()
+	return nil
+}
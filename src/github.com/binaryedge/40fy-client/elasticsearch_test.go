@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestElasticsearchSink(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		requests int
+		indexed  = map[string]string{}
+	)
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests++
+		if user, pass, ok := r.BasicAuth(); !ok || user != "elastic" || pass != "secret" {
+			t.Error("missing basic auth")
+		}
+		if r.URL.Path != "/_bulk" {
+			t.Error("unexpected path", r.URL.Path)
+		}
+		var items []string
+		scanner := bufio.NewScanner(r.Body)
+		for scanner.Scan() {
+			action := struct {
+				Index struct {
+					Index string `json:"_index"`
+					ID    string `json:"_id"`
+				} `json:"index"`
+			}{}
+			json.Unmarshal(scanner.Bytes(), &action)
+			scanner.Scan()
+			// the first request rejects the second item as overloaded
+			status := 201
+			if requests == 1 && len(items) == 1 {
+				status = 429
+			} else {
+				indexed[action.Index.ID] = action.Index.Index
+			}
+			items = append(items, fmt.Sprintf(`{"index":{"status":%d}}`, status))
+		}
+		fmt.Fprintf(w, `{"errors":%v,"items":[%s]}`, requests == 1, strings.Join(items, ","))
+	}
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+
+	s, err := newSink("elasticsearch://elastic:secret@" + strings.TrimPrefix(server.URL, "http://") + "/scans-%Y.%m?batch=2")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	lines := []string{
+		`{"origin":{"type":"ssh","job_id":"1","ts":1454472000000},"target":{"ip":"10.0.0.1","port":22}}`,
+		`{"origin":{"type":"ssh","job_id":"1","ts":1454472000000},"target":{"ip":"10.0.0.2","port":22}}`,
+		`{"origin":{"type":"ssh","job_id":"1","ts":1454472000000},"target":{"ip":"10.0.0.2","port":22}}`,
+	}
+	for _, l := range lines {
+		e, _ := decodeEvent([]byte(l))
+		if err := s.send(e, []byte(l+"\n")); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if err := s.close(); err != nil {
+		t.Fatal(err.Error())
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if requests != 3 {
+		t.Fatal("requests", requests)
+	}
+	if len(indexed) != 2 {
+		t.Fatal("indexed", indexed)
+	}
+	for _, index := range indexed {
+		if index != "scans-2016.02" {
+			t.Fatal("index", index)
+		}
+	}
+}
+
+func TestElasticsearchSinkFailure(t *testing.T) {
+	status := http.StatusForbidden
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+			w.Write([]byte(`{"error":"forbidden"}`))
+			return
+		}
+		w.Write([]byte(`{"errors":true,"items":[{"index":{"status":400,"error":{"type":"mapper_parsing_exception"}}}]}`))
+	}))
+	defer server.Close()
+	sk, err := newSink("elasticsearch://" + strings.TrimPrefix(server.URL, "http://") + "/scans?retries=0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer sk.close()
+	s := sk.(*esSink)
+	var acks []error
+	item := esItem{action: []byte(`{"index":{}}`), doc: []byte(`{}`), ack: func(err error) { acks = append(acks, err) }}
+
+	// the queue keeps the events of a failed request
+	s.flush([]interface{}{item})
+	if len(acks) != 1 || acks[0] == nil || !strings.Contains(acks[0].Error(), "403") {
+		t.Fatal("failed request acknowledged", acks)
+	}
+	// an event rejected for good is dropped
+	status = http.StatusOK
+	s.flush([]interface{}{item})
+	if len(acks) != 2 || acks[1] != nil {
+		t.Fatal("rejected event kept", acks)
+	}
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	default_enrich_cache  = 100000
+	enrich_check_interval = 30 * time.Second
+)
+
+// enrichPaths maps the fields of every kind of enrichment to the paths of
+// the values in the records of the databases, MaxMind GeoIP2 and GeoLite2
+// City, Country and ASN, and ip2asn.
+var enrichPaths = map[string][][2]string{
+	"geo": {
+		{"country", "country.iso_code"},
+		{"country_name", "country.names.en"},
+		{"city", "city.names.en"},
+		{"latitude", "location.latitude"},
+		{"longitude", "location.longitude"},
+	},
+	"asn": {
+		{"number", "autonomous_system_number"},
+		{"organization", "autonomous_system_organization"},
+		{"country", "country.iso_code"},
+	},
+}
+
+// ipDatabase looks up the record of the network holding an address.
+type ipDatabase interface {
+	lookup(ip net.IP) (map[string]interface{}, bool, error)
+}
+
+// openIPDatabase opens a MaxMind DB file, ending in .mmdb, or an ip2asn TSV
+// file.
+func openIPDatabase(path string) (ipDatabase, error) {
+	if strings.HasSuffix(strings.ToLower(path), ".mmdb") {
+		return openMMDB(path)
+	}
+	return openIP2ASN(path)
+}
+
+// enrichFiles returns the database files of every kind from the table of
+// the profile of config under enrich, for example
+//
+//	[enrich.default]
+//	geo = "/usr/share/GeoIP/GeoLite2-City.mmdb"
+//	asn = ["/usr/share/GeoIP/GeoLite2-ASN.mmdb", "/usr/share/ip2asn/ip2asn-v6.tsv.gz"]
+func enrichFiles(config map[string]interface{}, kinds []string) (map[string][]string, error) {
+	profile := configProfile(config)
+	profiles, _ := config["enrich"].(map[string]interface{})
+	table, _ := profiles[profile].(map[string]interface{})
+	files := map[string][]string{}
+	for _, kind := range kinds {
+		if _, ok := enrichPaths[kind]; !ok {
+			return nil, fmt.Errorf("unknown enrichment %q, use geo or asn", kind)
+		}
+		switch v := table[kind].(type) {
+		case string:
+			files[kind] = []string{v}
+		case []interface{}:
+			for _, path := range v {
+				if s, ok := path.(string); ok {
+					files[kind] = append(files[kind], s)
+				}
+			}
+		}
+		if len(files[kind]) == 0 {
+			return nil, fmt.Errorf("no %s databases configured, set %s under [enrich.%s] in the config", kind, kind, profile)
+		}
+	}
+	return files, nil
+}
+
+// ipSource is a database file of a kind of enrichment, with the state of
+// the file it was read from.
+type ipSource struct {
+	kind string
+	path string
+	mod  time.Time
+	size int64
+	db   ipDatabase
+	// failed reports the first failed lookup only, lookups may run on
+	// several goroutines
+	failed sync.Once
+}
+
+func openIPSource(kind, path string) (*ipSource, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	db, err := openIPDatabase(path)
+	if err != nil {
+		return nil, err
+	}
+	return &ipSource{kind: kind, path: path, mod: fi.ModTime(), size: fi.Size(), db: db}, nil
+}
+
+// changed reports whether the file was changed since it was read, and
+// remembers its new state.
+func (s *ipSource) changed() bool {
+	fi, err := os.Stat(s.path)
+	if err != nil || fi.ModTime().Equal(s.mod) && fi.Size() == s.size {
+		return false
+	}
+	s.mod, s.size = fi.ModTime(), fi.Size()
+	return true
+}
+
+// enrichment is what is known about an address, as added to events and as
+// JSON.
+type enrichment struct {
+	value map[string]interface{}
+	byts  []byte
+}
+
+// enricher adds an enrichment object with the geo location and the
+// autonomous system of target.ip to events, from local databases. The
+// first database of a kind knowing an address wins. Lookups of the most
+// recent addresses are cached, and databases are read again when their
+// files change.
+type enricher struct {
+	kinds  []string
+	report io.Writer
+
+	mu      sync.RWMutex
+	sources []*ipSource
+
+	cacheMu sync.Mutex
+	cache   *enrichCache
+	// generation counts the reloads, lookups started before the last one
+	// are not cached
+	generation uint64
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newEnricher(kinds []string, files map[string][]string, cacheSize int, interval time.Duration, report io.Writer) (*enricher, error) {
+	if cacheSize <= 0 {
+		return nil, fmt.Errorf("enrich cache size must be positive")
+	}
+	en := &enricher{
+		kinds:  kinds,
+		report: report,
+		cache:  newEnrichCache(cacheSize),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	for _, kind := range kinds {
+		for _, path := range files[kind] {
+			s, err := openIPSource(kind, path)
+			if err != nil {
+				return nil, fmt.Errorf("failed to open %s database: %s", kind, err.Error())
+			}
+			en.sources = append(en.sources, s)
+		}
+	}
+	go en.watch(interval)
+	return en, nil
+}
+
+// watch reads the databases again when their files change, until the
+// enricher is closed. A database that fails to load is kept as it was.
+func (en *enricher) watch(interval time.Duration) {
+	defer close(en.done)
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-en.stop:
+			return
+		case <-tick.C:
+			en.reload()
+		}
+	}
+}
+
+func (en *enricher) reload() {
+	en.mu.RLock()
+	sources := append([]*ipSource{}, en.sources...)
+	en.mu.RUnlock()
+	for i, s := range sources {
+		en.mu.Lock()
+		changed := s.changed()
+		en.mu.Unlock()
+		if !changed {
+			continue
+		}
+		ns, err := openIPSource(s.kind, s.path)
+		if err != nil {
+			fmt.Fprintf(en.report, "Enrich: failed to reload %s, keeping the previous one: %s\n", s.path, err.Error())
+			continue
+		}
+		en.mu.Lock()
+		en.sources[i] = ns
+		en.mu.Unlock()
+		en.resetCache()
+		fmt.Fprintf(en.report, "Enrich: reloaded %s\n", s.path)
+	}
+}
+
+// resetCache forgets the cached lookups, and those still running.
+func (en *enricher) resetCache() {
+	en.cacheMu.Lock()
+	en.cache.reset()
+	en.generation++
+	en.cacheMu.Unlock()
+}
+
+// lookup returns what the databases know about ip, nil for nothing.
+func (en *enricher) lookup(ip string) *enrichment {
+	en.cacheMu.Lock()
+	r, ok := en.cache.get(ip)
+	generation := en.generation
+	en.cacheMu.Unlock()
+	if ok {
+		return r
+	}
+	value := map[string]interface{}{}
+	if parsed := net.ParseIP(ip); parsed != nil {
+		en.mu.RLock()
+		for _, s := range en.sources {
+			if _, done := value[s.kind]; done {
+				continue
+			}
+			rec, ok, err := s.db.lookup(parsed)
+			if err != nil {
+				s.failed.Do(func() {
+					fmt.Fprintf(en.report, "Enrich: failed to look up %s in %s: %s\n", ip, s.path, err.Error())
+				})
+			}
+			if !ok {
+				continue
+			}
+			fields := map[string]interface{}{}
+			for _, p := range enrichPaths[s.kind] {
+				if v, ok := lookup(rec, splitPath(p[1])); ok {
+					fields[p[0]] = v
+				}
+			}
+			if len(fields) > 0 {
+				value[s.kind] = fields
+			}
+		}
+		en.mu.RUnlock()
+	}
+	if len(value) > 0 {
+		if byts, err := json.Marshal(value); err == nil {
+			r = &enrichment{value: value, byts: byts}
+		}
+	}
+	en.cacheMu.Lock()
+	if en.generation == generation {
+		en.cache.add(ip, r)
+	}
+	en.cacheMu.Unlock()
+	return r
+}
+
+// tag adds the enrichment of the target of the event to the event and to
+// the line as received. Events that already have an enrichment field are
+// left alone.
+func (en *enricher) tag(e event, line []byte) []byte {
+	if _, ok := e["enrichment"]; ok {
+		return line
+	}
+	ip := e.getString("target.ip")
+	if len(ip) == 0 {
+		return line
+	}
+	r := en.lookup(ip)
+	if r == nil {
+		return line
+	}
+	e["enrichment"] = r.value
+	return insertField(line, "enrichment", r.byts)
+}
+
+func (en *enricher) Close() error {
+	select {
+	case <-en.stop:
+	default:
+		close(en.stop)
+		<-en.done
+	}
+	return nil
+}
+
+type enrichCacheEntry struct {
+	ip string
+	r  *enrichment
+}
+
+// enrichCache keeps the enrichment of the last size addresses looked up,
+// including those nothing is known about.
+type enrichCache struct {
+	size  int
+	items map[string]*list.Element
+	order *list.List
+}
+
+func newEnrichCache(size int) *enrichCache {
+	return &enrichCache{size: size, items: map[string]*list.Element{}, order: list.New()}
+}
+
+func (c *enrichCache) get(ip string) (*enrichment, bool) {
+	el, ok := c.items[ip]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	return el.Value.(*enrichCacheEntry).r, true
+}
+
+func (c *enrichCache) add(ip string, r *enrichment) {
+	if el, ok := c.items[ip]; ok {
+		el.Value.(*enrichCacheEntry).r = r
+		c.order.MoveToFront(el)
+		return
+	}
+	c.items[ip] = c.order.PushFront(&enrichCacheEntry{ip, r})
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*enrichCacheEntry).ip)
+	}
+}
+
+func (c *enrichCache) reset() {
+	c.items = map[string]*list.Element{}
+	c.order.Init()
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testIP2ASN = "1.0.0.0\t1.0.0.255\t13335\tUS\tCLOUDFLARENET\n" +
+	"134744064\t134744319\t15169\tUS\tGOOGLE\n" +
+	"9.9.9.0\t9.9.9.255\t0\tNone\tNot routed\n" +
+	"2001:db8::\t2001:db8:ffff:ffff:ffff:ffff:ffff:ffff\t64496\tNL\tEXAMPLE\n"
+
+func TestIP2ASN(t *testing.T) {
+	table, err := readIP2ASN(strings.NewReader(testIP2ASN))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for ip, want := range map[string]uint64{
+		"8.8.8.8":     15169,
+		"1.0.0.1":     13335,
+		"2001:db8::1": 64496,
+		"9.9.9.9":     0,
+		"1.0.1.0":     0,
+	} {
+		rec, ok, _ := table.lookup(net.ParseIP(ip))
+		if want == 0 && ok || want != 0 && rec["autonomous_system_number"] != want {
+			t.Fatal("unexpected record of", ip, rec)
+		}
+	}
+	if _, err := readIP2ASN(strings.NewReader("1.0.0.0\tnope\t1\n")); err == nil {
+		t.Fatal("expected an error for an invalid range")
+	}
+}
+
+func enrichConfig(dir string) map[string]interface{} {
+	return map[string]interface{}{
+		"profile": "prod",
+		"enrich": map[string]interface{}{
+			"prod": map[string]interface{}{
+				"geo": filepath.Join(dir, "city.mmdb"),
+				"asn": []interface{}{filepath.Join(dir, "asn.tsv")},
+			},
+		},
+	}
+}
+
+func writeEnrichFiles(t *testing.T, dir, country string) {
+	mmdb := writeMMDB(6, 24, nil, []mmdbNetwork{{"8.8.8.0/24", testCity(country, false)}})
+	if err := ioutil.WriteFile(filepath.Join(dir, "city.mmdb"), mmdb, 0600); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "asn.tsv"), []byte(testIP2ASN), 0600); err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+func TestEnricher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "enrich")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	writeEnrichFiles(t, dir, "US")
+	if _, err := enrichFiles(enrichConfig(dir), []string{"geo", "city"}); err == nil {
+		t.Fatal("expected an error for an unknown enrichment")
+	}
+	if _, err := enrichFiles(map[string]interface{}{}, []string{"geo"}); err == nil || !strings.Contains(err.Error(), "[enrich.default]") {
+		t.Fatal("expected an error without databases", err)
+	}
+	files, err := enrichFiles(enrichConfig(dir), []string{"geo", "asn"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	var report bytes.Buffer
+	en, err := newEnricher([]string{"geo", "asn"}, files, 10, time.Hour, &report)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer en.Close()
+
+	line := []byte(`{"target":{"ip":"8.8.8.8","port":53}}` + "\n")
+	e, _ := decodeEvent(line)
+	tagged := en.tag(e, line)
+	want := `{"enrichment":{"asn":{"country":"US","number":15169,"organization":"GOOGLE"},` +
+		`"geo":{"city":"Mountain View","country":"US","country_name":"US name","latitude":37.386,"longitude":-122.0838}},` +
+		`"target":{"ip":"8.8.8.8","port":53}}` + "\n"
+	if string(tagged) != want {
+		t.Fatal("unexpected line", string(tagged))
+	}
+	if v := e.getString("enrichment.asn.organization"); v != "GOOGLE" {
+		t.Fatal("event not enriched", e)
+	}
+	unknown := []byte(`{"target":{"ip":"10.0.0.1"}}`)
+	e, _ = decodeEvent(unknown)
+	if string(en.tag(e, unknown)) != string(unknown) {
+		t.Fatal("unknown address enriched")
+	}
+	if _, ok := en.cache.get("10.0.0.1"); !ok {
+		t.Fatal("unknown address not cached")
+	}
+
+	// the geo database changes
+	writeEnrichFiles(t, dir, "DE")
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(filepath.Join(dir, "city.mmdb"), later, later)
+	en.reload()
+	if !strings.Contains(report.String(), "reloaded "+filepath.Join(dir, "city.mmdb")) {
+		t.Fatal("database not reloaded", report.String())
+	}
+	e, _ = decodeEvent(line)
+	en.tag(e, line)
+	if v := e.getString("enrichment.geo.country"); v != "DE" {
+		t.Fatal("stale enrichment", v)
+	}
+}
+
+func TestCmdEnrich(t *testing.T) {
+	dir, err := ioutil.TempDir("", "enrich")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	writeEnrichFiles(t, dir, "US")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"origin":{"job_id":"1234"},"target":{"ip":"8.8.8.8","port":53}}` + "\n"))
+	}))
+	defer server.Close()
+	config := testConfig(server.URL, token)
+	for k, v := range enrichConfig(dir) {
+		config[k] = v
+	}
+	buffer := bytes.NewBuffer([]byte{})
+	c := FirehoseCommand{http.Client{}, buffer, config, false}
+	if status := c.Run([]string{"-enrich=geo,asn", "-fields=target.ip,enrichment.geo.country,enrichment.asn.number"}); status != 0 {
+		t.Fatal("Status not 0", status)
+	}
+	if got := buffer.String(); got != `{"target.ip":"8.8.8.8","enrichment.geo.country":"US","enrichment.asn.number":15169}`+"\n" {
+		t.Fatal("unexpected output", got)
+	}
+}
+
+// blockingDB fails its lookups, each one once released.
+type blockingDB struct {
+	started chan bool
+	release chan bool
+}
+
+func (db blockingDB) lookup(ip net.IP) (map[string]interface{}, bool, error) {
+	db.started <- true
+	<-db.release
+	return nil, false, errors.New("corrupt database")
+}
+
+func TestEnricherConcurrentLookups(t *testing.T) {
+	db := blockingDB{make(chan bool), make(chan bool)}
+	var report bytes.Buffer
+	en := &enricher{
+		kinds:   []string{"asn"},
+		report:  &report,
+		sources: []*ipSource{{kind: "asn", path: "asn.tsv", db: db}},
+		cache:   newEnrichCache(10),
+	}
+	var wg sync.WaitGroup
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2"} {
+		wg.Add(1)
+		go func(ip string) {
+			defer wg.Done()
+			en.lookup(ip)
+		}(ip)
+	}
+	<-db.started
+	<-db.started
+	// a reload while the lookups run
+	en.resetCache()
+	close(db.release)
+	wg.Wait()
+	if n := strings.Count(report.String(), "failed to look up"); n != 1 {
+		t.Fatal("failures reported", n, "times")
+	}
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2"} {
+		if _, ok := en.cache.get(ip); ok {
+			t.Fatal("lookup from before the reload cached", ip)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// event is a single result from the stream decoded into generic JSON values,
+// see decodeEvent.
+type event map[string]interface{}
+
+// splitPath splits a dotted path with optional array indexes, for example
+// "result.data.ports[0].port", into its segments.
+func splitPath(path string) []string {
+	path = strings.Replace(path, "[", ".", -1)
+	path = strings.Replace(path, "]", "", -1)
+	segs := strings.Split(path, ".")
+	filterEmpty(&segs)
+	return segs
+}
+
+// lookup walks v along the path segments. Segments index into arrays when
+// they are numbers.
+func lookup(v interface{}, path []string) (interface{}, bool) {
+	for _, seg := range path {
+		switch n := v.(type) {
+		case map[string]interface{}:
+			var ok bool
+			if v, ok = n[seg]; !ok {
+				return nil, false
+			}
+		case event:
+			var ok bool
+			if v, ok = n[seg]; !ok {
+				return nil, false
+			}
+		case []interface{}:
+			i, err := strconv.Atoi(seg)
+			if err != nil || i < 0 || i >= len(n) {
+				return nil, false
+			}
+			v = n[i]
+		default:
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+func (e event) get(path string) (interface{}, bool) {
+	return lookup(e, splitPath(path))
+}
+
+func (e event) getString(path string) string {
+	v, ok := e.get(path)
+	if !ok {
+		return ""
+	}
+	return valueString(v)
+}
+
+// jobID is the id of the job that produced the event.
+func (e event) jobID() string {
+	return e.getString("origin.job_id")
+}
+
+// module is the module that produced the event, reported by the platform as
+// the origin type.
+func (e event) module() string {
+	if m := e.getString("origin.type"); len(m) > 0 {
+		return m
+	}
+	return e.getString("origin.module")
+}
+
+// time is the time the platform reported for the event, origin.ts in
+// milliseconds, or now when it has none.
+func (e event) time() time.Time {
+	if v, ok := e.get("origin.ts"); ok {
+		if ms, ok := number(v); ok && ms > 0 {
+			return time.Unix(0, int64(ms)*int64(time.Millisecond)).UTC()
+		}
+	}
+	return time.Now().UTC()
+}
+
+// id identifies a result by origin job id, ip, port and module, independently
+// of when it was received.
+func (e event) id() string {
+	h := sha1.New()
+	for _, v := range []string{e.jobID(), e.getString("target.ip"), e.getString("target.port"), e.module()} {
+		h.Write([]byte(v))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// insertField adds the field name with the JSON value to the object on line
+// as its first field, keeping the rest of the line as it is.
+func insertField(line []byte, name string, value []byte) []byte {
+	i := bytes.IndexByte(line, '{')
+	if i < 0 {
+		return line
+	}
+	out := append([]byte{}, line[:i+1]...)
+	out = strconv.AppendQuote(out, name)
+	out = append(out, ':')
+	out = append(out, value...)
+	if rest := bytes.TrimLeft(line[i+1:], " \t\r\n"); len(rest) > 0 && rest[0] != '}' {
+		out = append(out, ',')
+	}
+	return append(out, line[i+1:]...)
+}
+
+// valueString renders a JSON value as text, strings and numbers as they are
+// and everything else as JSON.
+func valueString(v interface{}) string {
+	switch n := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return n
+	case json.Number:
+		return n.String()
+	case bool:
+		return strconv.FormatBool(n)
+	case float64:
+		return strconv.FormatFloat(n, 'f', -1, 64)
+	}
+	byts, err := json.Marshal(v)
+	if err != nil {
+		return ""
+	}
+	return string(byts)
+}
+
+// flatten stores every leaf of v in out keyed by its dotted path.
+func flatten(prefix string, v interface{}, out map[string]interface{}) {
+	join := func(k string) string {
+		if len(prefix) == 0 {
+			return k
+		}
+		return prefix + "." + k
+	}
+	switch n := v.(type) {
+	case map[string]interface{}:
+		for k, c := range n {
+			flatten(join(k), c, out)
+		}
+	case event:
+		for k, c := range n {
+			flatten(join(k), c, out)
+		}
+	case []interface{}:
+		for i, c := range n {
+			flatten(prefix+"["+strconv.Itoa(i)+"]", c, out)
+		}
+	default:
+		out[prefix] = v
+	}
+}
@@ -0,0 +1,502 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// predicate is a compiled filter expression.
+type predicate func(e event) bool
+
+// compileFilter compiles a filter expression such as
+//
+//	target.port in (22, 2222) && target.ip in 10.0.0.0/8 && module == "ssh" && result.data.banner ~ /OpenSSH_7/
+//
+// Expressions combine comparisons with &&, || and ! (or and, or, not) and
+// parentheses. A comparison is a field path followed by one of
+// == != < <= > >= against a number or a string, ~ or !~ against a /regex/,
+// or "in" against a CIDR or a parenthesised list of values and CIDRs. A bare
+// path is true when the field is present and not empty, false or zero.
+// When a path resolves to an array the comparison holds if it holds for any
+// element.
+func compileFilter(src string) (predicate, error) {
+	toks, err := lexFilter(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &filterParser{toks: toks}
+	pred, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokEOF {
+		return nil, fmt.Errorf("filter: unexpected %q at %d", t.text, t.pos)
+	}
+	return pred, nil
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokWord
+	tokString
+	tokRegex
+	tokOp
+	tokLParen
+	tokRParen
+	tokComma
+)
+
+type filterToken struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+var filterOps = []string{"&&", "||", "==", "!=", "<=", ">=", "!~", "<", ">", "~", "!"}
+
+func isWordByte(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+		c == '_' || c == '.' || c == '[' || c == ']' || c == ':' || c == '-'
+}
+
+func lexFilter(src string) ([]filterToken, error) {
+	var toks []filterToken
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(':
+			toks = append(toks, filterToken{tokLParen, "(", i})
+			i++
+		case c == ')':
+			toks = append(toks, filterToken{tokRParen, ")", i})
+			i++
+		case c == ',':
+			toks = append(toks, filterToken{tokComma, ",", i})
+			i++
+		case c == '"' || c == '\'' || c == '/':
+			kind := tokString
+			if c == '/' {
+				kind = tokRegex
+			}
+			text, n, err := lexQuoted(src[i:], c)
+			if err != nil {
+				return nil, fmt.Errorf("filter: %s at %d", err.Error(), i)
+			}
+			toks = append(toks, filterToken{kind, text, i})
+			i += n
+		case isWordByte(c):
+			start := i
+			for i < len(src) && (isWordByte(src[i]) || src[i] == '/' && i+1 < len(src) && src[i+1] >= '0' && src[i+1] <= '9') {
+				i++
+			}
+			toks = append(toks, filterToken{tokWord, src[start:i], start})
+		default:
+			found := false
+			for _, op := range filterOps {
+				if strings.HasPrefix(src[i:], op) {
+					toks = append(toks, filterToken{tokOp, op, i})
+					i += len(op)
+					found = true
+					break
+				}
+			}
+			if !found {
+				return nil, fmt.Errorf("filter: unexpected %q at %d", c, i)
+			}
+		}
+	}
+	return append(toks, filterToken{tokEOF, "", len(src)}), nil
+}
+
+// lexQuoted reads a string or regex delimited by quote. Backslash escapes the
+// delimiter, in strings it also escapes itself while in regexes it is kept
+// so regexp sees its own escapes.
+func lexQuoted(src string, quote byte) (string, int, error) {
+	var b []byte
+	for i := 1; i < len(src); i++ {
+		c := src[i]
+		if c == '\\' && i+1 < len(src) {
+			next := src[i+1]
+			if next == quote || quote != '/' && next == '\\' {
+				b = append(b, next)
+			} else {
+				b = append(b, c, next)
+			}
+			i++
+			continue
+		}
+		if c == quote {
+			return string(b), i + 1, nil
+		}
+		b = append(b, c)
+	}
+	return "", 0, fmt.Errorf("unterminated %c", quote)
+}
+
+type filterParser struct {
+	toks []filterToken
+	pos  int
+}
+
+func (p *filterParser) peek() filterToken { return p.toks[p.pos] }
+
+func (p *filterParser) next() filterToken {
+	t := p.toks[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *filterParser) isKeyword(words ...string) bool {
+	t := p.peek()
+	for _, w := range words {
+		if (t.kind == tokOp || t.kind == tokWord) && t.text == w {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *filterParser) parseOr() (predicate, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.isKeyword("||", "or") {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(e event) bool { return l(e) || right(e) }
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseAnd() (predicate, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.isKeyword("&&", "and") {
+		p.next()
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(e event) bool { return l(e) && right(e) }
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseNot() (predicate, error) {
+	if p.isKeyword("!", "not") {
+		p.next()
+		inner, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return func(e event) bool { return !inner(e) }, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *filterParser) parsePrimary() (predicate, error) {
+	t := p.next()
+	switch t.kind {
+	case tokLParen:
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if r := p.next(); r.kind != tokRParen {
+			return nil, fmt.Errorf("filter: expected ) at %d", r.pos)
+		}
+		return inner, nil
+	case tokWord:
+		return p.parseComparison(compilePath(t.text))
+	}
+	return nil, fmt.Errorf("filter: expected field at %d", t.pos)
+}
+
+func (p *filterParser) parseComparison(get accessor) (predicate, error) {
+	op := p.peek()
+	switch {
+	case op.kind == tokOp && (op.text == "~" || op.text == "!~"):
+		p.next()
+		t := p.next()
+		if t.kind != tokRegex && t.kind != tokString {
+			return nil, fmt.Errorf("filter: expected /regex/ at %d", t.pos)
+		}
+		re, err := regexp.Compile(t.text)
+		if err != nil {
+			return nil, fmt.Errorf("filter: %s", err.Error())
+		}
+		match := func(v interface{}) bool { return re.MatchString(valueString(v)) }
+		if op.text == "!~" {
+			return func(e event) bool { v, ok := get(e); return !ok || !anyValue(v, match) }, nil
+		}
+		return func(e event) bool { v, ok := get(e); return ok && anyValue(v, match) }, nil
+	case op.kind == tokWord && op.text == "in":
+		p.next()
+		lits, err := p.parseSet()
+		if err != nil {
+			return nil, err
+		}
+		match := func(v interface{}) bool {
+			for _, l := range lits {
+				if l.match(v) {
+					return true
+				}
+			}
+			return false
+		}
+		return func(e event) bool { v, ok := get(e); return ok && anyValue(v, match) }, nil
+	case op.kind == tokOp && op.text != "&&" && op.text != "||" && op.text != "!":
+		p.next()
+		t := p.next()
+		if t.kind != tokWord && t.kind != tokString {
+			return nil, fmt.Errorf("filter: expected value at %d", t.pos)
+		}
+		l := newLiteral(t)
+		var cmp func(v interface{}) bool
+		switch op.text {
+		case "==":
+			cmp = l.equal
+		case "!=":
+			return func(e event) bool { v, ok := get(e); return !ok || !anyValue(v, l.equal) }, nil
+		default:
+			if !l.isNum {
+				return nil, fmt.Errorf("filter: %s needs a number at %d", op.text, t.pos)
+			}
+			cmp = l.compare(op.text)
+		}
+		return func(e event) bool { v, ok := get(e); return ok && anyValue(v, cmp) }, nil
+	}
+	return func(e event) bool { v, ok := get(e); return ok && truthy(v) }, nil
+}
+
+// parseSet reads the right hand side of "in", a single value or a
+// parenthesised list.
+func (p *filterParser) parseSet() ([]*literal, error) {
+	if p.peek().kind != tokLParen {
+		t := p.next()
+		if t.kind != tokWord && t.kind != tokString {
+			return nil, fmt.Errorf("filter: expected value at %d", t.pos)
+		}
+		return []*literal{newLiteral(t)}, nil
+	}
+	p.next()
+	var lits []*literal
+	for {
+		t := p.next()
+		if t.kind != tokWord && t.kind != tokString {
+			return nil, fmt.Errorf("filter: expected value at %d", t.pos)
+		}
+		lits = append(lits, newLiteral(t))
+		t = p.next()
+		if t.kind == tokRParen {
+			return lits, nil
+		}
+		if t.kind != tokComma {
+			return nil, fmt.Errorf("filter: expected , or ) at %d", t.pos)
+		}
+	}
+}
+
+// accessor fetches a field from an event.
+type accessor func(e event) (interface{}, bool)
+
+// filterAliases are short names for commonly used fields.
+var filterAliases = map[string]string{
+	"ip":     "target.ip",
+	"port":   "target.port",
+	"job_id": "origin.job_id",
+}
+
+func compilePath(name string) accessor {
+	if name == "module" {
+		return func(e event) (interface{}, bool) {
+			m := e.module()
+			return m, len(m) > 0
+		}
+	}
+	if full, ok := filterAliases[name]; ok {
+		name = full
+	}
+	segs := splitPath(name)
+	return func(e event) (interface{}, bool) { return lookup(e, segs) }
+}
+
+func anyValue(v interface{}, f func(interface{}) bool) bool {
+	if arr, ok := v.([]interface{}); ok {
+		for _, el := range arr {
+			if f(el) {
+				return true
+			}
+		}
+		return false
+	}
+	return f(v)
+}
+
+func truthy(v interface{}) bool {
+	switch n := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return n
+	case string:
+		return len(n) > 0
+	case json.Number:
+		f, err := n.Float64()
+		return err != nil || f != 0
+	case []interface{}:
+		return len(n) > 0
+	case map[string]interface{}:
+		return len(n) > 0
+	}
+	return true
+}
+
+// literal is a constant on the right hand side of a comparison, parsed once
+// into every form it may be compared as.
+type literal struct {
+	s     string
+	num   float64
+	isNum bool
+	cidr  *net.IPNet
+	v4net uint32
+	v4len uint32
+	isV4  bool
+}
+
+func newLiteral(t filterToken) *literal {
+	l := &literal{s: t.text}
+	if f, err := strconv.ParseFloat(t.text, 64); err == nil && t.kind == tokWord {
+		l.num, l.isNum = f, true
+	}
+	if strings.Contains(t.text, "/") {
+		if _, n, err := net.ParseCIDR(t.text); err == nil {
+			l.cidr = n
+			if ip4 := n.IP.To4(); ip4 != nil {
+				ones, _ := n.Mask.Size()
+				if ones > 32 {
+					ones -= 96
+				}
+				l.v4net = uint32(ip4[0])<<24 | uint32(ip4[1])<<16 | uint32(ip4[2])<<8 | uint32(ip4[3])
+				l.v4len = uint32(ones)
+				l.isV4 = true
+			}
+		}
+	}
+	return l
+}
+
+func (l *literal) match(v interface{}) bool {
+	if l.cidr != nil {
+		return l.contains(valueString(v))
+	}
+	return l.equal(v)
+}
+
+// contains reports whether the address ip is in the literal's network,
+// IPv4 addresses are checked without allocating.
+func (l *literal) contains(ip string) bool {
+	if a, ok := parseIPv4(ip); ok {
+		if !l.isV4 {
+			return false
+		}
+		if l.v4len == 0 {
+			return true
+		}
+		shift := 32 - l.v4len
+		return a>>shift == l.v4net>>shift
+	}
+	parsed := net.ParseIP(ip)
+	return parsed != nil && l.cidr.Contains(parsed)
+}
+
+func (l *literal) equal(v interface{}) bool {
+	if l.isNum {
+		if f, ok := number(v); ok {
+			return f == l.num
+		}
+	}
+	switch n := v.(type) {
+	case string:
+		return n == l.s
+	case json.Number:
+		return string(n) == l.s
+	}
+	return valueString(v) == l.s
+}
+
+func (l *literal) compare(op string) func(v interface{}) bool {
+	return func(v interface{}) bool {
+		f, ok := number(v)
+		if !ok {
+			return false
+		}
+		switch op {
+		case "<":
+			return f < l.num
+		case "<=":
+			return f <= l.num
+		case ">":
+			return f > l.num
+		case ">=":
+			return f >= l.num
+		}
+		return false
+	}
+}
+
+func number(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case json.Number:
+		f, err := strconv.ParseFloat(string(n), 64)
+		return f, err == nil
+	case float64:
+		return n, true
+	case string:
+		f, err := strconv.ParseFloat(n, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// parseIPv4 parses a dotted quad without allocating.
+func parseIPv4(s string) (uint32, bool) {
+	var ip, part uint32
+	parts, digits := 0, 0
+	for i := 0; i <= len(s); i++ {
+		if i == len(s) || s[i] == '.' {
+			if digits == 0 || part > 255 {
+				return 0, false
+			}
+			ip = ip<<8 | part
+			part, digits = 0, 0
+			parts++
+			continue
+		}
+		c := s[i]
+		if c < '0' || c > '9' || digits == 3 {
+			return 0, false
+		}
+		part = part*10 + uint32(c-'0')
+		digits++
+	}
+	return ip, parts == 4
+}
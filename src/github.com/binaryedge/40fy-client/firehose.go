@@ -21,6 +21,8 @@ func (s *FirehoseCommand) Run(args []string) int {
 	firehose := flag.NewFlagSet("firehose", flag.ContinueOnError)
 	token := firehose.String("token", "", "")
 	verbose := firehose.Bool("verbose", false, "show request and response")
+	flags := addStreamFlags(firehose)
+	flags.config = s.config
 	if err := firehose.Parse(args); err != nil {
 		return -1
 	}
@@ -38,6 +40,13 @@ func (s *FirehoseCommand) Run(args []string) int {
 		fmt.Println(s.Help())
 		return -1
 	}
+	p, err := flags.build(s.output, "")
+	if err != nil {
+		fmt.Println(err.Error())
+		return -1
+	}
+	defer p.close()
+	p.closeOnInterrupt()
 	req, err := http.NewRequest("GET", s.config["firehose_url"].(string), nil)
 	if err != nil {
 		fmt.Println("Failed to connect ", err.Error())
@@ -57,7 +66,17 @@ func (s *FirehoseCommand) Run(args []string) int {
 		fmt.Println(msg)
 		return -1
 	}
-	io.Copy(s.output, resp.Body)
+	err = readFromResponse(resp.Body, p)
+	if err != nil {
+		fmt.Println("Failed to read stream ", err.Error())
+	}
+	if cerr := p.close(); cerr != nil {
+		fmt.Println("Failed to close output ", cerr.Error())
+		return -1
+	}
+	if err != nil {
+		return -1
+	}
 	return 0
 }
 
@@ -73,10 +92,10 @@ func (s *FirehoseCommand) Synopsis() string {
 
 func (s *FirehoseCommand) Help() string {
 	return `
-Usage: 40fy-client firehose -token=TOKEN
+Usage: 40fy-client firehose -token=TOKEN [OUTPUT OPTIONS]
 
  The "TOKEN" parameter is the token given to you by BinaryEdge, it is used as authentication.
-	`
+` + streamFlagsHelp
 }
 
 func FirehoseCommandFactory() (cli.Command, error) {
@@ -84,15 +103,6 @@ func FirehoseCommandFactory() (cli.Command, error) {
 		client: http.Client{},
 		output: os.Stdout,
 	}
-	if contents, err := GetConfigContents(config_file_name); err == nil {
-		f.config = contents
-	} else {
-		f.config = DefaultConfig
-	}
-	for k, v := range DefaultConfig {
-		if _, ok := f.config[k]; !ok {
-			f.config[k] = v
-		}
-	}
+	f.config = loadConfig()
 	return f, nil
 }
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/mitchellh/cli"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// defaultColumns are the fields shown by the tabular formats when none are
+// given.
+const defaultColumns = "target.ip,target.port,origin.type,origin.job_id"
+
+// formatter writes events to an output in one format. line is the event as
+// it was received.
+type formatter interface {
+	write(e event, line []byte) error
+}
+
+type formatOptions struct {
+	proj      *projection
+	delimiter string
+	maxWidth  int
+	tty       bool
+	// fieldMap is the TOML file mapping event fields for cef and leef
+	fieldMap string
+}
+
+type formatterFactory func(w io.Writer, opts formatOptions) (formatter, error)
+
+var formats = map[string]formatterFactory{}
+
+// registerFormat makes a format available to --format.
+func registerFormat(name string, f formatterFactory) {
+	formats[name] = f
+}
+
+func formatNames() string {
+	var names []string
+	for name := range formats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+func newFormatter(name string, w io.Writer, opts formatOptions) (formatter, error) {
+	f, ok := formats[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown format %q, use one of %s", name, formatNames())
+	}
+	return f(w, opts)
+}
+
+// isTerminal reports whether w writes to a terminal.
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	return ok && terminal.IsTerminal(int(f.Fd()))
+}
+
+func init() {
+	registerFormat("ndjson", newJSONFormatter(false))
+	registerFormat("pretty", newJSONFormatter(true))
+	registerFormat("csv", newCSVFormatter(','))
+	registerFormat("tsv", newDelimitedFormatter("\t"))
+	registerFormat("delimited", newDelimitedFormatter(""))
+	registerFormat("table", newTableFormatter)
+}
+
+// jsonFormatter re-encodes every event, or its projected fields, as compact
+// JSON on one line or indented.
+type jsonFormatter struct {
+	w      io.Writer
+	proj   *projection
+	indent bool
+}
+
+func newJSONFormatter(indent bool) formatterFactory {
+	return func(w io.Writer, opts formatOptions) (formatter, error) {
+		return &jsonFormatter{w, opts.proj, indent}, nil
+	}
+}
+
+func (f *jsonFormatter) write(e event, line []byte) error {
+	var (
+		byts []byte
+		err  error
+	)
+	if f.proj != nil {
+		byts, err = f.proj.object(e)
+	} else {
+		byts, err = json.Marshal(e)
+	}
+	if err != nil {
+		return err
+	}
+	if f.indent {
+		var v interface{}
+		d := json.NewDecoder(bytes.NewReader(byts))
+		d.UseNumber()
+		if err = d.Decode(&v); err != nil {
+			return err
+		}
+		if byts, err = json.MarshalIndent(v, "", "  "); err != nil {
+			return err
+		}
+	}
+	byts = append(bytes.TrimRight(byts, "\n"), '\n')
+	_, err = f.w.Write(byts)
+	return err
+}
+
+func columns(opts formatOptions) (*projection, error) {
+	if opts.proj != nil {
+		return opts.proj, nil
+	}
+	return parseProjection(defaultColumns, "")
+}
+
+// csvFormatter writes projected fields as CSV with a header line.
+type csvFormatter struct {
+	w      *csv.Writer
+	proj   *projection
+	header bool
+}
+
+func newCSVFormatter(comma rune) formatterFactory {
+	return func(w io.Writer, opts formatOptions) (formatter, error) {
+		proj, err := columns(opts)
+		if err != nil {
+			return nil, err
+		}
+		cw := csv.NewWriter(w)
+		cw.Comma = comma
+		return &csvFormatter{w: cw, proj: proj}, nil
+	}
+}
+
+func (f *csvFormatter) write(e event, line []byte) error {
+	if !f.header {
+		f.header = true
+		f.w.Write(f.proj.names())
+	}
+	f.w.Write(f.proj.strings(e))
+	f.w.Flush()
+	return f.w.Error()
+}
+
+// delimitedFormatter writes projected fields separated by a delimiter,
+// escaping it inside values. tsv starts with a header line, the delimited
+// format used by --delimiter does not.
+type delimitedFormatter struct {
+	w      io.Writer
+	proj   *projection
+	delim  string
+	header bool
+}
+
+func newDelimitedFormatter(delim string) formatterFactory {
+	return func(w io.Writer, opts formatOptions) (formatter, error) {
+		proj, err := columns(opts)
+		if err != nil {
+			return nil, err
+		}
+		d := delim
+		if len(d) == 0 {
+			d = opts.delimiter
+		}
+		if len(d) == 0 {
+			return nil, fmt.Errorf("delimited format needs a delimiter")
+		}
+		return &delimitedFormatter{w: w, proj: proj, delim: d, header: len(delim) == 0}, nil
+	}
+}
+
+func (f *delimitedFormatter) write(e event, line []byte) error {
+	if !f.header {
+		f.header = true
+		names := f.proj.names()
+		for i := range names {
+			names[i] = escapeField(names[i], f.delim)
+		}
+		if _, err := io.WriteString(f.w, strings.Join(names, f.delim)+"\n"); err != nil {
+			return err
+		}
+	}
+	_, err := f.w.Write(f.proj.delimited(e, f.delim))
+	return err
+}
+
+// Rows held back by the table format to size its columns: the first
+// table_sample_rows rows, or those received within table_sample_wait of the
+// first one.
+const (
+	table_sample_rows = 20
+	table_sample_wait = time.Second
+)
+
+// tableFormatter aligns projected fields in columns. Column widths are set
+// once from the header and the first rows, up to maxWidth, so every row is
+// aligned with the ones before it; longer values are truncated. On a
+// terminal the header is coloured.
+type tableFormatter struct {
+	mu       sync.Mutex
+	ui       cli.Ui
+	proj     *projection
+	widths   []int
+	maxWidth int
+	// sample holds the first rows until the widths are set
+	sample [][]string
+	timer  *time.Timer
+	fixed  bool
+}
+
+func newTableFormatter(w io.Writer, opts formatOptions) (formatter, error) {
+	proj, err := columns(opts)
+	if err != nil {
+		return nil, err
+	}
+	var ui cli.Ui = &cli.BasicUi{Writer: w, ErrorWriter: w}
+	if opts.tty {
+		ui = &cli.ColoredUi{
+			OutputColor: cli.UiColorNone,
+			InfoColor:   cli.UiColorCyan,
+			ErrorColor:  cli.UiColorRed,
+			WarnColor:   cli.UiColorYellow,
+			Ui:          ui,
+		}
+	}
+	maxWidth := opts.maxWidth
+	if maxWidth <= 0 {
+		maxWidth = 40
+	}
+	return &tableFormatter{ui: ui, proj: proj, widths: make([]int, len(proj.fields)), maxWidth: maxWidth}, nil
+}
+
+// cell replaces control characters so a value stays on its line.
+func cell(v string) string {
+	return strings.Map(func(r rune) rune {
+		if r < ' ' {
+			return ' '
+		}
+		return r
+	}, v)
+}
+
+func (f *tableFormatter) row(values []string) string {
+	cells := make([]string, len(values))
+	for i, v := range values {
+		v = cell(v)
+		n := utf8.RuneCountInString(v)
+		if n > f.widths[i] {
+			v = string([]rune(v)[:f.widths[i]-1]) + "…"
+			n = f.widths[i]
+		}
+		cells[i] = v + strings.Repeat(" ", f.widths[i]-n)
+	}
+	return strings.TrimRight(strings.Join(cells, "  "), " ")
+}
+
+// fix sets the column widths from the header and the sampled rows, then
+// prints them. f.mu must be held.
+func (f *tableFormatter) fix() {
+	if f.fixed || len(f.sample) == 0 {
+		return
+	}
+	f.fixed = true
+	f.timer.Stop()
+	names := f.proj.names()
+	for _, values := range append([][]string{names}, f.sample...) {
+		for i, v := range values {
+			if n := utf8.RuneCountInString(cell(v)); n > f.widths[i] {
+				f.widths[i] = n
+			}
+		}
+	}
+	for i := range f.widths {
+		if f.widths[i] > f.maxWidth {
+			f.widths[i] = f.maxWidth
+		}
+	}
+	f.ui.Info(f.row(names))
+	for _, values := range f.sample {
+		f.ui.Output(f.row(values))
+	}
+	f.sample = nil
+}
+
+func (f *tableFormatter) write(e event, line []byte) error {
+	values := f.proj.strings(e)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.fixed {
+		f.ui.Output(f.row(values))
+		return nil
+	}
+	f.sample = append(f.sample, values)
+	if len(f.sample) == 1 {
+		f.timer = time.AfterFunc(table_sample_wait, func() {
+			f.mu.Lock()
+			defer f.mu.Unlock()
+			f.fix()
+		})
+	}
+	if len(f.sample) >= table_sample_rows {
+		f.fix()
+	}
+	return nil
+}
+
+// Close prints the rows still held back to size the columns.
+func (f *tableFormatter) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.fix()
+	return nil
+}
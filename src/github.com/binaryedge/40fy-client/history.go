@@ -0,0 +1,290 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	history_file_name = "jobs.json"
+	// history_lock_timeout is how long to wait for another process to
+	// finish with the history, locks older than history_lock_stale were
+	// left behind by a process that died
+	history_lock_timeout = 10 * time.Second
+	history_lock_stale   = time.Minute
+)
+
+// jobRecord is a job created by this client, as kept in the local history.
+type jobRecord struct {
+	ID             string          `json:"id"`
+	IdempotencyKey string          `json:"idempotency_key,omitempty"`
+	StreamURL      string          `json:"stream_url,omitempty"`
+	Request        json.RawMessage `json:"request"`
+	Profile        string          `json:"profile,omitempty"`
+	Labels         []string        `json:"labels,omitempty"`
+	CreatedAt      time.Time       `json:"created_at"`
+	UpdatedAt      time.Time       `json:"updated_at"`
+	Outcome        string          `json:"outcome"`
+	Message        string          `json:"message,omitempty"`
+}
+
+func (r *jobRecord) hasLabel(label string) bool {
+	for _, l := range r.Labels {
+		if l == label {
+			return true
+		}
+	}
+	return false
+}
+
+type byCreatedAt []*jobRecord
+
+func (b byCreatedAt) Len() int           { return len(b) }
+func (b byCreatedAt) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byCreatedAt) Less(i, j int) bool { return b[i].CreatedAt.Before(b[j].CreatedAt) }
+
+// jobHistory is the file backed list of jobs created from this machine,
+// oldest first.
+type jobHistory struct {
+	path    string
+	Records []*jobRecord `json:"jobs"`
+}
+
+func historyPath() string {
+	return filepath.Join(configHome(), history_file_name)
+}
+
+// openHistory loads the history at path, a missing file is an empty history.
+func openHistory(path string) (*jobHistory, error) {
+	h := &jobHistory{path: path}
+	byts, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return h, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(byts, h); err != nil {
+		return nil, fmt.Errorf("corrupt job history %s: %s", path, err.Error())
+	}
+	sort.Stable(byCreatedAt(h.Records))
+	return h, nil
+}
+
+// lockHistory takes the lock of the history at path so that it is read and
+// saved by one process at a time, and returns the function releasing it.
+func lockHistory(path string) (func(), error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	lock := path + ".lock"
+	deadline := time.Now().Add(history_lock_timeout)
+	for {
+		f, err := os.OpenFile(lock, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil {
+			fmt.Fprintln(f, os.Getpid())
+			f.Close()
+			return func() { os.Remove(lock) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		if fi, err := os.Stat(lock); err == nil && time.Since(fi.ModTime()) > history_lock_stale {
+			os.Remove(lock)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("job history is locked, remove %s if no other 40fy-client is running", lock)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// updateHistory loads the history at path under its lock, lets update
+// change it and saves it.
+func updateHistory(path string, update func(h *jobHistory)) error {
+	unlock, err := lockHistory(path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	h, err := openHistory(path)
+	if err != nil {
+		return err
+	}
+	update(h)
+	return h.save()
+}
+
+// save writes the history to a temporary file and renames it over the old
+// one so a crash never leaves a truncated history behind.
+func (h *jobHistory) save() error {
+	if err := os.MkdirAll(filepath.Dir(h.path), 0700); err != nil {
+		return err
+	}
+	byts, err := json.MarshalIndent(h, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := h.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, byts, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, h.path)
+}
+
+func (h *jobHistory) add(r *jobRecord) {
+	h.Records = append(h.Records, r)
+}
+
+// put replaces the record with the same idempotency key or adds r.
+func (h *jobHistory) put(r *jobRecord) {
+	if len(r.IdempotencyKey) > 0 {
+		for i, old := range h.Records {
+			if old.IdempotencyKey == r.IdempotencyKey {
+				h.Records[i] = r
+				return
+			}
+		}
+	}
+	h.add(r)
+}
+
+func (h *jobHistory) byKey(key string) *jobRecord {
+	for _, r := range h.Records {
+		if r.IdempotencyKey == key {
+			return r
+		}
+	}
+	return nil
+}
+
+func (h *jobHistory) get(id string) *jobRecord {
+	for _, r := range h.Records {
+		if r.ID == id {
+			return r
+		}
+	}
+	return nil
+}
+
+// last returns the most recent job with an identifier, optionally restricted
+// to jobs carrying label.
+func (h *jobHistory) last(label string) *jobRecord {
+	for i := len(h.Records) - 1; i >= 0; i-- {
+		r := h.Records[i]
+		if len(r.ID) == 0 {
+			continue
+		}
+		if len(label) == 0 || r.hasLabel(label) {
+			return r
+		}
+	}
+	return nil
+}
+
+// jobFilter selects history records by label and creation date.
+type jobFilter struct {
+	label string
+	since time.Time
+	until time.Time
+}
+
+func (f jobFilter) match(r *jobRecord) bool {
+	if len(f.label) > 0 && !r.hasLabel(f.label) {
+		return false
+	}
+	if !f.since.IsZero() && r.CreatedAt.Before(f.since) {
+		return false
+	}
+	if !f.until.IsZero() && !r.CreatedAt.Before(f.until) {
+		return false
+	}
+	return true
+}
+
+func (h *jobHistory) find(f jobFilter) []*jobRecord {
+	var found []*jobRecord
+	for _, r := range h.Records {
+		if f.match(r) {
+			found = append(found, r)
+		}
+	}
+	return found
+}
+
+// remove drops the given records and returns how many were removed.
+func (h *jobHistory) remove(records []*jobRecord) int {
+	drop := map[*jobRecord]bool{}
+	for _, r := range records {
+		drop[r] = true
+	}
+	var kept []*jobRecord
+	for _, r := range h.Records {
+		if !drop[r] {
+			kept = append(kept, r)
+		}
+	}
+	n := len(h.Records) - len(kept)
+	h.Records = kept
+	return n
+}
+
+// resolve turns a job reference as given on the command line into a job id.
+// "last" is the most recently created job, a label is the most recent job
+// carrying it, anything else is taken as a literal id.
+func (h *jobHistory) resolve(ref string) (string, error) {
+	if ref == "last" {
+		r := h.last("")
+		if r == nil {
+			return "", fmt.Errorf("no jobs in history")
+		}
+		return r.ID, nil
+	}
+	if len(ref) == 0 || h.get(ref) != nil {
+		return ref, nil
+	}
+	if r := h.last(ref); r != nil {
+		return r.ID, nil
+	}
+	return ref, nil
+}
+
+// resolveJobID resolves ref against the history at path, usually
+// historyPath().
+func resolveJobID(path, ref string) (string, error) {
+	if len(ref) == 0 {
+		return ref, nil
+	}
+	h, err := openHistory(path)
+	if err != nil {
+		return "", err
+	}
+	return h.resolve(ref)
+}
+
+// parseDate accepts a plain date or a RFC3339 timestamp.
+func parseDate(s string) (time.Time, error) {
+	if len(s) == 0 {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation("2006-01-02", s, time.Local)
+}
+
+func splitList(s string) []string {
+	l := strings.Split(s, ",")
+	for i := range l {
+		l[i] = strings.TrimSpace(l[i])
+	}
+	filterEmpty(&l)
+	return l
+}
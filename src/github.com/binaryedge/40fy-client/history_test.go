@@ -0,0 +1,99 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHistoryRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "history")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "nested", history_file_name)
+
+	h, err := openHistory(path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	now := time.Now().UTC()
+	h.add(&jobRecord{ID: "a", Labels: []string{"weekly"}, CreatedAt: now.Add(-48 * time.Hour), Outcome: "created"})
+	h.add(&jobRecord{ID: "b", Labels: []string{"adhoc"}, CreatedAt: now.Add(-24 * time.Hour), Outcome: "created"})
+	h.add(&jobRecord{ID: "c", Labels: []string{"weekly"}, CreatedAt: now, Outcome: "created"})
+	h.add(&jobRecord{CreatedAt: now.Add(time.Second), Outcome: "failed"})
+	if err := h.save(); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	h, err = openHistory(path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for ref, want := range map[string]string{"last": "c", "weekly": "c", "adhoc": "b", "a": "a", "zzz": "zzz"} {
+		if id, err := h.resolve(ref); err != nil || id != want {
+			t.Fatal("resolve", ref, "=", id, err, "want", want)
+		}
+	}
+	if n := len(h.find(jobFilter{label: "weekly"})); n != 2 {
+		t.Fatal("label filter found", n, "jobs")
+	}
+	if n := len(h.find(jobFilter{since: now.Add(-time.Hour)})); n != 2 {
+		t.Fatal("date filter found", n, "jobs")
+	}
+	if n := h.remove(h.find(jobFilter{label: "weekly"})); n != 2 {
+		t.Fatal("removed", n, "jobs")
+	}
+	if id, _ := h.resolve("last"); id != "b" {
+		t.Fatal("last after remove", id)
+	}
+}
+
+func TestHistoryLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "history")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, history_file_name)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			err := updateHistory(path, func(h *jobHistory) {
+				h.add(&jobRecord{ID: strconv.Itoa(i), CreatedAt: time.Now().UTC()})
+			})
+			if err != nil {
+				t.Error(err.Error())
+			}
+		}(i)
+	}
+	wg.Wait()
+	h, err := openHistory(path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(h.Records) != 20 {
+		t.Fatal("lost updates, kept", len(h.Records), "jobs")
+	}
+	if _, err := os.Stat(path + ".lock"); !os.IsNotExist(err) {
+		t.Fatal("lock left behind", err)
+	}
+
+	// a lock left by a process that died
+	stale := time.Now().Add(-2 * history_lock_stale)
+	ioutil.WriteFile(path+".lock", []byte("1\n"), 0600)
+	os.Chtimes(path+".lock", stale, stale)
+	unlock, err := lockHistory(path)
+	if err != nil {
+		t.Fatal("stale lock not taken over", err)
+	}
+	unlock()
+}
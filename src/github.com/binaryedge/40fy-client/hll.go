@@ -0,0 +1,55 @@
+package main
+
+import (
+	"hash/fnv"
+	"math"
+)
+
+const hll_precision = 14
+
+// hyperLogLog estimates the number of distinct values added to it in a
+// fixed 16KB, with a standard error of about 0.8%.
+type hyperLogLog struct {
+	registers [1 << hll_precision]uint8
+}
+
+// mix64 is the murmur3 finalizer, spreading the bits of FNV hashes of short
+// similar values such as IP addresses.
+func mix64(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
+
+func (h *hyperLogLog) add(v string) {
+	f := fnv.New64a()
+	f.Write([]byte(v))
+	x := mix64(f.Sum64())
+	i := x >> (64 - hll_precision)
+	rank := uint8(1)
+	for w := x << hll_precision; w&(1<<63) == 0 && rank <= 64-hll_precision; w <<= 1 {
+		rank++
+	}
+	if rank > h.registers[i] {
+		h.registers[i] = rank
+	}
+}
+
+func (h *hyperLogLog) count() uint64 {
+	m := float64(len(h.registers))
+	sum, zeros := 0.0, 0
+	for _, r := range h.registers {
+		sum += math.Pow(2, -float64(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+	estimate := 0.7213 / (1 + 1.079/m) * m * m / sum
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return uint64(estimate + 0.5)
+}
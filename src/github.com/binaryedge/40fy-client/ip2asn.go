@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// asnRange is a line of an ip2asn TSV file: a range of addresses announced
+// by an autonomous system, with the country it is registered in and its
+// description.
+type asnRange struct {
+	start, end [16]byte
+	number     uint64
+	country    string
+	org        string
+}
+
+type byRangeStart []asnRange
+
+func (b byRangeStart) Len() int           { return len(b) }
+func (b byRangeStart) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byRangeStart) Less(i, j int) bool { return bytes.Compare(b[i].start[:], b[j].start[:]) < 0 }
+
+// ip2asnTable looks up addresses in the ranges of the ip2asn files of
+// https://iptoasn.com/, with addresses as text or, in the -u32 files, as
+// numbers. Files ending in .gz are decompressed.
+type ip2asnTable struct {
+	ranges []asnRange
+}
+
+func openIP2ASN(path string) (*ip2asnTable, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err.Error())
+		}
+		defer gz.Close()
+		r = gz
+	}
+	t, err := readIP2ASN(r)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err.Error())
+	}
+	return t, nil
+}
+
+func readIP2ASN(r io.Reader) (*ip2asnTable, error) {
+	t := &ip2asnTable{}
+	scanner := bufio.NewScanner(r)
+	n := 0
+	for scanner.Scan() {
+		n++
+		line := scanner.Text()
+		if len(strings.TrimSpace(line)) == 0 {
+			continue
+		}
+		cols := strings.SplitN(line, "\t", 5)
+		if len(cols) < 3 {
+			return nil, fmt.Errorf("line %d: expected start, end, AS number, country and description", n)
+		}
+		var rg asnRange
+		var ok1, ok2 bool
+		rg.start, ok1 = parseRangeIP(cols[0])
+		rg.end, ok2 = parseRangeIP(cols[1])
+		number, err := strconv.ParseUint(cols[2], 10, 32)
+		if !ok1 || !ok2 || err != nil {
+			return nil, fmt.Errorf("line %d: invalid range", n)
+		}
+		// AS 0 marks addresses not routed
+		if number == 0 {
+			continue
+		}
+		rg.number = number
+		if len(cols) > 3 && cols[3] != "None" {
+			rg.country = cols[3]
+		}
+		if len(cols) > 4 {
+			rg.org = cols[4]
+		}
+		t.ranges = append(t.ranges, rg)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	sort.Sort(byRangeStart(t.ranges))
+	return t, nil
+}
+
+// parseRangeIP parses an address of an ip2asn file into its 16 byte form.
+func parseRangeIP(s string) ([16]byte, bool) {
+	var ip [16]byte
+	if n, err := strconv.ParseUint(s, 10, 32); err == nil {
+		copy(ip[:], net.IPv4(byte(n>>24), byte(n>>16), byte(n>>8), byte(n)))
+		return ip, true
+	}
+	parsed := net.ParseIP(s)
+	if parsed == nil {
+		return ip, false
+	}
+	copy(ip[:], parsed.To16())
+	return ip, true
+}
+
+// lookup returns the range holding ip as a record shaped like those of the
+// MaxMind ASN database.
+func (t *ip2asnTable) lookup(ip net.IP) (map[string]interface{}, bool, error) {
+	key := ip.To16()
+	if key == nil {
+		return nil, false, nil
+	}
+	i := sort.Search(len(t.ranges), func(i int) bool {
+		return bytes.Compare(t.ranges[i].start[:], key) > 0
+	}) - 1
+	if i < 0 || bytes.Compare(key, t.ranges[i].end[:]) > 0 {
+		return nil, false, nil
+	}
+	rg := t.ranges[i]
+	rec := map[string]interface{}{"autonomous_system_number": rg.number}
+	if len(rg.org) > 0 {
+		rec["autonomous_system_organization"] = rg.org
+	}
+	if len(rg.country) > 0 {
+		rec["country"] = map[string]interface{}{"iso_code": rg.country}
+	}
+	return rec, true, nil
+}
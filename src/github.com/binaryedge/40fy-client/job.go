@@ -0,0 +1,264 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mitchellh/cli"
+)
+
+var errInvalidCredentials = errors.New("Invalid credentials")
+
+// taskStatus is the part of a task returned by the tasks endpoint that is
+// shown in tables, the JSON output keeps everything the server sent.
+type taskStatus struct {
+	JobID          string `json:"job_id"`
+	ID             string `json:"id"`
+	Status         string `json:"status"`
+	Type           string `json:"type"`
+	CreatedAt      string `json:"created_at"`
+	Message        string `json:"message"`
+	StreamURL      string `json:"stream_url"`
+	IdempotencyKey string `json:"idempotency_key"`
+}
+
+func (t *taskStatus) id() string {
+	if len(t.JobID) > 0 {
+		return t.JobID
+	}
+	return t.ID
+}
+
+type jobCommand struct {
+	client  http.Client
+	output  io.Writer
+	config  map[string]interface{}
+	history string
+	verbose bool
+}
+
+func (j *jobCommand) Run(args []string) int {
+	if len(args) == 0 {
+		fmt.Println(j.Help())
+		return -1
+	}
+	job := flag.NewFlagSet("job "+args[0], flag.ContinueOnError)
+	token := job.String("token", "", "token for authenticating with api")
+	asJSON := job.Bool("json", false, "print the server response as JSON")
+	verbose := job.Bool("verbose", false, "show request and response")
+	if err := job.Parse(args[1:]); err != nil {
+		return -1
+	}
+	j.verbose = *verbose
+	if len(*token) == 0 {
+		*token, _ = j.config["token"].(string)
+	}
+	if len(*token) == 0 {
+		fmt.Println(j.Help())
+		return -1
+	}
+	base := strings.TrimRight(j.config["job_url"].(string), "/")
+
+	var (
+		method = "GET"
+		url    = base
+		id     string
+	)
+	switch args[0] {
+	case "list":
+		if job.NArg() != 0 {
+			fmt.Println(j.Help())
+			return -1
+		}
+	case "status", "cancel":
+		if job.NArg() != 1 {
+			fmt.Println(j.Help())
+			return -1
+		}
+		var err error
+		if id, err = resolveJobID(j.history, job.Arg(0)); err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to resolve job", err.Error())
+			return -1
+		}
+		url = base + "/" + id
+		if args[0] == "cancel" {
+			method = "DELETE"
+		}
+	default:
+		fmt.Println(j.Help())
+		return -1
+	}
+
+	bdy, err := j.do(method, url, *token)
+	if err == errInvalidCredentials {
+		fmt.Println(err.Error())
+		return -1
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to make request", err.Error())
+		return -1
+	}
+
+	var tasks []taskStatus
+	switch {
+	case args[0] == "list":
+		tasks, err = decodeTaskList(bdy)
+	case args[0] == "cancel" && len(strings.TrimSpace(string(bdy))) == 0:
+		// cancelling may answer with no content
+		tasks = []taskStatus{{}}
+	default:
+		var t taskStatus
+		err = json.Unmarshal(bdy, &t)
+		tasks = []taskStatus{t}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Received invalid json %s\n", err.Error())
+		return -1
+	}
+	if args[0] != "list" && len(tasks) > 0 {
+		if t := tasks[0]; len(t.id()) == 0 && len(t.Status) == 0 && len(t.Message) > 0 {
+			fmt.Fprintln(os.Stderr, t.Message)
+			return -1
+		}
+	}
+
+	if len(id) > 0 && len(tasks) > 0 {
+		outcome := tasks[0].Status
+		if args[0] == "cancel" {
+			outcome = "cancelled"
+		}
+		j.updateHistory(id, outcome)
+	}
+
+	if *asJSON {
+		if body := strings.TrimSpace(string(bdy)); len(body) > 0 {
+			fmt.Fprintln(j.output, body)
+		}
+		return 0
+	}
+	if args[0] == "cancel" {
+		fmt.Fprintln(j.output, "Cancelled job", id)
+		return 0
+	}
+	w := tabwriter.NewWriter(j.output, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tSTATUS\tTYPE\tCREATED")
+	for _, t := range tasks {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", t.id(), t.Status, t.Type, t.CreatedAt)
+	}
+	w.Flush()
+	return 0
+}
+
+// do sends an authenticated request to the tasks endpoint and returns the
+// body of a successful response. Errors reported by the server in a
+// "message" field are returned as errors.
+func (j *jobCommand) do(method, url, token string) ([]byte, error) {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("X-Token", token)
+	j.print("Request: %v\n", req)
+	resp, err := j.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	j.print("Response: %v\n", resp)
+	if resp.StatusCode == 401 {
+		return nil, errInvalidCredentials
+	}
+	bdy, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	j.print("%v\n", string(bdy))
+	if resp.StatusCode >= 300 {
+		s := struct {
+			Message string `json:"message"`
+		}{}
+		json.Unmarshal(bdy, &s)
+		if len(s.Message) == 0 {
+			s.Message = resp.Status
+		}
+		return nil, errors.New(s.Message)
+	}
+	return bdy, nil
+}
+
+// decodeTaskList accepts either a bare list of tasks or an object wrapping
+// it in "tasks" or "jobs".
+func decodeTaskList(bdy []byte) ([]taskStatus, error) {
+	var tasks []taskStatus
+	if err := json.Unmarshal(bdy, &tasks); err == nil {
+		return tasks, nil
+	}
+	s := struct {
+		Tasks []taskStatus `json:"tasks"`
+		Jobs  []taskStatus `json:"jobs"`
+	}{}
+	if err := json.Unmarshal(bdy, &s); err != nil {
+		return nil, err
+	}
+	return append(s.Tasks, s.Jobs...), nil
+}
+
+// updateHistory records the last known state of a job we created, jobs that
+// are not in the history are left alone.
+func (j *jobCommand) updateHistory(id, outcome string) {
+	if len(outcome) == 0 {
+		return
+	}
+	unlock, err := lockHistory(j.history)
+	if err != nil {
+		return
+	}
+	defer unlock()
+	h, err := openHistory(j.history)
+	if err != nil {
+		return
+	}
+	if r := h.get(id); r != nil {
+		r.Outcome = outcome
+		r.UpdatedAt = time.Now().UTC()
+		h.save()
+	}
+}
+
+func (j *jobCommand) print(pattern string, v interface{}) {
+	if j.verbose {
+		fmt.Fprintf(j.output, pattern, v)
+	}
+}
+
+func (j *jobCommand) Synopsis() string { return "Query and cancel jobs in the platform" }
+
+func (j *jobCommand) Help() string {
+	return `
+Usage: 40fy-client job status -token=TOKEN [-json] ID
+       40fy-client job list -token=TOKEN [-json]
+       40fy-client job cancel -token=TOKEN [-json] ID
+
+ The TOKEN parameter is the token given to you by BinaryEdge, it is used as authentication.
+ The ID parameter is the identifier of the job, "last" or a label from the local job history.
+ The json flag prints the response of the platform instead of a table.
+	`
+}
+
+func JobCommandFactory() (cli.Command, error) {
+	return &jobCommand{
+		client:  http.Client{},
+		output:  os.Stdout,
+		config:  loadConfig(),
+		history: historyPath(),
+	}, nil
+}
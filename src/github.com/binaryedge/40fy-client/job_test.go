@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCmdJob(t *testing.T) {
+	dir, err := ioutil.TempDir("", "job")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, history_file_name)
+	h, _ := openHistory(path)
+	h.add(&jobRecord{ID: "1234", CreatedAt: time.Now().UTC(), Outcome: "created"})
+	if err := h.save(); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	var requests []string
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		if r.Header.Get("X-Token") != token {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.Method + " " + r.URL.Path {
+		case "GET /":
+			w.Write([]byte(`{"tasks":[{"job_id":"1234","status":"running","type":"scan","created_at":"2017-07-14"},{"id":"5678","status":"done"}]}`))
+		case "GET /1234":
+			w.Write([]byte(`{"job_id":"1234","status":"done","type":"scan"}`))
+		case "GET /9999":
+			w.Write([]byte(`{"message":"Job not found"}`))
+		case "DELETE /1234":
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"message":"Unknown job"}`))
+		}
+	}
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+
+	run := func(args ...string) (int, string) {
+		var out bytes.Buffer
+		j := &jobCommand{client: http.Client{}, output: &out, config: testConfig(server.URL, token), history: path}
+		status := j.Run(args)
+		return status, out.String()
+	}
+	status, out := run("list")
+	if status != 0 || !strings.Contains(out, "1234  running  scan  2017-07-14") || !strings.Contains(out, "5678  done") {
+		t.Fatal("unexpected list", status, out)
+	}
+	status, out = run("status", "1234")
+	if status != 0 || !strings.Contains(out, "1234  done    scan") {
+		t.Fatal("unexpected status", status, out)
+	}
+	if h, _ := openHistory(path); h.get("1234").Outcome != "done" {
+		t.Fatal("history not updated", h.get("1234"))
+	}
+	if status, out = run("status", "-json", "1234"); status != 0 || out != `{"job_id":"1234","status":"done","type":"scan"}`+"\n" {
+		t.Fatal("unexpected json", status, out)
+	}
+	if status, _ = run("status", "9999"); status == 0 {
+		t.Fatal("message without a job accepted")
+	}
+	if status, _ = run("status", "0000"); status == 0 {
+		t.Fatal("error status accepted")
+	}
+	if status, _ = run("status", "-token=nope", "1234"); status == 0 {
+		t.Fatal("invalid credentials accepted")
+	}
+
+	// an empty response to a cancel
+	status, out = run("cancel", "1234")
+	if status != 0 || out != "Cancelled job 1234\n" {
+		t.Fatal("unexpected cancel", status, out)
+	}
+	if h, _ := openHistory(path); h.get("1234").Outcome != "cancelled" {
+		t.Fatal("history not updated", h.get("1234"))
+	}
+	if status, out = run("cancel", "-json", "1234"); status != 0 || out != "" {
+		t.Fatal("unexpected json", status, out)
+	}
+	if requests[len(requests)-1] != "DELETE /1234" {
+		t.Fatal("unexpected request", requests)
+	}
+
+	empty := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[]`))
+	}))
+	defer empty.Close()
+	var buf bytes.Buffer
+	j := &jobCommand{client: http.Client{}, output: &buf, config: testConfig(empty.URL, token), history: path}
+	if status := j.Run([]string{"list"}); status != 0 || strings.TrimSpace(buf.String()) != "ID  STATUS  TYPE  CREATED" {
+		t.Fatal("unexpected empty list", status, buf.String())
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mitchellh/cli"
+)
+
+type jobsCommand struct {
+	output  io.Writer
+	history string
+}
+
+func (j *jobsCommand) Run(args []string) int {
+	if len(args) == 0 {
+		fmt.Println(j.Help())
+		return -1
+	}
+	if args[0] == "rm" {
+		unlock, err := lockHistory(j.history)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to lock job history", err.Error())
+			return -1
+		}
+		defer unlock()
+	}
+	h, err := openHistory(j.history)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to read job history", err.Error())
+		return -1
+	}
+	switch args[0] {
+	case "list":
+		return j.list(h, args[1:])
+	case "show":
+		return j.show(h, args[1:])
+	case "rm":
+		return j.rm(h, args[1:])
+	}
+	fmt.Println(j.Help())
+	return -1
+}
+
+func filterFlags(fs *flag.FlagSet) (label, since, until *string) {
+	label = fs.String("label", "", "only jobs with this label")
+	since = fs.String("since", "", "only jobs created at or after this date")
+	until = fs.String("until", "", "only jobs created before this date")
+	return
+}
+
+func buildFilter(label, since, until string) (f jobFilter, err error) {
+	f.label = label
+	if f.since, err = parseDate(since); err != nil {
+		return
+	}
+	f.until, err = parseDate(until)
+	return
+}
+
+func (j *jobsCommand) list(h *jobHistory, args []string) int {
+	list := flag.NewFlagSet("jobs list", flag.ContinueOnError)
+	label, since, until := filterFlags(list)
+	asJSON := list.Bool("json", false, "print records as JSON")
+	if err := list.Parse(args); err != nil {
+		return -1
+	}
+	f, err := buildFilter(*label, *since, *until)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid date", err.Error())
+		return -1
+	}
+	records := h.find(f)
+	if *asJSON {
+		enc := json.NewEncoder(j.output)
+		for _, r := range records {
+			enc.Encode(r)
+		}
+		return 0
+	}
+	w := tabwriter.NewWriter(j.output, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tCREATED\tOUTCOME\tLABELS")
+	for _, r := range records {
+		id := r.ID
+		if len(id) == 0 {
+			id = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", id, r.CreatedAt.Local().Format(time.RFC3339), r.Outcome, strings.Join(r.Labels, ","))
+	}
+	w.Flush()
+	return 0
+}
+
+func (j *jobsCommand) show(h *jobHistory, args []string) int {
+	if len(args) != 1 {
+		fmt.Println(j.Help())
+		return -1
+	}
+	id, err := h.resolve(args[0])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return -1
+	}
+	r := h.get(id)
+	if r == nil {
+		fmt.Fprintf(os.Stderr, "Job %s not found in history\n", args[0])
+		return -1
+	}
+	byts, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return -1
+	}
+	fmt.Fprintln(j.output, string(byts))
+	return 0
+}
+
+func (j *jobsCommand) rm(h *jobHistory, args []string) int {
+	rm := flag.NewFlagSet("jobs rm", flag.ContinueOnError)
+	label, since, until := filterFlags(rm)
+	if err := rm.Parse(args); err != nil {
+		return -1
+	}
+	var records []*jobRecord
+	if rm.NArg() > 0 {
+		for _, id := range rm.Args() {
+			r := h.get(id)
+			if r == nil {
+				fmt.Fprintf(os.Stderr, "Job %s not found in history\n", id)
+				return -1
+			}
+			records = append(records, r)
+		}
+	} else {
+		if len(*label) == 0 && len(*since) == 0 && len(*until) == 0 {
+			fmt.Println(j.Help())
+			return -1
+		}
+		f, err := buildFilter(*label, *since, *until)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Invalid date", err.Error())
+			return -1
+		}
+		records = h.find(f)
+	}
+	n := h.remove(records)
+	if err := h.save(); err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to write job history", err.Error())
+		return -1
+	}
+	fmt.Fprintf(j.output, "Removed %d job(s)\n", n)
+	return 0
+}
+
+func (j *jobsCommand) Synopsis() string { return "List and manage locally recorded jobs" }
+
+func (j *jobsCommand) Help() string {
+	return `
+Usage: 40fy-client jobs list [-label=LABEL] [-since=DATE] [-until=DATE] [-json]
+       40fy-client jobs show ID
+       40fy-client jobs rm [-label=LABEL] [-since=DATE] [-until=DATE] [ID...]
+
+ Every job created with create-job is recorded in ~/.binaryedge/jobs.json.
+ DATE is either 2006-01-02 or a RFC3339 timestamp.
+ ID can also be "last" or a label, which selects the most recent matching job.
+	`
+}
+
+func JobsCommandFactory() (cli.Command, error) {
+	return &jobsCommand{
+		output:  os.Stdout,
+		history: historyPath(),
+	}, nil
+}
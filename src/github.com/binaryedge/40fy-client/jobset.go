@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// jobSet is the set of jobs a stream follows, with the labels they carry in
+// the local history.
+type jobSet struct {
+	ids    []string
+	labels map[string][]string
+}
+
+// resolveJobSet resolves the job references given on the command line
+// against the history. A reference is anything -job-id accepts, label:NAME
+// for every job carrying NAME, for example a batch created together, or
+// @FILE for the ids listed in FILE, one per line. Every job is kept once, in
+// the order given.
+func resolveJobSet(h *jobHistory, refs []string) (*jobSet, error) {
+	s := &jobSet{labels: map[string][]string{}}
+	seen := map[string]bool{}
+	add := func(id string) {
+		if len(id) == 0 || seen[id] {
+			return
+		}
+		seen[id] = true
+		s.ids = append(s.ids, id)
+		if r := h.get(id); r != nil {
+			s.labels[id] = r.Labels
+		}
+	}
+	for _, ref := range refs {
+		switch {
+		case strings.HasPrefix(ref, "@"):
+			ids, err := readJobIDs(ref[1:])
+			if err != nil {
+				return nil, err
+			}
+			for _, id := range ids {
+				add(id)
+			}
+		case strings.HasPrefix(ref, "label:"):
+			label := strings.TrimPrefix(ref, "label:")
+			found := h.find(jobFilter{label: label})
+			n := 0
+			for _, r := range found {
+				if len(r.ID) > 0 {
+					add(r.ID)
+					n++
+				}
+			}
+			if n == 0 {
+				return nil, fmt.Errorf("no jobs labelled %q in history", label)
+			}
+		default:
+			id, err := h.resolve(ref)
+			if err != nil {
+				return nil, err
+			}
+			add(id)
+		}
+	}
+	return s, nil
+}
+
+// readJobIDs reads the job ids listed in path, skipping blank lines and
+// comments starting with #.
+func readJobIDs(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var ids []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		ids = append(ids, line)
+	}
+	return ids, scanner.Err()
+}
+
+// jobRefs collects the references of repeated -job-id flags and of -job-ids
+// lists, which are comma separated or an @FILE.
+func jobRefs(ids stringList, lists stringList) []string {
+	refs := append([]string{}, ids...)
+	for _, l := range lists {
+		if strings.HasPrefix(l, "@") {
+			refs = append(refs, l)
+			continue
+		}
+		refs = append(refs, splitList(l)...)
+	}
+	filterEmpty(&refs)
+	return refs
+}
+
+// tag adds a "job" object with the id and labels of its job to the event and
+// to the line as received. Events that already have a job field are left
+// alone.
+func (s *jobSet) tag(e event, line []byte) []byte {
+	if _, ok := e["job"]; ok {
+		return line
+	}
+	id := e.jobID()
+	t := map[string]interface{}{"id": id}
+	if labels := s.labels[id]; len(labels) > 0 {
+		t["labels"] = labels
+	}
+	byts, err := json.Marshal(t)
+	if err != nil {
+		return line
+	}
+	e["job"] = t
+	return insertField(line, "job", byts)
+}
+
+// jobRouter is a sink writing the lines of every job, as received, to a
+// file of its own opened on its first result. Job ids other than letters,
+// digits, _ and - are rejected.
+type jobRouter struct {
+	open func(id string) (io.WriteCloser, error)
+
+	mu    sync.Mutex
+	files map[string]io.WriteCloser
+}
+
+func newJobRouter(open func(id string) (io.WriteCloser, error)) *jobRouter {
+	return &jobRouter{open: open, files: map[string]io.WriteCloser{}}
+}
+
+// fileJobID is what a job id may be made of to be used in a file name, so
+// an id sent by the server can't point outside the output directory.
+var fileJobID = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// jobOutput opens the files named after pattern, with {job} replaced by the
+// job id and rotated like -output-file.
+func jobOutput(pattern string) (*jobRouter, error) {
+	if !strings.Contains(pattern, "{job}") {
+		return nil, fmt.Errorf("job output %q must contain {job}", pattern)
+	}
+	return newJobRouter(func(id string) (io.WriteCloser, error) {
+		f, err := newRotatingFile(rotateOptions{pattern: strings.Replace(pattern, "{job}", id, -1)})
+		if err != nil {
+			return nil, err
+		}
+		return f, nil
+	}), nil
+}
+
+func (r *jobRouter) send(e event, line []byte) error {
+	id := e.jobID()
+	if len(id) == 0 {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	w, ok := r.files[id]
+	if !ok {
+		if !fileJobID.MatchString(id) {
+			return fmt.Errorf("invalid job id %q, can't name a file after it", id)
+		}
+		var err error
+		if w, err = r.open(id); err != nil {
+			return fmt.Errorf("failed to open output of job %s: %s", id, err.Error())
+		}
+		r.files[id] = w
+	}
+	_, err := w.Write(line)
+	return err
+}
+
+func (r *jobRouter) close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var err error
+	for id, w := range r.files {
+		if cerr := w.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+		delete(r.files, id)
+	}
+	return err
+}
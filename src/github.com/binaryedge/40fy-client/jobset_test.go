@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResolveJobSet(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jobset")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	list := filepath.Join(dir, "jobs.txt")
+	if err := ioutil.WriteFile(list, []byte("# batch\nf1\n\nf2\na\n"), 0600); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	now := time.Now().UTC()
+	h := &jobHistory{}
+	h.add(&jobRecord{ID: "a", Labels: []string{"batch-1"}, CreatedAt: now.Add(-time.Hour)})
+	h.add(&jobRecord{ID: "b", Labels: []string{"batch-1"}, CreatedAt: now})
+	h.add(&jobRecord{ID: "c", Labels: []string{"adhoc"}, CreatedAt: now})
+
+	s, err := resolveJobSet(h, jobRefs(stringList{"label:batch-1", "adhoc"}, stringList{"x, y", "@" + list}))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if want := []string{"a", "b", "c", "x", "y", "f1", "f2"}; !reflect.DeepEqual(s.ids, want) {
+		t.Fatal("unexpected jobs", s.ids, "want", want)
+	}
+	if _, err := resolveJobSet(h, []string{"label:none"}); err == nil {
+		t.Fatal("expected an error for a label without jobs")
+	}
+
+	e, _ := decodeEvent(jobResult)
+	line := s.tag(e, []byte(`{"origin":{"job_id":"a"}}`+"\n"))
+	if string(line) != `{"job":{"id":"1234"},"origin":{"job_id":"a"}}`+"\n" {
+		t.Fatal("unexpected tagged line", string(line))
+	}
+	e, _ = decodeEvent([]byte(`{"origin":{"job_id":"a"}}`))
+	if line := s.tag(e, []byte(`{ }`)); string(line) != `{"job":{"id":"a","labels":["batch-1"]} }` {
+		t.Fatal("unexpected tagged line", string(line))
+	}
+	if _, ok := e["job"]; !ok {
+		t.Fatal("event not tagged")
+	}
+}
+
+func TestCmdWithJobIDs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jobset")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	os.Setenv(CONFIG_PATH, dir)
+	defer os.Unsetenv(CONFIG_PATH)
+
+	third := []byte(`{"origin":{"job_id":"9999"}}` + "\n")
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		w.Write(jobResult)
+		w.Write(third)
+		w.Write(otherResult)
+		w.Write(jobResult)
+	}
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+
+	buffer := bytes.NewBuffer([]byte{})
+	c := StreamCommand{http.Client{}, buffer, testConfig(server.URL, ""), false}
+	pattern := filepath.Join(dir, "{job}.ndjson")
+	if status := c.Run([]string{"-token=" + token, "-job-id=1234", "-job-ids=4321", "-job-output=" + pattern}); status != 0 {
+		t.Fatal("Status not 0", status)
+	}
+	lines := strings.Split(strings.TrimSpace(buffer.String()), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[1], `{"job":{"id":"4321"},"origin"`) {
+		t.Fatal("unexpected output", buffer.String())
+	}
+	for id, want := range map[string][]byte{"1234": append(append([]byte{}, jobResult...), jobResult...), "4321": otherResult} {
+		byts, err := ioutil.ReadFile(filepath.Join(dir, id+".ndjson"))
+		if err != nil || !bytes.Equal(byts, want) {
+			t.Fatal("unexpected output of job", id, string(byts), err)
+		}
+	}
+}
+
+func TestJobOutputRejectsPaths(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jobset")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	r, err := jobOutput(filepath.Join(dir, "out", "{job}.ndjson"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer r.close()
+	for _, id := range []string{"../escaped", "a/b", ".."} {
+		line := []byte(`{"origin":{"job_id":"` + id + `"}}` + "\n")
+		e, _ := decodeEvent(line)
+		if err := r.send(e, line); err == nil {
+			t.Fatal("job id accepted", id)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "escaped.ndjson")); err == nil {
+		t.Fatal("wrote outside the output directory")
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"log"
 	"os"
+	"path/filepath"
 
 	"github.com/mitchellh/cli"
 	"gopkg.in/BurntSushi/toml.v0"
@@ -30,6 +31,39 @@ func GetConfigContents(path string) (content map[string]interface{}, err error)
 	return
 }
 
+// loadConfig reads the config file next to the binary and fills in any
+// missing keys from DefaultConfig.
+func loadConfig() map[string]interface{} {
+	config, err := GetConfigContents(config_file_name)
+	if err != nil || config == nil {
+		config = map[string]interface{}{}
+	}
+	for k, v := range DefaultConfig {
+		if _, ok := config[k]; !ok {
+			config[k] = v
+		}
+	}
+	return config
+}
+
+// configProfile returns the name of the profile of config, "default" unless
+// it sets profile.
+func configProfile(config map[string]interface{}) string {
+	if p, ok := config["profile"].(string); ok && len(p) > 0 {
+		return p
+	}
+	return "default"
+}
+
+// configHome returns the directory where the client keeps its local state,
+// $CONFIG_PATH if set and ~/.binaryedge/ otherwise.
+func configHome() string {
+	if path := os.Getenv(CONFIG_PATH); len(path) > 0 {
+		return path
+	}
+	return filepath.Join(os.Getenv("HOME"), config_home_path)
+}
+
 func main() {
 	c := cli.NewCLI("40fy-client", "1.0.0")
 	c.Args = os.Args[1:]
@@ -37,6 +71,15 @@ func main() {
 		"stream":     StreamCommandFactory,
 		"firehose":   FirehoseCommandFactory,
 		"create-job": CreateJobCommandFactory,
+		"jobs":       JobsCommandFactory,
+		"job":        JobCommandFactory,
+		"diff":       DiffCommandFactory,
+		"stats":      StatsCommandFactory,
+		"watch":      WatchCommandFactory,
+		"relay":      RelayCommandFactory,
+		"serve-sse":  ServeSSECommandFactory,
+		"replay":     ReplayCommandFactory,
+		"queue":      QueueCommandFactory,
 	}
 
 	exitStatus, err := c.Run()
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/big"
+	"net"
+)
+
+// mmdbMetadataMarker precedes the metadata at the end of a MaxMind DB file.
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// Types of the values in the data section of a MaxMind DB file.
+const (
+	mmdb_extended = iota
+	mmdb_pointer
+	mmdb_string
+	mmdb_double
+	mmdb_bytes
+	mmdb_uint16
+	mmdb_uint32
+	mmdb_map
+	mmdb_int32
+	mmdb_uint64
+	mmdb_uint128
+	mmdb_array
+	mmdb_container
+	mmdb_end_marker
+	mmdb_boolean
+	mmdb_float
+)
+
+// mmdb_max_depth bounds the nesting of values, so a corrupt file can't
+// send the decoder into a loop of pointers.
+const mmdb_max_depth = 32
+
+var errMMDBCorrupt = errors.New("corrupt MaxMind DB file")
+
+// mmdbReader looks up addresses in a MaxMind DB file such as GeoLite2 City
+// or ASN, read into memory. The file is a binary search tree over the bits
+// of the addresses whose leaves point to records in the data section, see
+// https://maxmind.github.io/MaxMind-DB/.
+type mmdbReader struct {
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	dbType     string
+	tree       []byte
+	data       mmdbDecoder
+	// ipv4Start is the node of ::/96 where IPv4 addresses start in an
+	// IPv6 tree
+	ipv4Start uint
+}
+
+func openMMDB(path string) (*mmdbReader, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	r, err := parseMMDB(buf)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err.Error())
+	}
+	return r, nil
+}
+
+func parseMMDB(buf []byte) (*mmdbReader, error) {
+	i := bytes.LastIndex(buf, mmdbMetadataMarker)
+	if i < 0 {
+		return nil, errors.New("not a MaxMind DB file")
+	}
+	v, _, err := mmdbDecoder(buf[i+len(mmdbMetadataMarker):]).decode(0, 0)
+	if err != nil {
+		return nil, err
+	}
+	meta, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, errMMDBCorrupt
+	}
+	r := &mmdbReader{}
+	r.dbType, _ = meta["database_type"].(string)
+	for key, dst := range map[string]*uint{
+		"node_count":  &r.nodeCount,
+		"record_size": &r.recordSize,
+		"ip_version":  &r.ipVersion,
+	} {
+		n, ok := meta[key].(uint64)
+		if !ok {
+			return nil, fmt.Errorf("metadata without %s", key)
+		}
+		*dst = uint(n)
+	}
+	if r.recordSize != 24 && r.recordSize != 28 && r.recordSize != 32 {
+		return nil, fmt.Errorf("unsupported record size %d", r.recordSize)
+	}
+	if r.ipVersion != 4 && r.ipVersion != 6 {
+		return nil, fmt.Errorf("unsupported IP version %d", r.ipVersion)
+	}
+	treeSize := r.recordSize / 4 * r.nodeCount
+	// the tree and the data section are separated by 16 zero bytes
+	if treeSize+16 > uint(i) {
+		return nil, errMMDBCorrupt
+	}
+	r.tree = buf[:treeSize]
+	r.data = mmdbDecoder(buf[treeSize+16 : i])
+	if r.ipVersion == 6 {
+		for n := 0; n < 96 && r.ipv4Start < r.nodeCount; n++ {
+			r.ipv4Start = r.record(r.ipv4Start, 0)
+		}
+	}
+	return r, nil
+}
+
+// record returns the left, bit 0, or right, bit 1, record of a node.
+func (r *mmdbReader) record(node, bit uint) uint {
+	switch r.recordSize {
+	case 24:
+		b := r.tree[node*6+bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		b := r.tree[node*7:]
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(r.tree[node*8+bit*4:]))
+	}
+}
+
+// lookup returns the record of the network holding ip, ok is false when
+// there is none.
+func (r *mmdbReader) lookup(ip net.IP) (map[string]interface{}, bool, error) {
+	node := uint(0)
+	bits := ip.To4()
+	if bits != nil {
+		if r.ipVersion == 6 {
+			node = r.ipv4Start
+		}
+	} else {
+		if r.ipVersion == 4 {
+			return nil, false, nil
+		}
+		bits = ip.To16()
+	}
+	for i := uint(0); i < uint(len(bits))*8 && node < r.nodeCount; i++ {
+		node = r.record(node, uint(bits[i/8]>>(7-i%8))&1)
+	}
+	if node == r.nodeCount {
+		return nil, false, nil
+	}
+	if node < r.nodeCount || node-r.nodeCount < 16 {
+		return nil, false, errMMDBCorrupt
+	}
+	v, _, err := r.data.decode(node-r.nodeCount-16, 0)
+	if err != nil {
+		return nil, false, err
+	}
+	m, ok := v.(map[string]interface{})
+	return m, ok, nil
+}
+
+// mmdbDecoder decodes the values of a data section, pointers are offsets
+// into it.
+type mmdbDecoder []byte
+
+// decode decodes the value at off and returns it with the offset after it.
+// Maps decode to map[string]interface{}, arrays to []interface{}, unsigned
+// integers to uint64 or *big.Int, int32 to int64 and floats to float64.
+func (d mmdbDecoder) decode(off uint, depth int) (interface{}, uint, error) {
+	if depth > mmdb_max_depth || off >= uint(len(d)) {
+		return nil, 0, errMMDBCorrupt
+	}
+	ctrl := d[off]
+	off++
+	typ := uint(ctrl >> 5)
+	if typ == mmdb_pointer {
+		ptr, next, err := d.pointer(ctrl, off)
+		if err != nil {
+			return nil, 0, err
+		}
+		v, _, err := d.decode(ptr, depth+1)
+		return v, next, err
+	}
+	if typ == mmdb_extended {
+		if off >= uint(len(d)) {
+			return nil, 0, errMMDBCorrupt
+		}
+		typ = 7 + uint(d[off])
+		off++
+	}
+	size := uint(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		if off+n > uint(len(d)) {
+			return nil, 0, errMMDBCorrupt
+		}
+		var v uint
+		for _, b := range d[off : off+n] {
+			v = v<<8 | uint(b)
+		}
+		off += n
+		size = []uint{29, 285, 65821}[n-1] + v
+	}
+	switch typ {
+	case mmdb_map:
+		m := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			k, next, err := d.decode(off, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, errMMDBCorrupt
+			}
+			if m[key], off, err = d.decode(next, depth+1); err != nil {
+				return nil, 0, err
+			}
+		}
+		return m, off, nil
+	case mmdb_array:
+		a := make([]interface{}, size)
+		for i := range a {
+			var err error
+			if a[i], off, err = d.decode(off, depth+1); err != nil {
+				return nil, 0, err
+			}
+		}
+		return a, off, nil
+	case mmdb_boolean:
+		return size != 0, off, nil
+	case mmdb_container, mmdb_end_marker:
+		return nil, off, nil
+	}
+	if off+size > uint(len(d)) {
+		return nil, 0, errMMDBCorrupt
+	}
+	b := d[off : off+size]
+	off += size
+	switch typ {
+	case mmdb_string:
+		return string(b), off, nil
+	case mmdb_bytes:
+		return append([]byte{}, b...), off, nil
+	case mmdb_double:
+		if size != 8 {
+			return nil, 0, errMMDBCorrupt
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), off, nil
+	case mmdb_float:
+		if size != 4 {
+			return nil, 0, errMMDBCorrupt
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), off, nil
+	case mmdb_uint16, mmdb_uint32, mmdb_uint64:
+		if size > 8 {
+			return nil, 0, errMMDBCorrupt
+		}
+		var v uint64
+		for _, c := range b {
+			v = v<<8 | uint64(c)
+		}
+		return v, off, nil
+	case mmdb_int32:
+		if size > 4 {
+			return nil, 0, errMMDBCorrupt
+		}
+		var v uint32
+		for _, c := range b {
+			v = v<<8 | uint32(c)
+		}
+		return int64(int32(v)), off, nil
+	case mmdb_uint128:
+		return new(big.Int).SetBytes(b), off, nil
+	}
+	return nil, 0, fmt.Errorf("unknown MaxMind DB type %d", typ)
+}
+
+// pointer decodes the pointer whose control byte is ctrl, it returns the
+// offset pointed to and the offset after the pointer.
+func (d mmdbDecoder) pointer(ctrl byte, off uint) (uint, uint, error) {
+	n := uint(ctrl>>3)&3 + 1
+	if off+n > uint(len(d)) {
+		return 0, 0, errMMDBCorrupt
+	}
+	b := d[off : off+n]
+	v := uint(ctrl & 7)
+	switch n {
+	case 1:
+		return v<<8 | uint(b[0]), off + n, nil
+	case 2:
+		return (v<<16 | uint(b[0])<<8 | uint(b[1])) + 2048, off + n, nil
+	case 3:
+		return (v<<24 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])) + 526336, off + n, nil
+	default:
+		return uint(binary.BigEndian.Uint32(b)), off + n, nil
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"net"
+	"sort"
+	"testing"
+)
+
+// mmdbPointer is encoded as a pointer to an offset of the data section.
+type mmdbPointer uint
+
+func mmdbControl(typ, size int) []byte {
+	var out []byte
+	first := byte(typ << 5)
+	if typ > 7 {
+		first = 0
+	}
+	var sz []byte
+	switch {
+	case size < 29:
+		first |= byte(size)
+	case size < 285:
+		first |= 29
+		sz = []byte{byte(size - 29)}
+	default:
+		first |= 30
+		sz = []byte{byte((size - 285) >> 8), byte(size - 285)}
+	}
+	out = append(out, first)
+	if typ > 7 {
+		out = append(out, byte(typ-7))
+	}
+	return append(out, sz...)
+}
+
+// mmdbEncode encodes v for the data section of a MaxMind DB file.
+func mmdbEncode(v interface{}) []byte {
+	switch n := v.(type) {
+	case mmdbPointer:
+		return []byte{byte(mmdb_pointer<<5) | byte(n>>8&7), byte(n)}
+	case string:
+		return append(mmdbControl(mmdb_string, len(n)), n...)
+	case uint32:
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, n)
+		for len(b) > 0 && b[0] == 0 {
+			b = b[1:]
+		}
+		return append(mmdbControl(mmdb_uint32, len(b)), b...)
+	case float64:
+		b := make([]byte, 8)
+		binary.BigEndian.PutUint64(b, math.Float64bits(n))
+		return append(mmdbControl(mmdb_double, 8), b...)
+	case bool:
+		size := 0
+		if n {
+			size = 1
+		}
+		return mmdbControl(mmdb_boolean, size)
+	case []interface{}:
+		out := mmdbControl(mmdb_array, len(n))
+		for _, el := range n {
+			out = append(out, mmdbEncode(el)...)
+		}
+		return out
+	case map[string]interface{}:
+		var keys []string
+		for k := range n {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		out := mmdbControl(mmdb_map, len(n))
+		for _, k := range keys {
+			out = append(out, mmdbEncode(k)...)
+			out = append(out, mmdbEncode(n[k])...)
+		}
+		return out
+	}
+	panic("unsupported value")
+}
+
+type mmdbNetwork struct {
+	cidr string
+	data interface{}
+}
+
+// mmdbNode holds the records of a node of the tree being built: a node, a
+// value or nothing.
+type mmdbNode [2]struct {
+	node int
+	data int
+}
+
+// writeMMDB builds a MaxMind DB file holding the networks, with data put
+// first in the data section, for example strings pointed to by mmdbPointer.
+func writeMMDB(ipVersion, recordSize int, shared []interface{}, networks []mmdbNetwork) []byte {
+	var data []byte
+	for _, v := range shared {
+		data = append(data, mmdbEncode(v)...)
+	}
+	nodes := []mmdbNode{{}}
+	for _, n := range networks {
+		_, ipnet, err := net.ParseCIDR(n.cidr)
+		if err != nil {
+			panic(err)
+		}
+		ones, bits := ipnet.Mask.Size()
+		ip := ipnet.IP
+		if ipVersion == 6 && bits == 32 {
+			// IPv4 networks are under ::/96
+			ip = append(make(net.IP, 12), ip.To4()...)
+			ones += 96
+		}
+		offset := len(data)
+		data = append(data, mmdbEncode(n.data)...)
+		node := 0
+		for i := 0; i < ones; i++ {
+			bit := int(ip[i/8]>>(7-uint(i%8))) & 1
+			if i == ones-1 {
+				nodes[node][bit].data = offset + 1
+				break
+			}
+			if nodes[node][bit].node == 0 {
+				nodes = append(nodes, mmdbNode{})
+				nodes[node][bit].node = len(nodes) - 1
+			}
+			node = nodes[node][bit].node
+		}
+	}
+	count := len(nodes)
+	var tree []byte
+	for _, n := range nodes {
+		var rec [2]uint32
+		for bit, r := range n {
+			switch {
+			case r.node > 0:
+				rec[bit] = uint32(r.node)
+			case r.data > 0:
+				rec[bit] = uint32(count + 16 + r.data - 1)
+			default:
+				rec[bit] = uint32(count)
+			}
+		}
+		switch recordSize {
+		case 24:
+			tree = append(tree, byte(rec[0]>>16), byte(rec[0]>>8), byte(rec[0]),
+				byte(rec[1]>>16), byte(rec[1]>>8), byte(rec[1]))
+		case 28:
+			tree = append(tree, byte(rec[0]>>16), byte(rec[0]>>8), byte(rec[0]),
+				byte(rec[0]>>24)<<4|byte(rec[1]>>24), byte(rec[1]>>16), byte(rec[1]>>8), byte(rec[1]))
+		default:
+			b := make([]byte, 8)
+			binary.BigEndian.PutUint32(b, rec[0])
+			binary.BigEndian.PutUint32(b[4:], rec[1])
+			tree = append(tree, b...)
+		}
+	}
+	out := append(tree, make([]byte, 16)...)
+	out = append(out, data...)
+	out = append(out, mmdbMetadataMarker...)
+	return append(out, mmdbEncode(map[string]interface{}{
+		"node_count":    uint32(count),
+		"record_size":   uint32(recordSize),
+		"ip_version":    uint32(ipVersion),
+		"database_type": "Test-City",
+		"languages":     []interface{}{"en"},
+	})...)
+}
+
+func testCity(country string, pointer bool) map[string]interface{} {
+	var name interface{} = country + " name"
+	if pointer {
+		name = mmdbPointer(0)
+	}
+	return map[string]interface{}{
+		"country":  map[string]interface{}{"iso_code": country, "names": map[string]interface{}{"en": name}},
+		"city":     map[string]interface{}{"names": map[string]interface{}{"en": "Mountain View"}},
+		"location": map[string]interface{}{"latitude": 37.386, "longitude": -122.0838},
+		"is_eu":    false,
+	}
+}
+
+func TestMMDBLookup(t *testing.T) {
+	shared := []interface{}{"United States"}
+	for _, version := range []int{4, 6} {
+		for _, size := range []int{24, 28, 32} {
+			networks := []mmdbNetwork{
+				{"8.8.8.0/24", testCity("US", true)},
+				{"1.0.0.0/8", testCity("AU", false)},
+			}
+			if version == 6 {
+				networks = append(networks, mmdbNetwork{"2001:db8::/32", testCity("NL", false)})
+			}
+			r, err := parseMMDB(writeMMDB(version, size, shared, networks))
+			if err != nil {
+				t.Fatal(version, size, err.Error())
+			}
+			if r.dbType != "Test-City" {
+				t.Fatal("unexpected database type", r.dbType)
+			}
+			rec, ok, err := r.lookup(net.ParseIP("8.8.8.8"))
+			if err != nil || !ok {
+				t.Fatal(version, size, "address not found", err)
+			}
+			if v, _ := lookup(rec, splitPath("country.names.en")); v != "United States" {
+				t.Fatal(version, size, "unexpected country", v)
+			}
+			if v, _ := lookup(rec, splitPath("location.longitude")); v != -122.0838 {
+				t.Fatal(version, size, "unexpected longitude", v)
+			}
+			rec, ok, err = r.lookup(net.ParseIP("1.2.3.4"))
+			if v, _ := lookup(rec, splitPath("country.iso_code")); err != nil || !ok || v != "AU" {
+				t.Fatal(version, size, "unexpected country", v, err)
+			}
+			if _, ok, err := r.lookup(net.ParseIP("9.9.9.9")); ok || err != nil {
+				t.Fatal(version, size, "unknown address found", err)
+			}
+			rec, ok, _ = r.lookup(net.ParseIP("2001:db8::1"))
+			if version == 6 && (!ok || rec["is_eu"] != false) {
+				t.Fatal(size, "IPv6 address not found", rec)
+			}
+			if version == 4 && ok {
+				t.Fatal(size, "IPv6 address found in an IPv4 database")
+			}
+		}
+	}
+}
+
+func TestMMDBCorrupt(t *testing.T) {
+	byts := writeMMDB(4, 24, nil, []mmdbNetwork{{"8.8.8.0/24", testCity("US", false)}})
+	if _, err := parseMMDB(byts[:20]); err == nil {
+		t.Fatal("expected an error without metadata")
+	}
+	r, err := parseMMDB(byts)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	// a loop of pointers
+	r.data = mmdbDecoder(mmdbEncode(mmdbPointer(0)))
+	if _, _, err := r.data.decode(0, 0); err != errMMDBCorrupt {
+		t.Fatal("expected a corrupt file", err)
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// default_max_line_size is the longest line read from a stream by default,
+// results are a few kilobytes.
+const default_max_line_size = 1 << 20
+
+// quarantine_excerpt is how much of a line too long to be read is kept in
+// the quarantine.
+const quarantine_excerpt = 4096
+
+// Reasons a line of a stream is rejected.
+const (
+	reason_too_long     = "line too long"
+	reason_invalid_utf8 = "invalid UTF-8"
+	reason_invalid_json = "invalid JSON"
+	reason_not_object   = "not a JSON object"
+	reason_trailing     = "data after the JSON object"
+)
+
+// lineError is why a line could not be decoded into an event.
+type lineError struct {
+	reason string
+	err    error
+}
+
+func (e *lineError) Error() string {
+	if e.err == nil {
+		return e.reason
+	}
+	return e.reason + ": " + e.err.Error()
+}
+
+// reasonOf returns the rejection reason of a decoding error.
+func reasonOf(err error) string {
+	if le, ok := err.(*lineError); ok {
+		return le.reason
+	}
+	return reason_invalid_json
+}
+
+// decodeEvent decodes a line holding exactly one JSON object, anything else
+// is a *lineError. Numbers are kept as json.Number so re-encoding an event
+// does not change them.
+func decodeEvent(byts []byte) (event, error) {
+	if !utf8.Valid(byts) {
+		return nil, &lineError{reason: reason_invalid_utf8}
+	}
+	trimmed := bytes.TrimSpace(byts)
+	if len(trimmed) == 0 || trimmed[0] != '{' {
+		return nil, &lineError{reason: reason_not_object}
+	}
+	r := bytes.NewReader(trimmed)
+	d := json.NewDecoder(r)
+	d.UseNumber()
+	var e event
+	if err := d.Decode(&e); err != nil {
+		return nil, &lineError{reason_invalid_json, err}
+	}
+	rest, _ := ioutil.ReadAll(io.MultiReader(d.Buffered(), r))
+	if len(bytes.TrimSpace(rest)) > 0 {
+		return nil, &lineError{reason: reason_trailing}
+	}
+	return e, nil
+}
+
+// lineReader splits a stream into lines of at most max bytes. Longer lines
+// are skipped without being held in memory.
+type lineReader struct {
+	r   *bufio.Reader
+	max int
+}
+
+func newLineReader(r io.Reader, max int) *lineReader {
+	if max <= 0 {
+		max = default_max_line_size
+	}
+	return &lineReader{r: bufio.NewReaderSize(r, 64*1024), max: max}
+}
+
+// next returns the next line with its line break. A line longer than max is
+// returned as an excerpt of its start with tooLong set, the rest of it is
+// discarded.
+func (l *lineReader) next() (line []byte, tooLong bool, err error) {
+	for {
+		chunk, err := l.r.ReadSlice('\n')
+		if !tooLong {
+			if len(line)+len(chunk) > l.max {
+				tooLong = true
+				n := quarantine_excerpt - len(line)
+				if n > len(chunk) {
+					n = len(chunk)
+				}
+				if n > 0 {
+					line = append(line, chunk[:n]...)
+				} else {
+					// the start of the line was read before it got too long
+					line = append([]byte(nil), line[:quarantine_excerpt]...)
+				}
+			} else {
+				line = append(line, chunk...)
+			}
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		return line, tooLong, err
+	}
+}
+
+// quarantineEntry is a line of the quarantine file: a rejected line with the
+// reason and the time it was rejected.
+type quarantineEntry struct {
+	TS     time.Time `json:"ts"`
+	Reason string    `json:"reason"`
+	Line   string    `json:"line"`
+}
+
+// lineRejects counts the lines rejected by a pipeline by reason, writes them
+// to the quarantine when there is one and reports them when closed.
+type lineRejects struct {
+	mu         sync.Mutex
+	counts     map[string]uint64
+	quarantine io.WriteCloser
+	path       string
+	report     io.Writer
+	now        func() time.Time
+}
+
+func newLineRejects(quarantine string, report io.Writer) (*lineRejects, error) {
+	r := &lineRejects{counts: map[string]uint64{}, report: report, now: time.Now}
+	if len(quarantine) > 0 {
+		f, err := newRotatingFile(rotateOptions{pattern: quarantine, literal: true})
+		if err != nil {
+			return nil, err
+		}
+		r.quarantine, r.path = f, quarantine
+	}
+	return r, nil
+}
+
+func (r *lineRejects) reject(line []byte, reason string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.counts[reason]++
+	if r.quarantine == nil {
+		return nil
+	}
+	byts, err := json.Marshal(quarantineEntry{r.now().UTC(), reason, string(bytes.TrimRight(line, "\r\n"))})
+	if err != nil {
+		return err
+	}
+	_, err = r.quarantine.Write(append(byts, '\n'))
+	return err
+}
+
+// total returns the number of rejected lines.
+func (r *lineRejects) total() uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var n uint64
+	for _, c := range r.counts {
+		n += c
+	}
+	return n
+}
+
+// String summarizes the rejected lines, for example
+// "3 malformed line(s): 2 invalid JSON, 1 line too long".
+func (r *lineRejects) String() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var reasons []string
+	for reason := range r.counts {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	var n uint64
+	for i, reason := range reasons {
+		n += r.counts[reason]
+		reasons[i] = fmt.Sprintf("%d %s", r.counts[reason], reason)
+	}
+	return fmt.Sprintf("%d malformed line(s): %s", n, strings.Join(reasons, ", "))
+}
+
+func (r *lineRejects) Close() error {
+	if r.total() > 0 {
+		s := "Skipped " + r.String()
+		if r.quarantine != nil {
+			s += ", quarantined to " + r.path
+		}
+		fmt.Fprintln(r.report, s)
+	}
+	if r.quarantine != nil {
+		return r.quarantine.Close()
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDecodeEvent(t *testing.T) {
+	for line, want := range map[string]string{
+		`{"origin":{"job_id":"1"}}` + "\n": "",
+		`  {"a":1}  `:                      "",
+		`{"origin":`:                       reason_invalid_json,
+		`[1,2]`:                            reason_not_object,
+		`"text"`:                           reason_not_object,
+		`{"a":1} {"b":2}`:                  reason_trailing,
+		"{\"a\":\"\xff\"}":                 reason_invalid_utf8,
+	} {
+		_, err := decodeEvent([]byte(line))
+		if len(want) == 0 && err != nil || len(want) > 0 && (err == nil || reasonOf(err) != want) {
+			t.Fatal("decoding", line, "returned", err, "want", want)
+		}
+	}
+}
+
+func TestLineReader(t *testing.T) {
+	long := strings.Repeat("x", 100*1024)
+	r := newLineReader(strings.NewReader("{}\n"+long+"\n{\"a\":1}\nlast"), 1024)
+	var got []string
+	for {
+		line, tooLong, err := r.next()
+		if tooLong {
+			if len(line) != quarantine_excerpt {
+				t.Fatal("unexpected excerpt of", len(line), "bytes")
+			}
+			got = append(got, "too long")
+		} else if len(line) > 0 {
+			got = append(got, string(line))
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if strings.Join(got, "|") != "{}\n|too long|{\"a\":1}\n|last" {
+		t.Fatal("unexpected lines", got)
+	}
+	// too long after the first chunks were kept
+	r = newLineReader(strings.NewReader(strings.Repeat("x", 200*1024)+"\n"), 100*1024)
+	if line, tooLong, _ := r.next(); !tooLong || len(line) != quarantine_excerpt {
+		t.Fatal("unexpected excerpt of", len(line), "bytes")
+	}
+}
+
+func TestQuarantine(t *testing.T) {
+	dir, err := ioutil.TempDir("", "quarantine")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "bad.ndjson")
+
+	var out, report bytes.Buffer
+	rejects, err := newLineRejects(path, &report)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	p := &pipeline{output: &out, rejects: rejects, maxLine: 100, closers: []io.Closer{rejects}}
+	p.withStats(ioutil.Discard, time.Hour, 1, true)
+	body := jobResult
+	body = append(body, "\n{\"origin\":\n"...)
+	body = append(body, `{"result":"`+strings.Repeat("x", 200)+`"}`+"\n"...)
+	body = append(body, otherResult...)
+	if err := readFromResponse(bytes.NewReader(body), p); err != nil {
+		t.Fatal(err.Error())
+	}
+	r := p.stats.report(p.stats.last)
+	if err := p.close(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if out.String() != string(jobResult)+string(otherResult) {
+		t.Fatal("unexpected output", out.String())
+	}
+	if r.DecodeErrors != 2 || r.DecodeErrorReasons[reason_invalid_json] != 1 || r.DecodeErrorReasons[reason_too_long] != 1 {
+		t.Fatal("unexpected counters", r.DecodeErrorReasons)
+	}
+	if want := "Skipped 2 malformed line(s): 1 invalid JSON, 1 line too long, quarantined to " + path + "\n"; report.String() != want {
+		t.Fatal("unexpected report", report.String())
+	}
+	byts, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	lines := strings.Split(strings.TrimSpace(string(byts)), "\n")
+	var q quarantineEntry
+	if len(lines) != 2 || json.Unmarshal([]byte(lines[0]), &q) != nil || q.Reason != reason_invalid_json || q.Line != `{"origin":` {
+		t.Fatal("unexpected quarantine", string(byts))
+	}
+}
@@ -0,0 +1,630 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const streamFlagsHelp = `
+Output options:
+ -filter=FILTER
+   Only show events matching FILTER, for example
+   target.port in (22, 2222) && target.ip in 10.0.0.0/8 && module == "ssh" && result.data.banner ~ /OpenSSH_7/
+   Fields are dotted paths into the event, ip, port, module and job_id are short for the common ones.
+   Comparisons are == != < <= > >=, ~ and !~ against a /regex/ and in against a CIDR or a list of values.
+   They combine with &&, ||, ! and parentheses.
+ -max-line-size=SIZE
+   Skip lines longer than SIZE (default 1M) without reading them into memory.
+ -quarantine=FILE
+   Check that every line is a single JSON object and write those that are not, or are too long, to FILE
+   as {"ts","reason","line"} objects. Without it lines are only checked when a filter, format, sink,
+   -stats or another option needs their content, lines copied to the output as received are not.
+   Malformed lines that are checked, and lines too long, are skipped and counted by reason, the counts
+   are printed at the end and in the -stats reports.
+ -queue-size=N
+   Lines are read, decoded, filtered and written by separate stages with queues of N lines (default 10000)
+   between them, so a slow output or sink does not hold up reading the stream. 0 does all in one.
+ -queue-policy=POLICY
+   What happens to lines read while the queue is full: block (default) stops reading, drop-oldest and
+   drop-newest drop lines and count them, spill writes them to a file in -spill-dir until the queue empties.
+ -decoders=N
+   Decode N lines at the same time, the events keep the order they were received in.
+ -dedupe
+   Drop events already seen within -dedupe-window (default 1h), for reconnects or overlapping subscriptions.
+ -dedupe-key=FIELDS
+   Fields identifying an event, default ip,port,module,hash where hash is a hash of the result.
+ -dedupe-mode=MODE, -dedupe-size=N, -dedupe-fp=RATE
+   lru (default) remembers the last N (default 1000000) events exactly. bloom remembers them in two
+   rotating Bloom filters sized for N events with RATE (default 0.001) false positives, in constant
+   memory for days on the firehose, events are then remembered for one to two windows.
+ -sample-rate=RATE
+   Pass only a fraction RATE of the events, for example 0.01.
+ -sample-key=FIELD
+   Sample on a hash of FIELD instead of at random, so all events with the same value, for example
+   the same target.ip, are either always or never passed. Events without FIELD are sampled at random.
+ -max-rate=N/s
+   Pass at most N events per second (or N/m, N/h), events above the rate are dropped and counted.
+   Sampling and the rate limit apply after -filter and -dedupe.
+ -enrich=geo,asn
+   Add an "enrichment" object with the country, city and location (geo) and the autonomous system (asn)
+   of target.ip to every event passed, sent to sinks and written, looked up in local MaxMind DB (.mmdb)
+   and ip2asn TSV files set for the profile in the config, for example
+     [enrich.default]
+     geo = "GeoLite2-City.mmdb"
+     asn = ["GeoLite2-ASN.mmdb", "ip2asn-v6.tsv.gz"]
+   The first file of a kind that knows an address is used. Files are read again when they change.
+ -enrich-cache=N
+   Number of addresses whose enrichment is kept (default 100000).
+ -fields=FIELDS
+   Comma separated fields to show instead of the whole event, for example target.ip,target.port,result.data.banner
+   Array elements are selected with [N], a field followed by =VALUE uses VALUE when the field is missing.
+   Fields are printed as a flat JSON object, or as a line separated by DELIMITER when -delimiter is given.
+ -delimiter=DELIMITER
+ -missing=VALUE
+   Shown for missing fields without their own default, JSON shows null otherwise.
+ -format=FORMAT
+   raw     the events as received (default)
+   ndjson  one normalized JSON object per line
+   pretty  indented JSON
+   csv     comma separated fields with a header
+   tsv     tab separated fields with a header
+   table   aligned columns sized from the first rows, no wider than -max-width
+           (default 40), coloured on a terminal
+   cef     ArcSight Common Event Format
+   leef    IBM QRadar Log Event Extended Format 1.0
+   none    nothing, for use with -sink
+   csv, tsv and table show FIELDS, or ip, port, module and job id when no fields are given.
+ -field-map=FILE
+   TOML file with [cef] and [leef] tables mapping extension keys to event fields, for example
+   [cef]
+   dhost = "result.data.hostname"
+   cs2 = "result.data.service.banner|result.data.banner"
+   Fields separated by | are tried in order, values starting with = are used as they are and
+   empty values remove a key. By default ip, port, module, timestamp, job id, banner and service
+   name are mapped to dst, dpt, app, rt, cs1, cs2 and cs3 (dst, dstPort, module, devTime, jobId,
+   banner and service in LEEF).
+ -output-file=PATTERN
+   Write to files named after PATTERN instead of stdout, strftime conversions such as %Y%m%d-%H are
+   replaced with the time the file was started, for example firehose-%Y%m%d-%H.ndjson.gz
+   Files are written under PATTERN.part and renamed once complete, names ending in .gz are gzipped.
+   A .part file left by a crash is renamed as it is, and writing stops if a file can't be renamed.
+ -rotate-size=SIZE, -rotate-every=DURATION
+   Start a new file after SIZE bytes before compression (10M, 1G) or after DURATION (30m, 24h).
+   A new file is also started whenever PATTERN yields a new name.
+ -compress
+   Gzip files even when PATTERN does not end in .gz.
+ -keep=N, -max-age=DURATION
+   Remove all but the N newest files, or files older than DURATION, named after PATTERN: every
+   strftime verb stands for its digits only, so other files in the directory are kept.
+ -sink=URL
+   Also send events to URL, may be given more than once.
+   elasticsearch://[user:password@]host:9200/index-%Y.%m.%d[?batch=500&flush=5s&retries=5&api_key=KEY]
+     Index events with the _bulk API in batches of batch events or every flush, elasticsearch+https uses TLS.
+     Indexes are named with the time of the event and documents are identified by job id, ip, port and module.
+   webhook://host/path[?batch=1&flush=5s&retries=5&template=FILE&header=Name:Value&secret_env=VAR&dead_letter=FILE]
+     POST events singly or in batches, webhook+https uses TLS. Other query parameters are kept in the URL.
+     FILE is a Go text/template executed with .Event, .Line, .Events and .Lines, by default single events are
+     posted as received and batches as a JSON array. header may be given more than once.
+     With secret=KEY or secret_env=VAR the body is signed with HMAC-SHA256 in the X-Signature-256 header,
+     signature_header=NAME changes it. Events failing after the retries are appended to dead_letter.
+   syslog[+udp|+tcp|+tls]://host:514[?format=cef&facility=local0&severity=notice&app_name=40fy-client&field_map=FILE]
+     Send RFC 5424 messages over udp (default), tcp or tls, with the payload in format, cef, leef or any
+     other format. ca=FILE verifies the server with the certificates in FILE, insecure=true does not
+     verify it. Stream connections are opened again when sending fails, up to retries=5 times.
+ -sink-queue=DIR
+   Write the events for every sink to a queue of segment files under DIR first, and remove them once the sink
+   confirmed their delivery. Events survive outages of the sink and restarts, they are sent again in order
+   until delivered, so some may be delivered twice. See 40fy-client queue inspect.
+ -sink-queue-size=SIZE
+   Largest size of the queue of a sink (default 1G), newer events are dropped and counted beyond it.
+ -record=FILE
+   Record every line received with the time it was received to FILE, gzipped when it ends in .gz,
+   to be played again with replay.
+ -stats
+   Print statistics of the events to stderr every -stats-interval (default 10s): events and bytes
+   per second, decode errors, unique IPs and the -top (default 10) ports, modules, /16 networks and job ids.
+ -stats-json
+   Print the statistics as one JSON object per report.
+	`
+
+// streamFlags are the flags shared by stream and firehose that control how
+// events are processed before they are written.
+type streamFlags struct {
+	// config is read for the databases of -enrich, loadConfig when nil
+	config map[string]interface{}
+
+	filter    *string
+	fields    *string
+	delimiter *string
+	missing   *string
+	format    *string
+	maxWidth  *int
+	fieldMap  *string
+
+	outputFile  *string
+	rotateSize  *string
+	rotateEvery *time.Duration
+	compress    *bool
+	keep        *int
+	maxAge      *time.Duration
+
+	sinks         stringList
+	sinkQueue     *string
+	sinkQueueSize *string
+	record        *string
+
+	maxLineSize *string
+	quarantine  *string
+
+	queueSize   *int
+	queuePolicy *string
+	decoders    *int
+	spillDir    *string
+
+	dedupe       *bool
+	dedupeKey    *string
+	dedupeWindow *time.Duration
+	dedupeMode   *string
+	dedupeSize   *int
+	dedupeFP     *float64
+
+	sampleRate *float64
+	sampleKey  *string
+	maxRate    *string
+
+	enrich      *string
+	enrichCache *int
+
+	stats         *bool
+	statsInterval *time.Duration
+	statsJSON     *bool
+	top           *int
+}
+
+func addStreamFlags(fs *flag.FlagSet) *streamFlags {
+	f := &streamFlags{
+		filter:    fs.String("filter", "", "only show events matching this expression"),
+		fields:    fs.String("fields", "", "comma separated fields to show instead of the whole event"),
+		delimiter: fs.String("delimiter", "", "print fields as a line separated by this instead of a JSON object"),
+		missing:   fs.String("missing", "", "value shown for fields missing from an event"),
+		format:    fs.String("format", "", "output format: raw, ndjson, pretty, csv, tsv, table, cef or leef"),
+		maxWidth:  fs.Int("max-width", 40, "widest column of the table format"),
+		fieldMap:  fs.String("field-map", "", "TOML file mapping event fields to cef and leef keys"),
+
+		outputFile:  fs.String("output-file", "", "write to files named after this strftime pattern instead of stdout"),
+		rotateSize:  fs.String("rotate-size", "", "start a new output file after this many bytes"),
+		rotateEvery: fs.Duration("rotate-every", 0, "start a new output file after this long"),
+		compress:    fs.Bool("compress", false, "gzip output files"),
+		keep:        fs.Int("keep", 0, "number of output files to keep"),
+		maxAge:      fs.Duration("max-age", 0, "remove output files older than this"),
+	}
+	fs.Var(&f.sinks, "sink", "also send events to this sink, may be given more than once")
+	f.sinkQueue = fs.String("sink-queue", "", "queue events for the sinks in this directory until they are delivered")
+	f.sinkQueueSize = fs.String("sink-queue-size", "1G", "largest size of the queue of a sink, newer events are dropped beyond it")
+	f.record = fs.String("record", "", "record every line received with its time to this file, for replay")
+	f.maxLineSize = fs.String("max-line-size", "1M", "longest line read from the stream, longer lines are skipped")
+	f.quarantine = fs.String("quarantine", "", "write lines that are not valid events to this file with the reason")
+	f.queueSize = fs.Int("queue-size", 10000, "lines queued between the stages of processing, 0 to process lines as they are read")
+	f.queuePolicy = fs.String("queue-policy", policy_block, "what to do with lines read while the queue is full: block, drop-oldest, drop-newest or spill")
+	f.decoders = fs.Int("decoders", 1, "number of lines decoded at the same time")
+	f.spillDir = fs.String("spill-dir", "", "directory of the spill file, default the temporary directory")
+	f.dedupe = fs.Bool("dedupe", false, "drop events already seen within -dedupe-window")
+	f.dedupeKey = fs.String("dedupe-key", defaultDedupeKey, "comma separated fields identifying duplicate events, hash is a hash of the result")
+	f.dedupeWindow = fs.Duration("dedupe-window", time.Hour, "time duplicates are dropped for, 0 for as long as they are remembered")
+	f.dedupeMode = fs.String("dedupe-mode", "lru", "how events are remembered: lru or bloom")
+	f.dedupeSize = fs.Int("dedupe-size", 1000000, "number of events remembered")
+	f.dedupeFP = fs.Float64("dedupe-fp", 0.001, "false positive rate of the bloom mode")
+	f.sampleRate = fs.Float64("sample-rate", 1, "fraction of the events passed, for example 0.01")
+	f.sampleKey = fs.String("sample-key", "", "field whose value decides whether an event is sampled, for example target.ip")
+	f.maxRate = fs.String("max-rate", "", "most events passed, as N/s, N/m or N/h")
+	f.enrich = fs.String("enrich", "", "comma separated enrichments added to events from the databases of the profile: geo, asn")
+	f.enrichCache = fs.Int("enrich-cache", default_enrich_cache, "number of addresses whose enrichment is cached")
+	f.stats = fs.Bool("stats", false, "print statistics of the events to stderr")
+	f.statsInterval = fs.Duration("stats-interval", 10*time.Second, "time between statistics reports")
+	f.statsJSON = fs.Bool("stats-json", false, "print statistics as JSON")
+	f.top = fs.Int("top", 10, "number of top values in statistics")
+	return f
+}
+
+// build compiles the flags into a pipeline writing to output. jobIDs, when
+// set, restrict the pipeline to the events of those jobs.
+func (f *streamFlags) build(output io.Writer, jobIDs ...string) (*pipeline, error) {
+	p := &pipeline{}
+	if len(*f.outputFile) > 0 {
+		size, err := parseSize(*f.rotateSize)
+		if err != nil {
+			return nil, err
+		}
+		file, err := newRotatingFile(rotateOptions{
+			pattern:  *f.outputFile,
+			maxSize:  size,
+			every:    *f.rotateEvery,
+			compress: *f.compress,
+			keep:     *f.keep,
+			maxAge:   *f.maxAge,
+		})
+		if err != nil {
+			return nil, err
+		}
+		output = file
+		p.closers = append(p.closers, file)
+	}
+	p.output = output
+	maxLine, err := parseSize(*f.maxLineSize)
+	if err != nil || maxLine <= 0 {
+		p.close()
+		return nil, fmt.Errorf("invalid max line size %q", *f.maxLineSize)
+	}
+	p.maxLine = int(maxLine)
+	rejects, err := newLineRejects(*f.quarantine, os.Stderr)
+	if err != nil {
+		p.close()
+		return nil, err
+	}
+	p.rejects = rejects
+	p.closers = append(p.closers, rejects)
+	if *f.queueSize > 0 {
+		st, err := newStages(stageOptions{
+			size:     *f.queueSize,
+			policy:   *f.queuePolicy,
+			decoders: *f.decoders,
+			spillDir: *f.spillDir,
+		}, os.Stderr)
+		if err != nil {
+			p.close()
+			return nil, err
+		}
+		p.stages = st
+		p.closers = append(p.closers, st)
+	}
+	if len(*f.record) > 0 {
+		rec, err := newRecorder(*f.record)
+		if err != nil {
+			p.close()
+			return nil, err
+		}
+		p.recorder = rec
+		p.closers = append(p.closers, rec)
+	}
+	p.filterJobs(jobIDs)
+	if err := p.filterBy("", *f.filter); err != nil {
+		p.close()
+		return nil, err
+	}
+	if *f.dedupe {
+		pred, err := newDedupe(dedupeOptions{
+			key:    *f.dedupeKey,
+			window: *f.dedupeWindow,
+			mode:   *f.dedupeMode,
+			size:   *f.dedupeSize,
+			fpRate: *f.dedupeFP,
+		})
+		if err != nil {
+			p.close()
+			return nil, err
+		}
+		p.filters = append(p.filters, pred)
+	}
+	if *f.sampleRate != 1 || len(*f.sampleKey) > 0 {
+		pred, err := newSampler(*f.sampleRate, *f.sampleKey)
+		if err != nil {
+			p.close()
+			return nil, err
+		}
+		p.filters = append(p.filters, pred)
+	}
+	if len(*f.maxRate) > 0 {
+		perSec, err := parseRate(*f.maxRate)
+		if err != nil {
+			p.close()
+			return nil, err
+		}
+		limiter := newRateLimiter(perSec, os.Stderr)
+		p.filters = append(p.filters, limiter.allow)
+		p.closers = append(p.closers, limiter)
+	}
+	if *f.stats {
+		if *f.statsInterval <= 0 {
+			p.close()
+			return nil, fmt.Errorf("stats interval must be positive")
+		}
+		p.withStats(os.Stderr, *f.statsInterval, *f.top, *f.statsJSON)
+		if p.stages != nil {
+			p.stats.stages = p.stages.metrics()
+		}
+	}
+	opts := formatOptions{
+		delimiter: *f.delimiter,
+		maxWidth:  *f.maxWidth,
+		tty:       isTerminal(output),
+		fieldMap:  *f.fieldMap,
+	}
+	if len(*f.fields) > 0 {
+		proj, err := parseProjection(*f.fields, *f.missing)
+		if err != nil {
+			p.close()
+			return nil, err
+		}
+		opts.proj = proj
+	}
+	if len(*f.enrich) > 0 {
+		config := f.config
+		if config == nil {
+			config = loadConfig()
+		}
+		kinds := splitList(*f.enrich)
+		files, err := enrichFiles(config, kinds)
+		if err != nil {
+			p.close()
+			return nil, err
+		}
+		en, err := newEnricher(kinds, files, *f.enrichCache, enrich_check_interval, os.Stderr)
+		if err != nil {
+			p.close()
+			return nil, err
+		}
+		p.enrich = en.tag
+		p.closers = append(p.closers, en)
+	}
+	queueSize, err := parseSize(*f.sinkQueueSize)
+	if err != nil {
+		p.close()
+		return nil, err
+	}
+	for _, spec := range f.sinks {
+		sk, err := newSink(spec)
+		if err != nil {
+			p.close()
+			return nil, err
+		}
+		if len(*f.sinkQueue) > 0 {
+			d, err := newDurableSink(sk, spec, *f.sinkQueue, queueSize, os.Stderr)
+			if err != nil {
+				sk.close()
+				p.close()
+				return nil, err
+			}
+			sk = d
+		}
+		p.addSink(sk)
+	}
+	format := *f.format
+	if format == "none" {
+		p.output = ioutil.Discard
+		format = ""
+	}
+	if len(format) == 0 && opts.proj != nil {
+		format = "ndjson"
+		if len(opts.delimiter) > 0 {
+			format = "delimited"
+		}
+	}
+	if len(format) > 0 && format != "raw" {
+		fm, err := newFormatter(format, p.output, opts)
+		if err != nil {
+			p.close()
+			return nil, err
+		}
+		p.format = fm
+		if c, ok := fm.(io.Closer); ok {
+			// flushed before the output it writes to is closed
+			p.closers = append([]io.Closer{c}, p.closers...)
+		}
+	}
+	return p, nil
+}
+
+// pipeline handles the lines read from a stream one at a time. Lines are
+// only decoded when some stage needs to look inside them, otherwise they are
+// copied as they were received.
+type pipeline struct {
+	filters []predicate
+	// format renders events for output, nil writes lines as received
+	format   formatter
+	output   io.Writer
+	sinks    []sink
+	stats    *streamStats
+	recorder *recorder
+	// rejects counts, and quarantines, the lines that are not events
+	rejects *lineRejects
+	// maxLine is the longest line read, 0 for default_max_line_size
+	maxLine int
+	// stages, when set, runs the pipeline in stages as lines are read
+	stages *stages
+	// enrich, when set, adds to events and lines before they are sent
+	enrich func(e event, line []byte) []byte
+	// tag, when set, marks events and lines before they are written
+	tag func(e event, line []byte) []byte
+	// written, when set, is called with every event written by emit
+	written func(e event)
+	closers []io.Closer
+	once    sync.Once
+}
+
+// filterBy restricts the pipeline to the events of jobID and those matching
+// the filter expression, when given.
+func (p *pipeline) filterBy(jobID, expr string) error {
+	p.filterJobs([]string{jobID})
+	if len(expr) > 0 {
+		pred, err := compileFilter(expr)
+		if err != nil {
+			return err
+		}
+		p.filters = append(p.filters, pred)
+	}
+	return nil
+}
+
+// filterJobs restricts the pipeline to the events of the given jobs, empty
+// ids are ignored.
+func (p *pipeline) filterJobs(ids []string) {
+	jobs := map[string]bool{}
+	for _, id := range ids {
+		if len(id) > 0 {
+			jobs[id] = true
+		}
+	}
+	if len(jobs) > 0 {
+		p.filters = append(p.filters, func(e event) bool { return jobs[e.jobID()] })
+	}
+}
+
+// withStats counts the events that pass the filters and reports them to w
+// every interval.
+func (p *pipeline) withStats(w io.Writer, interval time.Duration, top int, asJSON bool) {
+	p.stats = newStreamStats(top)
+	p.closers = append(p.closers, newStatsReporter(p.stats, w, interval, asJSON))
+}
+
+func (p *pipeline) needsDecode() bool {
+	return len(p.filters) > 0 || p.format != nil || len(p.sinks) > 0 || p.stats != nil || p.tag != nil || p.written != nil || p.enrich != nil ||
+		p.rejects != nil && p.rejects.quarantine != nil
+}
+
+// handle records, decodes, processes and writes a line. Run in stages the
+// same steps are taken by different goroutines, see runStages.
+func (p *pipeline) handle(line []byte) error {
+	if err := p.record(line); err != nil {
+		return err
+	}
+	e, ok, err := p.decode(line)
+	if err != nil || !ok {
+		return err
+	}
+	if !p.process(e, len(line)) {
+		return nil
+	}
+	return p.emit(e, line)
+}
+
+func (p *pipeline) record(line []byte) error {
+	if p.recorder == nil {
+		return nil
+	}
+	return p.recorder.record(line)
+}
+
+// decode decodes line when some stage needs to look inside it, rejecting
+// lines that are not events. ok is false for lines that are skipped, the
+// event is nil for lines copied as received.
+func (p *pipeline) decode(line []byte) (e event, ok bool, err error) {
+	if !p.needsDecode() {
+		return nil, true, nil
+	}
+	e, err = decodeEvent(line)
+	if err != nil {
+		// blank lines keep the connection alive
+		if len(bytes.TrimSpace(line)) == 0 {
+			return nil, false, nil
+		}
+		return nil, false, p.reject(line, reasonOf(err))
+	}
+	return e, true, nil
+}
+
+// process applies the filters to a decoded event and counts it when it
+// passes them.
+func (p *pipeline) process(e event, size int) bool {
+	if e == nil {
+		return true
+	}
+	for _, f := range p.filters {
+		if !f(e) {
+			return false
+		}
+	}
+	if p.stats != nil {
+		p.stats.add(e, size)
+	}
+	return true
+}
+
+// emit sends an event to the sinks and writes it to the output. Sinks get
+// the line as received and enriched, before any tag.
+func (p *pipeline) emit(e event, line []byte) error {
+	if e == nil {
+		_, err := p.output.Write(line)
+		return err
+	}
+	if p.enrich != nil {
+		line = p.enrich(e, line)
+	}
+	for _, sk := range p.sinks {
+		if err := sk.send(e, line); err != nil {
+			return err
+		}
+	}
+	if p.tag != nil {
+		line = p.tag(e, line)
+	}
+	var err error
+	if p.format != nil {
+		err = p.format.write(e, line)
+	} else {
+		_, err = p.output.Write(line)
+	}
+	if err == nil && p.written != nil {
+		p.written(e)
+	}
+	return err
+}
+
+// reject counts a line that is not an event and quarantines it.
+func (p *pipeline) reject(line []byte, reason string) error {
+	if p.stats != nil {
+		p.stats.decodeError(reason)
+	}
+	if p.rejects != nil {
+		return p.rejects.reject(line, reason)
+	}
+	return nil
+}
+
+// addSink sends the events passing the filters to sk as well, and closes it
+// with the pipeline.
+func (p *pipeline) addSink(sk sink) {
+	p.sinks = append(p.sinks, sk)
+	p.closers = append(p.closers, sinkCloser{sk})
+}
+
+type sinkCloser struct{ s sink }
+
+func (c sinkCloser) Close() error { return c.s.close() }
+
+// close releases the outputs of the pipeline, finishing any output files.
+func (p *pipeline) close() error {
+	var err error
+	p.once.Do(func() {
+		for _, c := range p.closers {
+			if cerr := c.Close(); cerr != nil && err == nil {
+				err = cerr
+			}
+		}
+	})
+	return err
+}
+
+// closeOnInterrupt closes the pipeline before the process is stopped by
+// SIGINT or SIGTERM so output files are complete.
+func (p *pipeline) closeOnInterrupt() {
+	if len(p.closers) == 0 {
+		return
+	}
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-c
+		if err := p.close(); err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to close output", err.Error())
+		}
+		os.Exit(1)
+	}()
+}
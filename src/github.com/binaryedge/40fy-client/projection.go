@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+type projectedField struct {
+	name   string
+	path   []string
+	def    string
+	hasDef bool
+}
+
+// projection picks a list of fields out of an event, for example
+// "target.ip,target.port,result.data.banner=none". A field may carry its own
+// default after "=", used when the path is missing from an event.
+type projection struct {
+	fields  []projectedField
+	missing string
+}
+
+func parseProjection(spec, missing string) (*projection, error) {
+	p := &projection{missing: missing}
+	for _, f := range splitList(spec) {
+		pf := projectedField{name: f}
+		if i := strings.Index(f, "="); i >= 0 {
+			pf.name, pf.def, pf.hasDef = f[:i], f[i+1:], true
+		}
+		pf.path = splitPath(pf.name)
+		if len(pf.path) == 0 {
+			return nil, fmt.Errorf("invalid field %q", f)
+		}
+		p.fields = append(p.fields, pf)
+	}
+	if len(p.fields) == 0 {
+		return nil, fmt.Errorf("no fields given")
+	}
+	return p, nil
+}
+
+func (p *projection) names() []string {
+	names := make([]string, len(p.fields))
+	for i, f := range p.fields {
+		names[i] = f.name
+	}
+	return names
+}
+
+// value returns the i-th field of e, nil when it is missing and has no
+// default.
+func (p *projection) value(e event, i int) interface{} {
+	f := &p.fields[i]
+	if v, ok := lookup(e, f.path); ok {
+		return v
+	}
+	if f.hasDef {
+		return f.def
+	}
+	if len(p.missing) > 0 {
+		return p.missing
+	}
+	return nil
+}
+
+// strings returns the fields of e as text.
+func (p *projection) strings(e event) []string {
+	values := make([]string, len(p.fields))
+	for i := range p.fields {
+		values[i] = valueString(p.value(e, i))
+	}
+	return values
+}
+
+// object encodes the fields of e as a flat JSON object keyed by field name,
+// in the order they were given.
+func (p *projection) object(e event) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, f := range p.fields {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		k, _ := json.Marshal(f.name)
+		buf.Write(k)
+		buf.WriteByte(':')
+		v, err := json.Marshal(p.value(e, i))
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(v)
+	}
+	buf.WriteString("}\n")
+	return buf.Bytes(), nil
+}
+
+// delimited joins the fields of e with delim. Backslashes, line breaks, tabs
+// and the delimiter are escaped so every event stays on one line.
+func (p *projection) delimited(e event, delim string) []byte {
+	values := p.strings(e)
+	for i, v := range values {
+		values[i] = escapeField(v, delim)
+	}
+	return []byte(strings.Join(values, delim) + "\n")
+}
+
+func escapeField(v, delim string) string {
+	if !strings.ContainsAny(v, "\\\n\r\t"+delim) {
+		return v
+	}
+	v = strings.Replace(v, "\\", "\\\\", -1)
+	v = strings.Replace(v, "\n", "\\n", -1)
+	v = strings.Replace(v, "\r", "\\r", -1)
+	v = strings.Replace(v, "\t", "\\t", -1)
+	if len(delim) > 0 && delim != "\t" {
+		v = strings.Replace(v, delim, "\\"+delim, -1)
+	}
+	return v
+}
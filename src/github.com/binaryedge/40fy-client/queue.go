@@ -0,0 +1,403 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mitchellh/cli"
+)
+
+const (
+	sink_spec_file       = "sink"
+	wal_segment_size     = 64 << 20
+	queue_max_inflight   = 10000
+	queue_drain_timeout  = 10 * time.Second
+	queue_sync_interval  = time.Second
+	queue_retry_interval = 30 * time.Second
+)
+
+// ackingSink is a sink that confirms delivery. ack is called once the event
+// was delivered or given up on for good, with nil, or with an error when it
+// should be sent again later.
+type ackingSink interface {
+	sink
+	sendAck(e event, line []byte, ack func(err error)) error
+}
+
+// sinkQueueDir is the directory of the queue of the sink spec under dir,
+// named after the scheme, host and path of the sink, without credentials.
+func sinkQueueDir(dir, spec string) (string, string) {
+	name := spec
+	if u, err := url.Parse(escapePercent(spec)); err == nil {
+		name = u.Scheme + "://" + u.Host + u.Path
+	}
+	sum := sha1.Sum([]byte(name))
+	scheme := name
+	if i := strings.Index(scheme, ":"); i >= 0 {
+		scheme = scheme[:i]
+	}
+	return filepath.Join(dir, scheme+"-"+hex.EncodeToString(sum[:6])), name
+}
+
+// durableSink writes events to a queue on disk before they are delivered to
+// the sink it wraps, so events survive outages of the sink and restarts of
+// the client. An event leaves the queue once the sink acknowledged it.
+// Events a sink failed to deliver are sent again, in order, after a pause,
+// so an event may be delivered more than once.
+type durableSink struct {
+	inner  sink
+	q      *wal
+	name   string
+	report io.Writer
+
+	mu       sync.Mutex
+	settled  *sync.Cond
+	inflight []*queuedEvent
+	nacked   error
+	dropped  uint64
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// queuedEvent is an event of the queue handed to the sink.
+type queuedEvent struct {
+	rec   walRecord
+	acked bool
+	// settled is set once the sink acknowledged or failed the event
+	settled bool
+}
+
+func newDurableSink(inner sink, spec, dir string, maxSize int64, report io.Writer) (*durableSink, error) {
+	path, name := sinkQueueDir(dir, spec)
+	q, err := openWAL(path, wal_segment_size, maxSize)
+	if err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(path, sink_spec_file), []byte(name+"\n"), 0600); err != nil {
+		q.close()
+		return nil, err
+	}
+	d := &durableSink{
+		inner:  inner,
+		q:      q,
+		name:   name,
+		report: report,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	d.settled = sync.NewCond(&d.mu)
+	if n := q.depth(); n > 0 {
+		fmt.Fprintf(report, "Queue: resuming delivery of %d event(s) to %s\n", n, name)
+	}
+	go d.deliver()
+	return d, nil
+}
+
+func (d *durableSink) send(e event, line []byte) error {
+	err := d.q.append(line, time.Now())
+	if err == errWALFull {
+		d.mu.Lock()
+		d.dropped++
+		d.mu.Unlock()
+		return nil
+	}
+	return err
+}
+
+// deliver hands the queued events to the sink from the cursor on, and
+// starts again from the cursor after a pause when one was not delivered.
+func (d *durableSink) deliver() {
+	defer close(d.done)
+	tick := time.NewTicker(queue_sync_interval)
+	defer tick.Stop()
+	go func() {
+		for {
+			select {
+			case <-d.stop:
+				return
+			case <-tick.C:
+				if err := d.q.sync(); err != nil {
+					fmt.Fprintln(d.report, "Queue: failed to sync", err.Error())
+				}
+			}
+		}
+	}()
+	b := newBackoff(time.Second, queue_retry_interval)
+	pos := d.cursor()
+	for {
+		if err := d.waitRoom(); err != nil {
+			if !d.pause(b.next(), err) {
+				return
+			}
+			pos = d.cursor()
+			continue
+		}
+		rec, err := d.q.next(pos, d.stop)
+		if err == errWALEnd {
+			return
+		}
+		if err != nil {
+			// a corrupt segment can't be read past, skip to the next one
+			fmt.Fprintf(d.report, "Queue: skipping the rest of a segment of %s: %s\n", d.name, err.Error())
+			next := walPos{Segment: pos.Segment + 1}
+			d.acked(d.track(walRecord{pos: pos, next: next}), nil)
+			pos = next
+			continue
+		}
+		pos = rec.next
+		qe := d.track(rec)
+		if err := d.send1(qe); err == nil {
+			b.reset()
+		}
+	}
+}
+
+func (d *durableSink) cursor() walPos {
+	d.q.mu.Lock()
+	defer d.q.mu.Unlock()
+	return d.q.cursor
+}
+
+// send1 delivers a queued event to the sink.
+func (d *durableSink) send1(qe *queuedEvent) error {
+	e, err := decodeEvent(qe.rec.data)
+	if err != nil {
+		// not an event, nothing to deliver
+		d.acked(qe, nil)
+		return nil
+	}
+	if as, ok := d.inner.(ackingSink); ok {
+		err := as.sendAck(e, qe.rec.data, func(err error) { d.acked(qe, err) })
+		if err != nil {
+			// the event can't be sent as it is, it won't be sent later either
+			fmt.Fprintf(d.report, "Queue: dropped an event for %s: %s\n", d.name, err.Error())
+			d.acked(qe, nil)
+		}
+		return err
+	}
+	err = d.inner.send(e, qe.rec.data)
+	d.acked(qe, err)
+	return err
+}
+
+func (d *durableSink) track(rec walRecord) *queuedEvent {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	qe := &queuedEvent{rec: rec}
+	d.inflight = append(d.inflight, qe)
+	return qe
+}
+
+func (d *durableSink) acked(qe *queuedEvent, err error) {
+	d.mu.Lock()
+	qe.settled = true
+	if err != nil {
+		if d.nacked == nil {
+			d.nacked = err
+		}
+	} else {
+		qe.acked = true
+	}
+	d.settled.Broadcast()
+	d.mu.Unlock()
+	d.advance()
+}
+
+// advance moves the cursor of the queue past the events acknowledged in
+// order.
+func (d *durableSink) advance() {
+	d.mu.Lock()
+	n, events := 0, 0
+	var pos walPos
+	for n < len(d.inflight) && d.inflight[n].acked {
+		pos = d.inflight[n].rec.next
+		if d.inflight[n].rec.data != nil {
+			events++
+		}
+		n++
+	}
+	d.inflight = d.inflight[n:]
+	d.settled.Broadcast()
+	d.mu.Unlock()
+	if n > 0 {
+		if err := d.q.ack(pos, events); err != nil {
+			fmt.Fprintln(d.report, "Queue: failed to acknowledge", err.Error())
+		}
+	}
+}
+
+// waitRoom waits while too many events are waiting for an acknowledgement,
+// and for the events in flight to settle once one was not delivered, which
+// it returns.
+func (d *durableSink) waitRoom() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for len(d.inflight) >= queue_max_inflight && d.nacked == nil && !d.closing() {
+		d.settled.Wait()
+	}
+	if d.nacked == nil {
+		return nil
+	}
+	// the sink acknowledges or fails every event it was given
+	for {
+		waiting := false
+		for _, qe := range d.inflight {
+			if !qe.settled {
+				waiting = true
+			}
+		}
+		if !waiting || d.closing() {
+			break
+		}
+		d.settled.Wait()
+	}
+	err := d.nacked
+	d.nacked = nil
+	d.inflight = nil
+	return err
+}
+
+func (d *durableSink) closing() bool {
+	select {
+	case <-d.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// pause waits before events are sent again, it returns false when the sink
+// is closed meanwhile.
+func (d *durableSink) pause(wait time.Duration, err error) bool {
+	fmt.Fprintf(d.report, "Queue: delivery to %s failed, %d event(s) queued, retrying in %s: %s\n",
+		d.name, d.q.depth(), wait, err.Error())
+	select {
+	case <-d.stop:
+		return false
+	case <-time.After(wait):
+		return true
+	}
+}
+
+// close gives the sink a little time to be handed what is queued, closes it
+// so it flushes and acknowledges its batches, and keeps the rest on disk for
+// the next run.
+func (d *durableSink) close() error {
+	deadline := time.Now().Add(queue_drain_timeout)
+	for time.Now().Before(deadline) {
+		d.mu.Lock()
+		handed := d.q.depth() <= len(d.inflight) || d.nacked != nil
+		d.mu.Unlock()
+		if handed {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	close(d.stop)
+	d.q.wake()
+	d.mu.Lock()
+	d.settled.Broadcast()
+	d.mu.Unlock()
+	<-d.done
+	err := d.inner.close()
+	if qerr := d.q.close(); err == nil {
+		err = qerr
+	}
+	if n := d.q.depth(); n > 0 {
+		fmt.Fprintf(d.report, "Queue: %d event(s) for %s kept in %s\n", n, d.name, d.q.dir)
+	}
+	if d.dropped > 0 {
+		fmt.Fprintf(d.report, "Queue: full, dropped %d event(s) for %s\n", d.dropped, d.name)
+	}
+	return err
+}
+
+type queueCommand struct {
+	output io.Writer
+	dir    string
+}
+
+func (c *queueCommand) Run(args []string) int {
+	if len(args) == 0 || args[0] != "inspect" {
+		fmt.Println(c.Help())
+		return -1
+	}
+	fs := flag.NewFlagSet("queue inspect", flag.ContinueOnError)
+	asJSON := fs.Bool("json", false, "print the state of every queue as JSON")
+	if err := fs.Parse(args[1:]); err != nil {
+		return -1
+	}
+	dir := c.dir
+	if fs.NArg() > 0 {
+		dir = fs.Arg(0)
+	}
+	dirs := []string{dir}
+	if _, err := os.Stat(filepath.Join(dir, sink_spec_file)); err != nil {
+		infos, err := ioutil.ReadDir(dir)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to read queues", err.Error())
+			return -1
+		}
+		dirs = nil
+		for _, fi := range infos {
+			if fi.IsDir() {
+				dirs = append(dirs, filepath.Join(dir, fi.Name()))
+			}
+		}
+	}
+	now := time.Now()
+	w := tabwriter.NewWriter(c.output, 0, 8, 2, ' ', 0)
+	if !*asJSON {
+		fmt.Fprintln(w, "SINK\tRECORDS\tBYTES\tSEGMENTS\tOLDEST")
+	}
+	for _, d := range dirs {
+		s, err := inspectWAL(d)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to read queue", d, err.Error())
+			return -1
+		}
+		if *asJSON {
+			json.NewEncoder(c.output).Encode(s)
+			continue
+		}
+		oldest := "-"
+		if s.Records > 0 {
+			oldest = (now.Sub(s.Oldest) / time.Second * time.Second).String()
+		}
+		sink := s.Sink
+		if len(sink) == 0 {
+			sink = d
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\t%d\t%s\n", sink, s.Records, formatSize(float64(s.Bytes)), s.Segments, oldest)
+	}
+	w.Flush()
+	return 0
+}
+
+func (c *queueCommand) Synopsis() string { return "Inspect the queues of sinks on disk" }
+
+func (c *queueCommand) Help() string {
+	return `
+Usage: 40fy-client queue inspect [-json] [DIR]
+
+ Shows the events waiting in the queues of the sinks of -sink-queue, by default those in ~/.binaryedge/queue:
+ the sink, the number of records and their size, the number of segment files and the age of the oldest record.
+	`
+}
+
+func QueueCommandFactory() (cli.Command, error) {
+	return &queueCommand{output: os.Stdout, dir: filepath.Join(configHome(), "queue")}, nil
+}
@@ -0,0 +1,495 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/mitchellh/cli"
+	"golang.org/x/net/websocket"
+)
+
+// relayLine is a line of the upstream stream with its sequence number.
+type relayLine struct {
+	id   uint64
+	line []byte
+}
+
+// relayClient is a local consumer of the relay. Lines matching its filter
+// are queued in lines, when the queue is full they are dropped or the
+// client is disconnected depending on the policy of the hub.
+type relayClient struct {
+	id        int
+	kind      string
+	addr      string
+	expr      string
+	filter    predicate
+	connected time.Time
+	lines     chan relayLine
+	closed    chan struct{}
+	sent      uint64
+	dropped   uint64
+}
+
+// relayHub fans the lines of the upstream connection out to the clients.
+// Lines are numbered from 1 and the last replay of them are kept for clients
+// resuming after a given line.
+type relayHub struct {
+	buffer int
+	policy string
+	replay int
+	// origins are the origins of the pages allowed to connect, requests
+	// from other pages are refused
+	origins []string
+	// tokens, when set, are the local tokens clients must give
+	tokens *sseTokens
+
+	mu       sync.Mutex
+	clients  map[*relayClient]bool
+	nextID   int
+	upstream string
+	received uint64
+	history  []relayLine
+	oldest   int
+}
+
+func newRelayHub(buffer int, policy string) (*relayHub, error) {
+	if buffer <= 0 {
+		return nil, fmt.Errorf("buffer must be positive")
+	}
+	if policy != "drop" && policy != "disconnect" {
+		return nil, fmt.Errorf("unknown slow client policy %q, use drop or disconnect", policy)
+	}
+	return &relayHub{
+		buffer:   buffer,
+		policy:   policy,
+		clients:  map[*relayClient]bool{},
+		upstream: "connecting",
+	}, nil
+}
+
+func (h *relayHub) subscribe(kind, addr, expr string) (*relayClient, error) {
+	c, _, err := h.resume(kind, addr, expr, 0)
+	return c, err
+}
+
+// resume subscribes a client that already received the lines up to after,
+// and returns the kept lines after it matching its filter. A client that
+// missed more lines than are kept gets all of them.
+func (h *relayHub) resume(kind, addr, expr string, after uint64) (*relayClient, []relayLine, error) {
+	c := &relayClient{
+		kind:      kind,
+		addr:      addr,
+		expr:      expr,
+		connected: time.Now().UTC(),
+		lines:     make(chan relayLine, h.buffer),
+		closed:    make(chan struct{}),
+	}
+	if len(expr) > 0 {
+		pred, err := compileFilter(expr)
+		if err != nil {
+			return nil, nil, err
+		}
+		c.filter = pred
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.nextID++
+	c.id = h.nextID
+	h.clients[c] = true
+	var backlog []relayLine
+	if after > 0 {
+		for i := range h.history {
+			l := h.history[(h.oldest+i)%len(h.history)]
+			if l.id > after && c.match(l.line) {
+				backlog = append(backlog, l)
+			}
+		}
+	}
+	return c, backlog, nil
+}
+
+func (c *relayClient) match(line []byte) bool {
+	if c.filter == nil {
+		return true
+	}
+	e, err := decodeEvent(line)
+	return err == nil && c.filter(e)
+}
+
+func (h *relayHub) unsubscribe(c *relayClient) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.clients[c] {
+		delete(h.clients, c)
+		close(c.closed)
+	}
+}
+
+func (h *relayHub) setUpstream(state string) {
+	h.mu.Lock()
+	h.upstream = state
+	h.mu.Unlock()
+}
+
+// Write hands a line of the upstream stream to every client whose filter it
+// matches. It never blocks on a client.
+func (h *relayHub) Write(line []byte) (int, error) {
+	l := relayLine{line: append([]byte(nil), line...)}
+	var (
+		e       event
+		decoded bool
+	)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.received++
+	l.id = h.received
+	if h.replay > 0 {
+		if len(h.history) < h.replay {
+			h.history = append(h.history, l)
+		} else {
+			h.history[h.oldest] = l
+			h.oldest = (h.oldest + 1) % h.replay
+		}
+	}
+	for c := range h.clients {
+		if c.filter != nil {
+			if !decoded {
+				e, _ = decodeEvent(l.line)
+				decoded = true
+			}
+			if e == nil || !c.filter(e) {
+				continue
+			}
+		}
+		select {
+		case c.lines <- l:
+			c.sent++
+		default:
+			c.dropped++
+			if h.policy == "disconnect" {
+				delete(h.clients, c)
+				close(c.closed)
+			}
+		}
+	}
+	return len(line), nil
+}
+
+type relayClientStatus struct {
+	ID        int       `json:"id"`
+	Kind      string    `json:"kind"`
+	Addr      string    `json:"addr"`
+	Filter    string    `json:"filter,omitempty"`
+	Connected time.Time `json:"connected"`
+	Sent      uint64    `json:"sent"`
+	Dropped   uint64    `json:"dropped"`
+	Queued    int       `json:"queued"`
+}
+
+type relayStatus struct {
+	Upstream string              `json:"upstream"`
+	Received uint64              `json:"received"`
+	Clients  []relayClientStatus `json:"clients"`
+}
+
+func (h *relayHub) status() relayStatus {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := relayStatus{Upstream: h.upstream, Received: h.received, Clients: []relayClientStatus{}}
+	for c := range h.clients {
+		s.Clients = append(s.Clients, relayClientStatus{
+			ID:        c.id,
+			Kind:      c.kind,
+			Addr:      c.addr,
+			Filter:    c.expr,
+			Connected: c.connected,
+			Sent:      c.sent,
+			Dropped:   c.dropped,
+			Queued:    len(c.lines),
+		})
+	}
+	return s
+}
+
+// handler serves the relay: /stream as chunked NDJSON, /ws as one WebSocket
+// text message per event and /status as JSON. Clients pick their events
+// with the filter query parameter.
+func (h *relayHub) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stream", h.serveStream)
+	// origins are checked by authorize, for every endpoint
+	mux.Handle("/ws", websocket.Server{
+		Handler:   h.serveWebSocket,
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+	})
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(h.status())
+	})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if code, msg := h.authorize(r); code != 0 {
+			http.Error(w, msg, code)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// authorize returns the status and message refusing a request, 0 when it
+// is accepted. Browsers send the origin of the page making the request,
+// pages of other sites could otherwise read the events through the
+// relay. Clients other than browsers send no Origin.
+func (h *relayHub) authorize(r *http.Request) (int, string) {
+	if origin := r.Header.Get("Origin"); len(origin) > 0 {
+		allowed := false
+		for _, o := range h.origins {
+			allowed = allowed || o == origin
+		}
+		if !allowed {
+			return http.StatusForbidden, "origin not allowed"
+		}
+	}
+	if h.tokens != nil {
+		if _, ok := h.tokens.user(requestToken(r)); !ok {
+			return http.StatusUnauthorized, "invalid or missing access token"
+		}
+	}
+	return 0, ""
+}
+
+// isLoopback reports whether the address listen only accepts connections
+// from the local host.
+func isLoopback(listen string) bool {
+	host, _, err := net.SplitHostPort(listen)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func (h *relayHub) serveStream(w http.ResponseWriter, r *http.Request) {
+	c, err := h.subscribe("http", r.RemoteAddr, r.URL.Query().Get("filter"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer h.unsubscribe(c)
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	if flusher != nil {
+		flusher.Flush()
+	}
+	var gone <-chan bool
+	if cn, ok := w.(http.CloseNotifier); ok {
+		gone = cn.CloseNotify()
+	}
+	for {
+		select {
+		case l := <-c.lines:
+			if _, err := w.Write(l.line); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		case <-c.closed:
+			return
+		case <-gone:
+			return
+		}
+	}
+}
+
+func (h *relayHub) serveWebSocket(ws *websocket.Conn) {
+	defer ws.Close()
+	c, err := h.subscribe("websocket", ws.Request().RemoteAddr, ws.Request().URL.Query().Get("filter"))
+	if err != nil {
+		websocket.Message.Send(ws, `{"error":`+fmt.Sprintf("%q", err.Error())+`}`)
+		return
+	}
+	defer h.unsubscribe(c)
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		var msg string
+		for websocket.Message.Receive(ws, &msg) == nil {
+		}
+	}()
+	for {
+		select {
+		case l := <-c.lines:
+			if err := websocket.Message.Send(ws, string(bytes.TrimRight(l.line, "\r\n"))); err != nil {
+				return
+			}
+		case <-c.closed:
+			return
+		case <-gone:
+			return
+		}
+	}
+}
+
+type RelayCommand struct {
+	client  http.Client
+	config  map[string]interface{}
+	tokens  string
+	verbose bool
+}
+
+func (r *RelayCommand) Run(args []string) int {
+	fs := flag.NewFlagSet("relay", flag.ContinueOnError)
+	token := fs.String("token", "", "token for authenticating with api")
+	firehose := fs.Bool("firehose", false, "relay the firehose instead of the user's stream")
+	jobID := fs.String("job-id", "", "only relay events of this job, \"last\" or a label from the job history")
+	filter := fs.String("filter", "", "only relay events matching this expression")
+	listen := fs.String("listen", "127.0.0.1:8040", "address the relay listens on")
+	buffer := fs.Int("buffer", 1000, "events queued for every client")
+	policy := fs.String("slow", "drop", "what happens to clients whose queue is full: drop or disconnect")
+	allowOrigin := fs.String("allow-origin", "", "comma separated origins of the pages allowed to connect")
+	verbose := fs.Bool("verbose", false, "show upstream requests and responses")
+	if err := fs.Parse(args); err != nil {
+		return -1
+	}
+	r.verbose = *verbose
+	if len(*token) == 0 {
+		if tok, ok := r.config["token"].(string); ok && len(tok) > 0 {
+			*token = tok
+		} else {
+			fmt.Println(r.Help())
+			return -1
+		}
+	}
+	id, err := resolveJobID(historyPath(), *jobID)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to resolve job", err.Error())
+		return -1
+	}
+	hub, err := newRelayHub(*buffer, *policy)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return -1
+	}
+	hub.origins = splitList(*allowOrigin)
+	if !isLoopback(*listen) {
+		tokens, err := openSSETokens(r.tokens)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to read local tokens", err.Error())
+			return -1
+		}
+		if len(tokens.Users) == 0 {
+			fmt.Fprintf(os.Stderr, "Listening on %s needs local tokens, create one with 40fy-client serve-sse -add-user=NAME\n", *listen)
+			return -1
+		}
+		hub.tokens = tokens
+	}
+	p := &pipeline{output: hub}
+	if err := p.filterBy(id, *filter); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return -1
+	}
+	url := r.config["stream_url"].(string)
+	if *firehose {
+		url = r.config["firehose_url"].(string)
+	}
+	go r.upstream(url, *token, hub, p)
+	fmt.Fprintf(os.Stderr, "Relaying on http://%s/stream and ws://%s/ws\n", *listen, *listen)
+	if err := http.ListenAndServe(*listen, hub.handler()); err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to listen", err.Error())
+		return -1
+	}
+	return 0
+}
+
+// upstream keeps a single connection to url open, reconnecting with backoff
+// when it drops, and feeds it to the hub through p.
+func (r *RelayCommand) upstream(url, token string, hub *relayHub, p *pipeline) {
+	b := newBackoff(time.Second, time.Minute)
+	for {
+		err := r.connect(url, token, hub, p, b)
+		if err == errInvalidCredentials {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+		wait := b.next()
+		msg := "upstream closed"
+		if err != nil {
+			msg = err.Error()
+		}
+		hub.setUpstream("reconnecting: " + msg)
+		fmt.Fprintf(os.Stderr, "Upstream disconnected (%s), reconnecting in %s\n", msg, wait)
+		time.Sleep(wait)
+	}
+}
+
+func (r *RelayCommand) connect(url, token string, hub *relayHub, p *pipeline, b *backoff) error {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Add("X-Token", token)
+	r.print("Request: %v\n", req)
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	r.print("Response: %v\n", resp)
+	if resp.StatusCode == 401 {
+		return errInvalidCredentials
+	}
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	b.reset()
+	hub.setUpstream("connected")
+	return readFromResponse(resp.Body, p)
+}
+
+func (r *RelayCommand) print(pattern string, v interface{}) {
+	if r.verbose {
+		fmt.Fprintf(os.Stderr, pattern, v)
+	}
+}
+
+func (r *RelayCommand) Synopsis() string {
+	return "Share one stream or firehose connection with many local clients"
+}
+
+func (r *RelayCommand) Help() string {
+	return `
+Usage: 40fy-client relay -token=TOKEN [-firehose] [-job-id=JOBID] [-filter=FILTER] [-listen=127.0.0.1:8040] [-buffer=1000] [-slow=drop|disconnect] [-allow-origin=ORIGIN]
+
+ Holds a single connection to the stream, or the firehose with -firehose, reconnecting when it drops,
+ and serves it to local clients:
+   http://LISTEN/stream   the events as chunked NDJSON, as stream prints them
+   ws://LISTEN/ws         one WebSocket text message per event
+   http://LISTEN/status   upstream state and per client sent, dropped and queued counts as JSON
+ Clients choose their own events with a filter query parameter, for example
+   curl 'http://127.0.0.1:8040/stream?filter=port%3D%3D22'
+ The "JOB-ID" and "FILTER" parameters restrict what is relayed to all clients, as for stream.
+ Every client has a queue of BUFFER events. When a slow client's queue is full further events are
+ dropped for it (drop, the default) or it is disconnected (disconnect), other clients are not held up.
+
+ Requests from web pages, carrying an Origin header, are refused unless the origin is one of the
+ comma separated "ORIGIN" parameter. When "LISTEN" is not a loopback address clients must give a
+ local token of serve-sse -add-user, as access_token or in an Authorization: Bearer header.
+	`
+}
+
+func RelayCommandFactory() (cli.Command, error) {
+	r := &RelayCommand{client: http.Client{}, tokens: sseTokensPath()}
+	r.config = loadConfig()
+	return r, nil
+}
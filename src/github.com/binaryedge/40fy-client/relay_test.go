@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+func waitForClients(t *testing.T, h *relayHub, n int) {
+	for i := 0; i < 100; i++ {
+		if len(h.status().Clients) == n {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("clients did not connect")
+}
+
+func TestRelay(t *testing.T) {
+	hub, err := newRelayHub(10, "drop")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	hub.origins = []string{"http://localhost/"}
+	server := httptest.NewServer(hub.handler())
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/stream?filter=" + url.QueryEscape("port == 22"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer resp.Body.Close()
+	ws, err := websocket.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws", "", "http://localhost/")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer ws.Close()
+	waitForClients(t, hub, 2)
+
+	ssh := `{"target":{"ip":"10.0.0.1","port":22}}` + "\n"
+	web := `{"target":{"ip":"10.0.0.1","port":80}}` + "\n"
+	hub.Write([]byte(web))
+	hub.Write([]byte(ssh))
+
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	if err != nil || line != ssh {
+		t.Fatal("http client got", line, err)
+	}
+	for _, want := range []string{web, ssh} {
+		var msg string
+		if err := websocket.Message.Receive(ws, &msg); err != nil || msg+"\n" != want {
+			t.Fatal("websocket client got", msg, err)
+		}
+	}
+}
+
+func TestRelaySlowClients(t *testing.T) {
+	for _, policy := range []string{"drop", "disconnect"} {
+		hub, _ := newRelayHub(2, policy)
+		slow, _ := hub.subscribe("http", "slow", "")
+		fast, _ := hub.subscribe("http", "fast", "")
+		for i := 0; i < 5; i++ {
+			hub.Write([]byte("{}\n"))
+			<-fast.lines
+		}
+		s := hub.status()
+		if policy == "drop" {
+			if len(s.Clients) != 2 || slow.dropped != 3 || len(slow.lines) != 2 || fast.sent != 5 {
+				t.Error("drop", slow.dropped, fast.sent)
+			}
+			continue
+		}
+		if len(s.Clients) != 1 || s.Clients[0].Addr != "fast" || fast.sent != 5 {
+			byts, _ := json.Marshal(s)
+			t.Error("disconnect", string(byts))
+		}
+		select {
+		case <-slow.closed:
+		default:
+			t.Error("slow client not closed")
+		}
+	}
+}
+
+func TestRelayAuthorize(t *testing.T) {
+	hub, _ := newRelayHub(10, "drop")
+	hub.origins = []string{"http://localhost:3000"}
+	server := httptest.NewServer(hub.handler())
+	defer server.Close()
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws"
+
+	if _, err := websocket.Dial(wsURL, "", "http://evil.example/"); err == nil {
+		t.Fatal("websocket connection from another site accepted")
+	}
+	ws, err := websocket.Dial(wsURL, "", "http://localhost:3000")
+	if err != nil {
+		t.Fatal("websocket connection from an allowed origin refused", err)
+	}
+	ws.Close()
+
+	get := func(path, origin string) int {
+		req, _ := http.NewRequest("GET", server.URL+path, nil)
+		if len(origin) > 0 {
+			req.Header.Set("Origin", origin)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := get("/status", "http://evil.example"); code != http.StatusForbidden {
+		t.Fatal("status served to another site", code)
+	}
+	if code := get("/status", ""); code != http.StatusOK {
+		t.Fatal("status refused without an origin", code)
+	}
+
+	hub.tokens = &sseTokens{Users: map[string]string{}}
+	tok, _ := hub.tokens.add("alice")
+	if code := get("/status", ""); code != http.StatusUnauthorized {
+		t.Fatal("status served without a token", code)
+	}
+	if code := get("/status?access_token="+tok, ""); code != http.StatusOK {
+		t.Fatal("status refused with a token", code)
+	}
+	if _, err := websocket.Dial(wsURL, "", "http://localhost:3000"); err == nil {
+		t.Fatal("websocket connection accepted without a token")
+	}
+	ws, err = websocket.Dial(wsURL+"?access_token="+tok, "", "http://localhost:3000")
+	if err != nil {
+		t.Fatal("websocket connection refused with a token", err)
+	}
+	ws.Close()
+
+	for listen, want := range map[string]bool{
+		"127.0.0.1:8040": true,
+		"[::1]:8040":     true,
+		"localhost:8040": true,
+		":8040":          false,
+		"0.0.0.0:8040":   false,
+		"10.0.0.1:8040":  false,
+	} {
+		if isLoopback(listen) != want {
+			t.Error("unexpected loopback", listen)
+		}
+	}
+}
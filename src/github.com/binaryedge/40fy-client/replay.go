@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mitchellh/cli"
+)
+
+// recordEntry is a line of a recording: a line of the stream as received,
+// base64 encoded so any bytes are replayed as they were, with the time it
+// was received. Older recordings hold the line as a string in Line.
+type recordEntry struct {
+	TS   time.Time `json:"ts"`
+	Data []byte    `json:"data"`
+	Line string    `json:"line,omitempty"`
+}
+
+// line returns the line of the stream as received.
+func (e *recordEntry) line() []byte {
+	if e.Data == nil {
+		return []byte(e.Line)
+	}
+	return e.Data
+}
+
+// recorder writes every line handed to it to a recording.
+type recorder struct {
+	mu  sync.Mutex
+	w   io.WriteCloser
+	now func() time.Time
+}
+
+// newRecorder records to path, gzipped when it ends in .gz. The recording
+// is written under path.part and renamed when closed.
+func newRecorder(path string) (*recorder, error) {
+	f, err := newRotatingFile(rotateOptions{pattern: path, literal: true})
+	if err != nil {
+		return nil, err
+	}
+	return &recorder{w: f, now: time.Now}, nil
+}
+
+func (r *recorder) record(line []byte) error {
+	byts, err := json.Marshal(recordEntry{TS: r.now().UTC(), Data: line})
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, err = r.w.Write(append(byts, '\n'))
+	return err
+}
+
+func (r *recorder) Close() error {
+	return r.w.Close()
+}
+
+// readRecording calls fn with every entry of the recording at path, which
+// may be gzipped, until fn fails or stop is closed.
+func readRecording(path string, stop <-chan struct{}, fn func(recordEntry) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	buf := bufio.NewReader(f)
+	var r io.Reader = buf
+	if magic, _ := buf.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(buf)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	}
+	lines := bufio.NewReader(r)
+	for n := 1; ; n++ {
+		select {
+		case <-stop:
+			return nil
+		default:
+		}
+		byts, err := lines.ReadBytes('\n')
+		if len(byts) > 0 {
+			var e recordEntry
+			if jerr := json.Unmarshal(byts, &e); jerr != nil {
+				return fmt.Errorf("%s:%d: invalid recording entry: %s", path, n, jerr.Error())
+			}
+			if ferr := fn(e); ferr != nil {
+				return ferr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// parseSpeed parses a replay speed, a factor of the original pace or max
+// for as fast as possible, returned as 0.
+func parseSpeed(s string) (float64, error) {
+	if s == "max" {
+		return 0, nil
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || v <= 0 {
+		return 0, fmt.Errorf("invalid speed %q, use a positive factor or max", s)
+	}
+	return v, nil
+}
+
+// play replays the recording at path to fn at speed times the pace it was
+// recorded at, or as fast as possible when speed is 0.
+func play(path string, speed float64, stop <-chan struct{}, fn func(line []byte) error) error {
+	var first, start time.Time
+	return readRecording(path, stop, func(e recordEntry) error {
+		if speed > 0 {
+			if first.IsZero() {
+				first, start = e.TS, time.Now()
+			}
+			due := start.Add(time.Duration(float64(e.TS.Sub(first)) / speed))
+			if wait := due.Sub(time.Now()); wait > 0 {
+				select {
+				case <-time.After(wait):
+				case <-stop:
+					return nil
+				}
+			}
+		}
+		return fn(e.line())
+	})
+}
+
+type ReplayCommand struct {
+	output io.Writer
+}
+
+func (r *ReplayCommand) Run(args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	speed := fs.String("speed", "1", "pace of the replay: a factor of the original pace, or max")
+	serve := fs.String("serve", "", "serve the recording over HTTP on this address like the stream instead")
+	flags := addStreamFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return -1
+	}
+	if fs.NArg() != 1 {
+		fmt.Println(r.Help())
+		return -1
+	}
+	path := fs.Arg(0)
+	sp, err := parseSpeed(*speed)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return -1
+	}
+	if _, err := os.Stat(path); err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to open recording", err.Error())
+		return -1
+	}
+	if len(*serve) > 0 {
+		fmt.Fprintf(os.Stderr, "Replaying %s on http://%s/\n", path, *serve)
+		if err := http.ListenAndServe(*serve, replayHandler(path, sp)); err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to listen", err.Error())
+			return -1
+		}
+		return 0
+	}
+	p, err := flags.build(r.output, "")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return -1
+	}
+	defer p.close()
+	p.closeOnInterrupt()
+	if err := play(path, sp, nil, p.handle); err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to replay", err.Error())
+		return -1
+	}
+	if err := p.close(); err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to close output", err.Error())
+		return -1
+	}
+	return 0
+}
+
+// replayHandler plays the recording from the start to every request, as
+// chunked NDJSON like the stream, whatever the path and token.
+func replayHandler(path string, speed float64) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		flusher, _ := w.(http.Flusher)
+		stop := make(chan struct{})
+		if cn, ok := w.(http.CloseNotifier); ok {
+			gone := cn.CloseNotify()
+			done := make(chan struct{})
+			defer close(done)
+			go func() {
+				select {
+				case <-gone:
+					close(stop)
+				case <-done:
+				}
+			}()
+		}
+		play(path, speed, stop, func(line []byte) error {
+			if _, err := w.Write(line); err != nil {
+				return err
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+			return nil
+		})
+	})
+}
+
+func (r *ReplayCommand) Synopsis() string { return "Replay a recorded stream session" }
+
+func (r *ReplayCommand) Help() string {
+	return `
+Usage: 40fy-client replay [-speed=1|N|max] [-serve=ADDRESS] [OUTPUT OPTIONS] RECORDING
+
+ Plays a session recorded with stream -record, or firehose -record, as if it was received again.
+ The "speed" parameter plays it at the original pace (1, the default), N times faster, or as fast as possible (max).
+ The events go through the output options like those of stream, so they can be filtered, formatted,
+ written to files or sent to sinks.
+ With -serve=ADDRESS the recording is instead played from the start to every HTTP request to ADDRESS,
+ as chunked NDJSON like the stream. Point stream_url in the config at it, for example
+ stream_url = "http://127.0.0.1:8042/v1/stream", to run the client and its consumers offline.
+` + streamFlagsHelp
+}
+
+func ReplayCommandFactory() (cli.Command, error) {
+	return &ReplayCommand{output: os.Stdout}, nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRecordAndReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "replay")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "session.ndjson.gz")
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags := addStreamFlags(fs)
+	fs.Parse([]string{"-record=" + path, "-filter=port == 22"})
+	var out bytes.Buffer
+	p, err := flags.build(&out, "")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	start := time.Unix(1000, 0)
+	lines := []string{
+		`{"target":{"ip":"10.0.0.1","port":22}}` + "\n",
+		`{"target":{"ip":"10.0.0.2","port":80}}` + "\n",
+		`{"target":{"ip":"10.0.0.3","port":22}}` + "\n",
+		"{\"target\":{\"ip\":\"10.0.0.4\",\"banner\":\"\xff\xfe\"}}\n",
+	}
+	for i, l := range lines {
+		now := start.Add(time.Duration(i) * 100 * time.Millisecond)
+		p.recorder.now = func() time.Time { return now }
+		p.handle([]byte(l))
+	}
+	if err := p.close(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if out.String() != lines[0]+lines[2] {
+		t.Fatal("filtered output", out.String())
+	}
+
+	var replayed bytes.Buffer
+	begin := time.Now()
+	if err := play(path, 2, nil, func(line []byte) error {
+		replayed.Write(line)
+		return nil
+	}); err != nil {
+		t.Fatal(err.Error())
+	}
+	if took := time.Since(begin); took < 140*time.Millisecond || took > time.Second {
+		t.Error("300ms recorded at double speed took", took)
+	}
+	if replayed.String() != lines[0]+lines[1]+lines[2]+lines[3] {
+		t.Fatal("replayed", replayed.String())
+	}
+
+	server := httptest.NewServer(replayHandler(path, 0))
+	defer server.Close()
+	resp, err := http.Get(server.URL + "/v1/stream")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer resp.Body.Close()
+	byts, _ := ioutil.ReadAll(resp.Body)
+	if string(byts) != replayed.String() {
+		t.Fatal("served", string(byts))
+	}
+
+	// recordings holding lines as strings
+	old := filepath.Join(dir, "old.ndjson")
+	ioutil.WriteFile(old, []byte(`{"ts":"2017-07-14T02:40:00Z","line":"{}\n"}`+"\n"), 0600)
+	replayed.Reset()
+	play(old, 0, nil, func(line []byte) error {
+		replayed.Write(line)
+		return nil
+	})
+	if replayed.String() != "{}\n" {
+		t.Fatal("replayed", replayed.String())
+	}
+}
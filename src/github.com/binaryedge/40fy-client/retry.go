@@ -0,0 +1,42 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	mrand "math/rand"
+	"time"
+)
+
+// backoff produces exponentially growing waits with jitter, capped at max.
+type backoff struct {
+	base    time.Duration
+	max     time.Duration
+	attempt uint
+}
+
+func newBackoff(base, max time.Duration) *backoff {
+	return &backoff{base: base, max: max}
+}
+
+func (b *backoff) next() time.Duration {
+	d := b.base << b.attempt
+	if d > b.max || d <= 0 {
+		d = b.max
+	} else {
+		b.attempt++
+	}
+	// wait between half and the full delay so clients don't retry in lockstep
+	return d/2 + time.Duration(mrand.Int63n(int64(d/2)+1))
+}
+
+func (b *backoff) reset() {
+	b.attempt = 0
+}
+
+func newIdempotencyKey() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return time.Now().UTC().Format("20060102150405.000000000")
+	}
+	return hex.EncodeToString(b)
+}
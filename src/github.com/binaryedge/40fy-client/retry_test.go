@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// failingTransport fails the first fail requests as if the connection
+// dropped.
+type failingTransport struct {
+	fail int
+}
+
+func (f *failingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if f.fail > 0 {
+		f.fail--
+		return nil, errors.New("connection reset by peer")
+	}
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// jobServer serves the jobs endpoint, answering the first posts with
+// failure statuses and recording the idempotency keys of the posts.
+type jobServer struct {
+	failures []int
+	listed   string
+	keys     []string
+}
+
+func (s *jobServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" {
+		w.Write([]byte(s.listed))
+		return
+	}
+	s.keys = append(s.keys, r.Header.Get("Idempotency-Key"))
+	if len(s.failures) > 0 {
+		w.WriteHeader(s.failures[0])
+		s.failures = s.failures[1:]
+		return
+	}
+	w.Write([]byte(`{"job_id":"j1","stream_url":"http://stream"}`))
+}
+
+func TestCreateJobRetries(t *testing.T) {
+	dir, err := ioutil.TempDir("", "retry")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	js := &jobServer{listed: `[]`}
+	server := httptest.NewServer(js)
+	defer server.Close()
+
+	run := func(transport http.RoundTripper, args ...string) int {
+		c := &createJobCommand{
+			client:     http.Client{Transport: transport},
+			config:     testConfig(server.URL, token),
+			output:     &bytes.Buffer{},
+			history:    filepath.Join(dir, history_file_name),
+			retryDelay: time.Millisecond,
+		}
+		return c.Run(append([]string{"-targets=8.8.8.8", "-port=80", "-modules=http"}, args...))
+	}
+
+	// server errors
+	js.failures = []int{http.StatusInternalServerError, http.StatusBadGateway}
+	if status := run(nil, "-idempotency-key=k1"); status != 0 {
+		t.Fatal("Status not 0", status)
+	}
+	if len(js.keys) != 3 || js.keys[0] != "k1" || js.keys[2] != "k1" {
+		t.Fatal("unexpected submissions", js.keys)
+	}
+	h, _ := openHistory(filepath.Join(dir, history_file_name))
+	if r := h.byKey("k1"); r == nil || r.ID != "j1" || r.Outcome != "created" {
+		t.Fatal("unexpected history", r)
+	}
+
+	// the same submission again is not posted
+	js.keys = nil
+	if status := run(nil, "-idempotency-key=k1"); status != 0 || len(js.keys) != 0 {
+		t.Fatal("job submitted again", status, js.keys)
+	}
+	// the same key for another job
+	if status := run(nil, "-idempotency-key=k1", "-port=443"); status == 0 || len(js.keys) != 0 {
+		t.Fatal("key reused for another job", status, js.keys)
+	}
+
+	// connection errors
+	if status := run(&failingTransport{fail: 2}, "-idempotency-key=k2"); status != 0 || len(js.keys) != 1 {
+		t.Fatal("not retried on connection errors", status, js.keys)
+	}
+	js.keys = nil
+	if status := run(&failingTransport{fail: 10}, "-idempotency-key=k3", "-retries=2"); status == 0 {
+		t.Fatal("retried more than asked")
+	}
+
+	// giving up leaves a record without a job, runs with the key ask
+	// the platform before posting again
+	js.listed = `{"tasks":[{"job_id":"j3","idempotency_key":"k3","stream_url":"http://stream"}]}`
+	if status := run(nil, "-idempotency-key=k3", "-retries=2"); status != 0 || len(js.keys) != 0 {
+		t.Fatal("job submitted by an earlier run posted again", status, js.keys)
+	}
+	h, _ = openHistory(filepath.Join(dir, history_file_name))
+	if r := h.byKey("k3"); r == nil || r.ID != "j3" {
+		t.Fatal("submitted job not found", r)
+	}
+
+	// a post that reached the server before failing
+	js.failures = []int{http.StatusServiceUnavailable}
+	js.listed = `{"tasks":[{"job_id":"j4","idempotency_key":"k4"}]}`
+	if status := run(nil, "-idempotency-key=k4"); status != 0 || len(js.keys) != 1 {
+		t.Fatal("job posted again after it was submitted", status, js.keys)
+	}
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const partial_suffix = ".part"
+
+var errClosed = errors.New("output file is closed")
+
+// strftime formats t with the common strftime conversions
+// %Y %y %m %d %H %M %S %j %s and %%.
+func strftime(pattern string, t time.Time) string {
+	var b []byte
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		if c != '%' || i+1 == len(pattern) {
+			b = append(b, c)
+			continue
+		}
+		i++
+		switch pattern[i] {
+		case 'Y':
+			b = append(b, t.Format("2006")...)
+		case 'y':
+			b = append(b, t.Format("06")...)
+		case 'm':
+			b = append(b, t.Format("01")...)
+		case 'd':
+			b = append(b, t.Format("02")...)
+		case 'H':
+			b = append(b, t.Format("15")...)
+		case 'M':
+			b = append(b, t.Format("04")...)
+		case 'S':
+			b = append(b, t.Format("05")...)
+		case 'j':
+			b = append(b, fmt.Sprintf("%03d", t.YearDay())...)
+		case 's':
+			b = strconv.AppendInt(b, t.Unix(), 10)
+		case '%':
+			b = append(b, '%')
+		default:
+			b = append(b, '%', pattern[i])
+		}
+	}
+	return string(b)
+}
+
+// strftimeGlob turns a strftime pattern into a glob matching the files it
+// produces.
+func strftimeGlob(pattern string) string {
+	var b []byte
+	for i := 0; i < len(pattern); i++ {
+		if pattern[i] == '%' && i+1 < len(pattern) {
+			i++
+			if pattern[i] == '%' {
+				b = append(b, '%')
+			} else if len(b) == 0 || b[len(b)-1] != '*' {
+				b = append(b, '*')
+			}
+			continue
+		}
+		b = append(b, pattern[i])
+	}
+	return string(b)
+}
+
+// producedBy returns a regexp matching the paths of the files written for
+// pattern, with or without the counter of a rotation. Unlike the glob, every
+// verb only matches the digits it expands to, so other files in the same
+// directory are left alone.
+func producedBy(pattern string, literal bool) *regexp.Regexp {
+	var exprs []string
+	for _, p := range []string{pattern, withCounter(pattern, "\x00")} {
+		var expr string
+		for i := 0; i < len(p); i++ {
+			switch {
+			case p[i] == 0:
+				expr += `\d+`
+			case p[i] == '%' && !literal && i+1 < len(p):
+				i++
+				switch p[i] {
+				case 'Y':
+					expr += `\d{4}`
+				case 'y', 'm', 'd', 'H', 'M', 'S':
+					expr += `\d{2}`
+				case 'j':
+					expr += `\d{3}`
+				case 's':
+					expr += `\d+`
+				case '%':
+					expr += "%"
+				default:
+					expr += regexp.QuoteMeta(p[i-1 : i+1])
+				}
+			default:
+				expr += regexp.QuoteMeta(p[i : i+1])
+			}
+		}
+		exprs = append(exprs, expr)
+	}
+	return regexp.MustCompile("^(" + strings.Join(exprs, "|") + ")$")
+}
+
+// withCounter inserts a counter before the extensions of the file name, so
+// firehose.ndjson.gz becomes firehose-2.ndjson.gz.
+func withCounter(path, n string) string {
+	dir, base := filepath.Split(path)
+	if i := strings.Index(base, "."); i > 0 {
+		return dir + base[:i] + "-" + n + base[i:]
+	}
+	return dir + base + "-" + n
+}
+
+// parseSize parses a byte count with an optional K, M or G suffix.
+func parseSize(s string) (int64, error) {
+	if len(s) == 0 {
+		return 0, nil
+	}
+	mult := int64(1)
+	u := strings.ToUpper(strings.TrimSuffix(strings.TrimSuffix(s, "B"), "b"))
+	switch {
+	case strings.HasSuffix(u, "K"):
+		mult, u = 1<<10, u[:len(u)-1]
+	case strings.HasSuffix(u, "M"):
+		mult, u = 1<<20, u[:len(u)-1]
+	case strings.HasSuffix(u, "G"):
+		mult, u = 1<<30, u[:len(u)-1]
+	}
+	n, err := strconv.ParseInt(u, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * mult, nil
+}
+
+type rotateOptions struct {
+	pattern string
+	// literal takes pattern as the name of the file, without strftime
+	// conversions
+	literal  bool
+	maxSize  int64
+	every    time.Duration
+	compress bool
+	keep     int
+	maxAge   time.Duration
+}
+
+// rotatingFile writes to a series of files named after a strftime pattern.
+// A new file is started when the current one reaches maxSize, when every has
+// passed or when the pattern yields a new name. Files are written under a
+// temporary name and only renamed to their final name once complete and
+// synced, so readers never see a partial file. A temporary file left behind
+// by a crash is finished as it is before a new one is started. Files whose
+// name ends in .gz, or all files with compress, are gzipped. Once a file
+// can't be finished or started nothing more is written.
+type rotatingFile struct {
+	opts rotateOptions
+
+	mu      sync.Mutex
+	file    *os.File
+	gz      *gzip.Writer
+	w       io.Writer
+	name    string
+	started time.Time
+	size    int64
+	checked int64
+	closed  bool
+	err     error
+	stop    chan struct{}
+	now     func() time.Time
+}
+
+func newRotatingFile(opts rotateOptions) (*rotatingFile, error) {
+	if len(opts.pattern) == 0 {
+		return nil, fmt.Errorf("no output file given")
+	}
+	r := &rotatingFile{opts: opts, stop: make(chan struct{}), now: time.Now}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	go r.tick()
+	return r, nil
+}
+
+// tick rotates idle files on time so they are not held back until the next
+// event arrives.
+func (r *rotatingFile) tick() {
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-t.C:
+			r.mu.Lock()
+			if !r.closed && r.err == nil && r.size > 0 && r.due(0) {
+				if err := r.rotate(); err != nil {
+					fmt.Fprintf(os.Stderr, "Failed to rotate %s, no longer writing to it: %s\n", r.name, err.Error())
+				}
+			}
+			r.mu.Unlock()
+		}
+	}
+}
+
+// expand returns the name of the file at t.
+func (r *rotatingFile) expand(t time.Time) string {
+	if r.opts.literal {
+		return r.opts.pattern
+	}
+	return strftime(r.opts.pattern, t)
+}
+
+func (r *rotatingFile) open() error {
+	now := r.now()
+	r.name = r.expand(now)
+	if dir := filepath.Dir(r.name); len(dir) > 0 {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	// a crash left the file unfinished, keep what it holds
+	if _, err := os.Stat(r.name + partial_suffix); err == nil {
+		if err := finishName(r.name); err != nil {
+			return err
+		}
+	}
+	f, err := os.OpenFile(r.name+partial_suffix, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	r.file, r.w, r.gz = f, f, nil
+	if r.opts.compress || strings.HasSuffix(r.name, ".gz") {
+		r.gz = gzip.NewWriter(f)
+		r.w = r.gz
+	}
+	r.started, r.size = now, 0
+	return nil
+}
+
+// due reports whether the current file should be finished before writing n
+// more bytes.
+func (r *rotatingFile) due(n int) bool {
+	if r.opts.maxSize > 0 && r.size > 0 && r.size+int64(n) > r.opts.maxSize {
+		return true
+	}
+	now := r.now()
+	if r.opts.every > 0 && now.Sub(r.started) >= r.opts.every {
+		return true
+	}
+	// the name can change at most once a second
+	if sec := now.Unix(); !r.opts.literal && sec != r.checked {
+		r.checked = sec
+		return strftime(r.opts.pattern, now) != r.name
+	}
+	return false
+}
+
+// finish completes the current file: flush, sync, close and rename to its
+// final name. An existing file of the same name gets a counter added.
+func (r *rotatingFile) finish() error {
+	if r.gz != nil {
+		if err := r.gz.Close(); err != nil {
+			return err
+		}
+	}
+	if err := r.file.Sync(); err != nil {
+		return err
+	}
+	if err := r.file.Close(); err != nil {
+		return err
+	}
+	return finishName(r.name)
+}
+
+// finishName renames the temporary file of name to name, or to name with a
+// counter when a file of that name exists.
+func finishName(name string) error {
+	final := name
+	for n := 1; ; n++ {
+		if _, err := os.Stat(final); os.IsNotExist(err) {
+			break
+		}
+		final = withCounter(name, strconv.Itoa(n))
+	}
+	if err := os.Rename(name+partial_suffix, final); err != nil {
+		return err
+	}
+	syncDir(filepath.Dir(final))
+	return nil
+}
+
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
+
+// rotate finishes the current file and starts the next one. A failure is
+// kept and returned by every later write.
+func (r *rotatingFile) rotate() error {
+	if err := r.finish(); err != nil {
+		r.err = err
+		return err
+	}
+	r.prune()
+	if err := r.open(); err != nil {
+		r.err = err
+		return err
+	}
+	return nil
+}
+
+type byModTime []os.FileInfo
+
+func (b byModTime) Len() int           { return len(b) }
+func (b byModTime) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byModTime) Less(i, j int) bool { return b[i].ModTime().After(b[j].ModTime()) }
+
+// prune removes finished files beyond the retention count or age. Only
+// files named after the pattern are considered.
+func (r *rotatingFile) prune() {
+	if r.opts.keep <= 0 && r.opts.maxAge <= 0 {
+		return
+	}
+	seen := map[string]bool{}
+	var files []os.FileInfo
+	paths := map[os.FileInfo]string{}
+	glob := r.opts.pattern
+	if !r.opts.literal {
+		glob = strftimeGlob(glob)
+	}
+	ours := producedBy(r.opts.pattern, r.opts.literal)
+	for _, glob := range []string{glob, withCounter(glob, "*")} {
+		matches, _ := filepath.Glob(glob)
+		for _, m := range matches {
+			if seen[m] || !ours.MatchString(m) {
+				continue
+			}
+			seen[m] = true
+			if fi, err := os.Stat(m); err == nil && !fi.IsDir() {
+				files = append(files, fi)
+				paths[fi] = m
+			}
+		}
+	}
+	sort.Sort(byModTime(files))
+	now := r.now()
+	for i, fi := range files {
+		if r.opts.keep > 0 && i >= r.opts.keep || r.opts.maxAge > 0 && now.Sub(fi.ModTime()) > r.opts.maxAge {
+			os.Remove(paths[fi])
+		}
+	}
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return 0, errClosed
+	}
+	if r.err != nil {
+		return 0, r.err
+	}
+	if r.due(len(p)) {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.w.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	close(r.stop)
+	if r.err != nil {
+		r.file.Close()
+		return r.err
+	}
+	if r.size == 0 {
+		r.file.Close()
+		return os.Remove(r.name + partial_suffix)
+	}
+	if err := r.finish(); err != nil {
+		return err
+	}
+	r.prune()
+	return nil
+}
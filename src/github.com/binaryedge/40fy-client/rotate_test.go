@@ -0,0 +1,169 @@
+package main
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestStrftime(t *testing.T) {
+	ts := time.Date(2016, 2, 3, 4, 5, 6, 0, time.UTC)
+	if got := strftime("firehose-%Y%m%d-%H%M%S-%j-%%.ndjson.gz", ts); got != "firehose-20160203-040506-034-%.ndjson.gz" {
+		t.Fatal(got)
+	}
+	if got := strftimeGlob("out/firehose-%Y%m%d-%H.ndjson.gz"); got != "out/firehose-*-*.ndjson.gz" {
+		t.Fatal(got)
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rotate")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Date(2016, 2, 3, 4, 0, 0, 0, time.UTC)
+	r, err := newRotatingFile(rotateOptions{
+		pattern: filepath.Join(dir, "firehose-%H.ndjson.gz"),
+		maxSize: 10,
+		keep:    3,
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	r.mu.Lock()
+	r.now = func() time.Time { return now }
+	r.mu.Unlock()
+
+	for _, line := range []string{"aaaaaa\n", "bbbbbb\n", "cccccc\n"} {
+		if _, err := r.Write([]byte(line)); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	r.mu.Lock()
+	now = now.Add(time.Hour)
+	r.mu.Unlock()
+	r.Write([]byte("dddddd\n"))
+	if err := r.Close(); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	matches, _ := filepath.Glob(filepath.Join(dir, "*"))
+	sort.Strings(matches)
+	var names []string
+	for _, m := range matches {
+		names = append(names, filepath.Base(m))
+	}
+	want := []string{"firehose-04-1.ndjson.gz", "firehose-04-2.ndjson.gz", "firehose-05.ndjson.gz"}
+	if len(names) != len(want) {
+		t.Fatal("files", names, "want", want)
+	}
+	for i := range want {
+		if names[i] != want[i] {
+			t.Fatal("files", names, "want", want)
+		}
+	}
+	f, err := os.Open(filepath.Join(dir, "firehose-05.ndjson.gz"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if byts, _ := ioutil.ReadAll(gz); string(byts) != "dddddd\n" {
+		t.Fatal("content", string(byts))
+	}
+}
+
+func TestRotatingFileRecovery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rotate")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	// a literal name is not expanded, its leftover is kept
+	path := filepath.Join(dir, "100%s.ndjson")
+	if err := ioutil.WriteFile(path+partial_suffix, []byte("old\n"), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	r, err := newRotatingFile(rotateOptions{pattern: path, literal: true})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	r.Write([]byte("new\n"))
+	if err := r.Close(); err != nil {
+		t.Fatal(err.Error())
+	}
+	for name, want := range map[string]string{"100%s.ndjson": "old\n", "100%s-1.ndjson": "new\n"} {
+		if byts, err := ioutil.ReadFile(filepath.Join(dir, name)); err != nil || string(byts) != want {
+			t.Fatal("unexpected", name, string(byts), err)
+		}
+	}
+
+	// a file that can't be finished stops the writes
+	sub := filepath.Join(dir, "sub")
+	r, err = newRotatingFile(rotateOptions{pattern: filepath.Join(sub, "out.ndjson"), maxSize: 4})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	r.Write([]byte("abcd"))
+	os.RemoveAll(sub)
+	if _, err := r.Write([]byte("efgh")); err == nil {
+		t.Fatal("expected an error finishing a removed file")
+	}
+	if _, err := r.Write([]byte("ijkl")); err == nil {
+		t.Fatal("written after a failed rotation")
+	}
+	if err := r.Close(); err == nil {
+		t.Fatal("expected the rotation error on close")
+	}
+}
+
+func TestRotatingFilePruneOwnFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rotate")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	others := []string{"notes.ndjson", "20160203-draft.ndjson", "2016020.ndjson", "out-20160203.ndjson.part"}
+	for _, name := range others {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("x\n"), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	now := time.Date(2016, 2, 3, 4, 0, 0, 0, time.UTC)
+	r, err := newRotatingFile(rotateOptions{pattern: filepath.Join(dir, "%Y%m%d.ndjson"), maxSize: 1, keep: 1})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	r.mu.Lock()
+	r.now = func() time.Time { return now }
+	r.mu.Unlock()
+	for i := 0; i < 3; i++ {
+		r.Write([]byte("line\n"))
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, name := range others {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Fatal("pruned", name)
+		}
+	}
+	matches, _ := filepath.Glob(filepath.Join(dir, "20160203*.ndjson"))
+	if len(matches) != 2 {
+		t.Fatal("unexpected files", matches)
+	}
+	if re := producedBy("out/fh-%Y%m%d-%H.ndjson", false); !re.MatchString("out/fh-20160203-04.ndjson") ||
+		!re.MatchString("out/fh-20160203-04-2.ndjson") || re.MatchString("out/fh-2016-notes.ndjson") {
+		t.Fatal("unexpected regexp", re)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// newSampler returns a predicate passing a fraction rate of the events. With
+// a key field the decision is taken on a hash of its value, so all events
+// with the same value are either passed or dropped. Events without the
+// field are sampled at random, rather than all together on an empty value.
+func newSampler(rate float64, key string) (predicate, error) {
+	if rate <= 0 || rate > 1 {
+		return nil, fmt.Errorf("sample rate must be above 0 and at most 1")
+	}
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	random := func(e event) bool { return r.Float64() < rate }
+	if len(key) == 0 {
+		return random, nil
+	}
+	if len(splitPath(key)) == 0 {
+		return nil, fmt.Errorf("invalid sample key %q", key)
+	}
+	field := compilePath(key)
+	limit := rate * math.MaxUint64
+	return func(e event) bool {
+		v, ok := field(e)
+		if !ok || v == nil {
+			return random(e)
+		}
+		h := fnv.New64a()
+		h.Write([]byte(valueString(v)))
+		return float64(mix64(h.Sum64())) < limit
+	}, nil
+}
+
+// parseRate parses a rate such as 100/s, 600/m, 1000/h or a plain number of
+// events per second.
+func parseRate(s string) (float64, error) {
+	n, unit := s, time.Second
+	if i := strings.Index(s, "/"); i >= 0 {
+		n = s[:i]
+		switch s[i+1:] {
+		case "s":
+		case "m":
+			unit = time.Minute
+		case "h":
+			unit = time.Hour
+		default:
+			return 0, fmt.Errorf("invalid rate %q, use N/s, N/m or N/h", s)
+		}
+	}
+	v, err := strconv.ParseFloat(n, 64)
+	if err != nil || v <= 0 {
+		return 0, fmt.Errorf("invalid rate %q, use N/s, N/m or N/h", s)
+	}
+	return v / unit.Seconds(), nil
+}
+
+// rateLimiter is a token bucket passing at most perSec events a second on
+// average, with bursts of up to one second worth of events. Dropped events
+// are counted and reported when it is closed.
+type rateLimiter struct {
+	mu      sync.Mutex
+	perSec  float64
+	burst   float64
+	tokens  float64
+	last    time.Time
+	dropped uint64
+	now     func() time.Time
+	report  io.Writer
+}
+
+func newRateLimiter(perSec float64, report io.Writer) *rateLimiter {
+	burst := math.Max(1, perSec)
+	return &rateLimiter{perSec: perSec, burst: burst, tokens: burst, now: time.Now, report: report}
+}
+
+func (r *rateLimiter) allow(e event) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := r.now()
+	if !r.last.IsZero() {
+		r.tokens = math.Min(r.burst, r.tokens+now.Sub(r.last).Seconds()*r.perSec)
+	}
+	r.last = now
+	if r.tokens >= 1 {
+		r.tokens--
+		return true
+	}
+	r.dropped++
+	return false
+}
+
+func (r *rateLimiter) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.dropped > 0 {
+		fmt.Fprintf(r.report, "Rate limit dropped %d event(s)\n", r.dropped)
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestSampler(t *testing.T) {
+	pred, err := newSampler(0.1, "")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	passed := 0
+	for i := 0; i < 10000; i++ {
+		if pred(event{}) {
+			passed++
+		}
+	}
+	if passed < 800 || passed > 1200 {
+		t.Error("random sampling passed", passed, "of 10000")
+	}
+
+	pred, err = newSampler(0.1, "target.ip")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	passed = 0
+	for i := 0; i < 10000; i++ {
+		ip := fmt.Sprintf("10.0.%d.%d", i/256, i%256)
+		e := event{"target": map[string]interface{}{"ip": ip}}
+		first := pred(e)
+		if pred(e) != first {
+			t.Fatal("inconsistent sampling of", ip)
+		}
+		if first {
+			passed++
+		}
+	}
+	if passed < 800 || passed > 1200 {
+		t.Error("key sampling passed", passed, "of 10000")
+	}
+
+	// events without the key
+	passed = 0
+	for i := 0; i < 10000; i++ {
+		if pred(event{}) {
+			passed++
+		}
+	}
+	if passed < 800 || passed > 1200 {
+		t.Error("sampling without the key passed", passed, "of 10000")
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	for _, c := range []struct {
+		in   string
+		want float64
+	}{{"10/s", 10}, {"600/m", 10}, {"5", 5}, {"3600/h", 1}} {
+		if got, err := parseRate(c.in); err != nil || got != c.want {
+			t.Error(c.in, got, err)
+		}
+	}
+	if _, err := parseRate("10/d"); err == nil {
+		t.Error("10/d accepted")
+	}
+
+	var report bytes.Buffer
+	r := newRateLimiter(10, &report)
+	now := time.Unix(0, 0)
+	r.now = func() time.Time { return now }
+	passed := 0
+	for i := 0; i < 100; i++ {
+		now = now.Add(10 * time.Millisecond)
+		if r.allow(nil) {
+			passed++
+		}
+	}
+	// a burst of 10 and 10 more over the second
+	if passed < 19 || passed > 21 {
+		t.Error("passed", passed, "events in a second at 10/s")
+	}
+	r.Close()
+	if want := fmt.Sprintf("Rate limit dropped %d event(s)\n", 100-passed); report.String() != want {
+		t.Error("reported", report.String())
+	}
+}
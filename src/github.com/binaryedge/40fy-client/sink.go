@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sink receives every event that passed the filters, in addition to the
+// output of the command. Sinks may buffer, close flushes them.
+type sink interface {
+	send(e event, line []byte) error
+	close() error
+}
+
+// sinkFactory creates a sink from its URL, the scheme selects the factory.
+type sinkFactory func(u *url.URL) (sink, error)
+
+var sinks = map[string]sinkFactory{}
+
+// registerSink makes a sink available to --sink under the URL scheme name.
+func registerSink(scheme string, f sinkFactory) {
+	sinks[scheme] = f
+}
+
+// newSink parses spec as a URL and creates the sink registered for its
+// scheme. A "+suffix" on the scheme, as in elasticsearch+https, is left for
+// the sink to interpret.
+func newSink(spec string) (sink, error) {
+	u, err := url.Parse(escapePercent(spec))
+	if err != nil {
+		return nil, fmt.Errorf("invalid sink %q: %s", spec, err.Error())
+	}
+	scheme := u.Scheme
+	if i := strings.Index(scheme, "+"); i >= 0 {
+		scheme = scheme[:i]
+	}
+	f, ok := sinks[scheme]
+	if !ok {
+		var names []string
+		for name := range sinks {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown sink %q, use one of %s", u.Scheme, strings.Join(names, ", "))
+	}
+	return f(u)
+}
+
+// escapePercent escapes the % of strftime conversions in spec, leaving
+// valid URL escapes alone.
+func escapePercent(spec string) string {
+	ishex := func(c byte) bool {
+		return c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F'
+	}
+	var b []byte
+	for i := 0; i < len(spec); i++ {
+		if spec[i] == '%' && !(i+2 < len(spec) && ishex(spec[i+1]) && ishex(spec[i+2])) {
+			b = append(b, "%25"...)
+			continue
+		}
+		b = append(b, spec[i])
+	}
+	return string(b)
+}
+
+// transport returns the "+suffix" of a sink URL scheme, or def.
+func transport(u *url.URL, def string) string {
+	if i := strings.Index(u.Scheme, "+"); i >= 0 {
+		return u.Scheme[i+1:]
+	}
+	return def
+}
+
+// stringList is a flag that may be given more than once.
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// max_pending_batches bounds the batches waiting to be flushed, add blocks
+// beyond it.
+const max_pending_batches = 4
+
+// batcher collects items for a sink and hands them to flush in batches of
+// size items, or once the oldest pending item is age old. Batches are
+// flushed in order by a goroutine of their own, flush is never called
+// concurrently and add only blocks when max_pending_batches batches are
+// waiting for it.
+type batcher struct {
+	size  int
+	age   time.Duration
+	flush func(items []interface{})
+
+	mu      sync.Mutex
+	pending []interface{}
+	oldest  time.Time
+	// queueMu is taken before mu is released to queue a batch, so batches
+	// are queued in the order they were collected
+	queueMu sync.Mutex
+	queue   chan []interface{}
+	flushed chan struct{}
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+func newBatcher(size int, age time.Duration, flush func(items []interface{})) *batcher {
+	b := &batcher{
+		size:    size,
+		age:     age,
+		flush:   flush,
+		queue:   make(chan []interface{}, max_pending_batches),
+		flushed: make(chan struct{}),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go b.flusher()
+	go b.tick()
+	return b
+}
+
+func (b *batcher) add(item interface{}) {
+	b.mu.Lock()
+	if len(b.pending) == 0 {
+		b.oldest = time.Now()
+	}
+	b.pending = append(b.pending, item)
+	if len(b.pending) < b.size {
+		b.mu.Unlock()
+		return
+	}
+	b.enqueueLocked()
+}
+
+// enqueueLocked takes the pending items and queues them for flushing,
+// b.mu is held when called and released when it returns.
+func (b *batcher) enqueueLocked() {
+	items := b.pending
+	b.pending = nil
+	b.queueMu.Lock()
+	b.mu.Unlock()
+	b.queue <- items
+	b.queueMu.Unlock()
+}
+
+func (b *batcher) flusher() {
+	defer close(b.flushed)
+	for items := range b.queue {
+		b.flush(items)
+	}
+}
+
+func (b *batcher) tick() {
+	defer close(b.done)
+	t := time.NewTicker(100 * time.Millisecond)
+	defer t.Stop()
+	for {
+		select {
+		case <-b.stop:
+			return
+		case <-t.C:
+			b.mu.Lock()
+			if len(b.pending) > 0 && time.Since(b.oldest) >= b.age {
+				b.enqueueLocked()
+			} else {
+				b.mu.Unlock()
+			}
+		}
+	}
+}
+
+// close flushes what is pending and stops the batcher.
+func (b *batcher) close() {
+	close(b.stop)
+	<-b.done
+	b.mu.Lock()
+	if len(b.pending) > 0 {
+		b.enqueueLocked()
+	} else {
+		b.mu.Unlock()
+	}
+	close(b.queue)
+	<-b.flushed
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mitchellh/cli"
+)
+
+const sse_tokens_file_name = "sse_tokens.json"
+
+// sseTokens are the local users allowed to read the events served by
+// serve-sse. Only a hash of every token is stored.
+type sseTokens struct {
+	path  string
+	Users map[string]string `json:"users"`
+}
+
+func sseTokensPath() string {
+	return filepath.Join(configHome(), sse_tokens_file_name)
+}
+
+func openSSETokens(path string) (*sseTokens, error) {
+	t := &sseTokens{path: path, Users: map[string]string{}}
+	byts, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return t, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(byts, t); err != nil {
+		return nil, fmt.Errorf("corrupt token file %s: %s", path, err.Error())
+	}
+	if t.Users == nil {
+		t.Users = map[string]string{}
+	}
+	return t, nil
+}
+
+func (t *sseTokens) save() error {
+	if err := os.MkdirAll(filepath.Dir(t.path), 0700); err != nil {
+		return err
+	}
+	byts, err := json.MarshalIndent(t, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := t.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, byts, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, t.path)
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// add creates a new token for user, replacing any previous one.
+func (t *sseTokens) add(user string) (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(b)
+	t.Users[user] = hashToken(token)
+	return token, nil
+}
+
+// user returns the user owning token.
+func (t *sseTokens) user(token string) (string, bool) {
+	if len(token) == 0 {
+		return "", false
+	}
+	h := []byte(hashToken(token))
+	for user, stored := range t.Users {
+		if subtle.ConstantTimeCompare(h, []byte(stored)) == 1 {
+			return user, true
+		}
+	}
+	return "", false
+}
+
+// sseServer serves the events of a relay hub as text/event-stream to the
+// users of tokens.
+type sseServer struct {
+	hub         *relayHub
+	tokens      *sseTokens
+	heartbeat   time.Duration
+	allowOrigin string
+}
+
+// requestToken reads the local token from the Authorization header or, as
+// browsers can't set headers on an EventSource, the access_token parameter.
+func requestToken(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	return r.URL.Query().Get("access_token")
+}
+
+func (s *sseServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if len(s.allowOrigin) > 0 {
+		w.Header().Set("Access-Control-Allow-Origin", s.allowOrigin)
+		w.Header().Set("Access-Control-Allow-Headers", "Authorization, Last-Event-ID")
+	}
+	if r.Method == "OPTIONS" {
+		return
+	}
+	user, ok := s.tokens.user(requestToken(r))
+	if !ok {
+		http.Error(w, "invalid or missing access token", http.StatusUnauthorized)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	lastID := r.Header.Get("Last-Event-ID")
+	if len(lastID) == 0 {
+		lastID = r.URL.Query().Get("last_event_id")
+	}
+	after, _ := strconv.ParseUint(lastID, 10, 64)
+	c, backlog, err := s.hub.resume("sse", user+"@"+r.RemoteAddr, r.URL.Query().Get("filter"), after)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer s.hub.unsubscribe(c)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write([]byte("retry: 3000\n\n")); err != nil {
+		return
+	}
+	for _, l := range backlog {
+		if _, err := w.Write(sseEvent(l)); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	var gone <-chan bool
+	if cn, ok := w.(http.CloseNotifier); ok {
+		gone = cn.CloseNotify()
+	}
+	heartbeat := time.NewTicker(s.heartbeat)
+	defer heartbeat.Stop()
+	for {
+		var err error
+		select {
+		case l := <-c.lines:
+			_, err = w.Write(sseEvent(l))
+		case <-heartbeat.C:
+			_, err = w.Write([]byte(": heartbeat\n\n"))
+		case <-c.closed:
+			return
+		case <-gone:
+			return
+		}
+		if err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// sseEvent formats a line as an event, the line is JSON and holds no line
+// breaks once trimmed.
+func sseEvent(l relayLine) []byte {
+	b := []byte("id: " + strconv.FormatUint(l.id, 10) + "\ndata: ")
+	b = append(b, strings.TrimRight(string(l.line), "\r\n")...)
+	return append(b, "\n\n"...)
+}
+
+type serveSSECommand struct {
+	client  http.Client
+	config  map[string]interface{}
+	tokens  string
+	verbose bool
+}
+
+func (s *serveSSECommand) Run(args []string) int {
+	fs := flag.NewFlagSet("serve-sse", flag.ContinueOnError)
+	token := fs.String("token", "", "token for authenticating with api")
+	firehose := fs.Bool("firehose", false, "serve the firehose instead of the user's stream")
+	jobID := fs.String("job-id", "", "only serve events of this job, \"last\" or a label from the job history")
+	filter := fs.String("filter", "", "only serve events matching this expression")
+	listen := fs.String("listen", "127.0.0.1:8041", "address to listen on")
+	replay := fs.Int("replay", 1000, "events kept for clients reconnecting with Last-Event-ID")
+	buffer := fs.Int("buffer", 1000, "events queued for every client before it is disconnected")
+	heartbeat := fs.Duration("heartbeat", 15*time.Second, "time between heartbeat comments")
+	allowOrigin := fs.String("allow-origin", "", "origin allowed to read the events from a browser, * for any")
+	addUser := fs.String("add-user", "", "create a local access token for this user and exit")
+	removeUser := fs.String("remove-user", "", "remove the local access token of this user and exit")
+	listUsers := fs.Bool("list-users", false, "list the users with a local access token and exit")
+	verbose := fs.Bool("verbose", false, "show upstream requests and responses")
+	if err := fs.Parse(args); err != nil {
+		return -1
+	}
+	tokens, err := openSSETokens(s.tokens)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to read tokens", err.Error())
+		return -1
+	}
+	switch {
+	case len(*addUser) > 0:
+		tok, err := tokens.add(*addUser)
+		if err == nil {
+			err = tokens.save()
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to save token", err.Error())
+			return -1
+		}
+		fmt.Println(tok)
+		return 0
+	case len(*removeUser) > 0:
+		if _, ok := tokens.Users[*removeUser]; !ok {
+			fmt.Fprintln(os.Stderr, "No token for user", *removeUser)
+			return -1
+		}
+		delete(tokens.Users, *removeUser)
+		if err := tokens.save(); err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to save tokens", err.Error())
+			return -1
+		}
+		return 0
+	case *listUsers:
+		var users []string
+		for u := range tokens.Users {
+			users = append(users, u)
+		}
+		sort.Strings(users)
+		for _, u := range users {
+			fmt.Println(u)
+		}
+		return 0
+	}
+
+	if len(*token) == 0 {
+		if tok, ok := s.config["token"].(string); ok && len(tok) > 0 {
+			*token = tok
+		} else {
+			fmt.Println(s.Help())
+			return -1
+		}
+	}
+	if len(tokens.Users) == 0 {
+		fmt.Fprintln(os.Stderr, "No local users, create one with -add-user=NAME")
+		return -1
+	}
+	if *heartbeat <= 0 || *replay < 0 {
+		fmt.Fprintln(os.Stderr, "heartbeat must be positive and replay not negative")
+		return -1
+	}
+	id, err := resolveJobID(historyPath(), *jobID)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to resolve job", err.Error())
+		return -1
+	}
+	// a slow browser is disconnected and catches up from the replay buffer
+	// when it reconnects
+	hub, err := newRelayHub(*buffer, "disconnect")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return -1
+	}
+	hub.replay = *replay
+	p := &pipeline{output: hub}
+	if err := p.filterBy(id, *filter); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return -1
+	}
+	url := s.config["stream_url"].(string)
+	if *firehose {
+		url = s.config["firehose_url"].(string)
+	}
+	relay := &RelayCommand{client: s.client, config: s.config, verbose: *verbose}
+	go relay.upstream(url, *token, hub, p)
+
+	mux := http.NewServeMux()
+	mux.Handle("/events", &sseServer{hub: hub, tokens: tokens, heartbeat: *heartbeat, allowOrigin: *allowOrigin})
+	fmt.Fprintf(os.Stderr, "Serving events on http://%s/events\n", *listen)
+	if err := http.ListenAndServe(*listen, mux); err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to listen", err.Error())
+		return -1
+	}
+	return 0
+}
+
+func (s *serveSSECommand) Synopsis() string {
+	return "Serve the stream to browsers as Server-Sent Events"
+}
+
+func (s *serveSSECommand) Help() string {
+	return `
+Usage: 40fy-client serve-sse -token=TOKEN [-firehose] [-job-id=JOBID] [-filter=FILTER] [-listen=127.0.0.1:8041] [-replay=1000] [-heartbeat=15s] [-allow-origin=ORIGIN]
+       40fy-client serve-sse -add-user=NAME | -remove-user=NAME | -list-users
+
+ Holds a single connection to the stream, or the firehose with -firehose, and serves it as text/event-stream
+ on http://LISTEN/events, for example to an EventSource in a browser:
+   new EventSource("http://127.0.0.1:8041/events?access_token=LOCALTOKEN&filter=port%3D%3D22")
+ Every event has an id. Clients reconnecting with Last-Event-ID, or last_event_id, get the events they
+ missed from the last REPLAY events. A heartbeat comment is sent every HEARTBEAT to keep connections open.
+ Clients that fall BUFFER events behind are disconnected and catch up when they reconnect.
+
+ The TOKEN is never sent to clients, they authenticate with local tokens instead, given as
+ access_token or in an Authorization: Bearer header. -add-user=NAME prints a new token for NAME,
+ tokens are stored hashed in ~/.binaryedge/sse_tokens.json.
+ The "ORIGIN" parameter sets Access-Control-Allow-Origin for dashboards served from another origin.
+	`
+}
+
+func ServeSSECommandFactory() (cli.Command, error) {
+	s := &serveSSECommand{
+		client: http.Client{},
+		tokens: sseTokensPath(),
+	}
+	s.config = loadConfig()
+	return s, nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSSETokens(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sse")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "tokens.json")
+	tokens, _ := openSSETokens(path)
+	tok, err := tokens.add("alice")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := tokens.save(); err != nil {
+		t.Fatal(err.Error())
+	}
+	byts, _ := ioutil.ReadFile(path)
+	if strings.Contains(string(byts), tok) {
+		t.Fatal("token stored in clear")
+	}
+	tokens, _ = openSSETokens(path)
+	if user, ok := tokens.user(tok); !ok || user != "alice" {
+		t.Fatal("token not found", user)
+	}
+	if _, ok := tokens.user("nope"); ok {
+		t.Fatal("unknown token accepted")
+	}
+}
+
+func TestSSEServer(t *testing.T) {
+	tokens := &sseTokens{Users: map[string]string{}}
+	tok, _ := tokens.add("alice")
+	hub, _ := newRelayHub(10, "disconnect")
+	hub.replay = 2
+	server := httptest.NewServer(&sseServer{hub: hub, tokens: tokens, heartbeat: 50 * time.Millisecond})
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatal("served without a token", resp.Status)
+	}
+
+	for _, l := range []string{`{"n":1}`, `{"n":2}`, `{"n":3}`} {
+		hub.Write([]byte(l + "\n"))
+	}
+	req, _ := http.NewRequest("GET", server.URL+"?access_token="+tok, nil)
+	req.Header.Set("Last-Event-ID", "1")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatal("unexpected content type", resp.Header)
+	}
+	r := bufio.NewReader(resp.Body)
+	var got []string
+	for len(got) < 8 {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		got = append(got, strings.TrimRight(line, "\n"))
+		if len(got) == 6 {
+			hub.Write([]byte(`{"n":4}` + "\n"))
+		}
+	}
+	want := []string{"retry: 3000", "", "id: 2", `data: {"n":2}`, "", "id: 3", `data: {"n":3}`, ""}
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Fatal("got", got)
+	}
+	rest := ""
+	for !strings.Contains(rest, ": heartbeat") {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		rest += line
+	}
+	if !strings.Contains(rest, "id: 4\ndata: {\"n\":4}\n") {
+		t.Fatal("missing live event", rest)
+	}
+}
@@ -0,0 +1,508 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// Policies for lines read while the input queue is full.
+const (
+	policy_block       = "block"
+	policy_drop_oldest = "drop-oldest"
+	policy_drop_newest = "drop-newest"
+	policy_spill       = "spill"
+)
+
+type stageOptions struct {
+	// size is the number of lines or events every queue holds
+	size     int
+	policy   string
+	decoders int
+	spillDir string
+}
+
+// stageMetrics measures a stage: the depth of the queue in front of it, the
+// time items wait in that queue and the time the stage spends on them.
+type stageMetrics struct {
+	name string
+
+	mu              sync.Mutex
+	depth, maxDepth int
+	items           uint64
+	dropped         uint64
+	spilled         uint64
+	wait, maxWait   time.Duration
+	busy            time.Duration
+}
+
+func (m *stageMetrics) sample(depth int) {
+	m.mu.Lock()
+	m.depth = depth
+	if depth > m.maxDepth {
+		m.maxDepth = depth
+	}
+	m.mu.Unlock()
+}
+
+func (m *stageMetrics) observe(wait, busy time.Duration) {
+	m.mu.Lock()
+	m.items++
+	m.wait += wait
+	if wait > m.maxWait {
+		m.maxWait = wait
+	}
+	m.busy += busy
+	m.mu.Unlock()
+}
+
+// stageReport is the state of a stage in the statistics reports.
+type stageReport struct {
+	Name      string  `json:"name"`
+	Items     uint64  `json:"items"`
+	Depth     int     `json:"depth"`
+	MaxDepth  int     `json:"max_depth"`
+	Dropped   uint64  `json:"dropped,omitempty"`
+	Spilled   uint64  `json:"spilled,omitempty"`
+	AvgWaitMs float64 `json:"avg_wait_ms"`
+	MaxWaitMs float64 `json:"max_wait_ms"`
+	AvgBusyMs float64 `json:"avg_busy_ms"`
+}
+
+func (m *stageMetrics) report() stageReport {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ms := func(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+	r := stageReport{
+		Name:      m.name,
+		Items:     m.items,
+		Depth:     m.depth,
+		MaxDepth:  m.maxDepth,
+		Dropped:   m.dropped,
+		Spilled:   m.spilled,
+		MaxWaitMs: ms(m.maxWait),
+	}
+	if m.items > 0 {
+		r.AvgWaitMs = ms(m.wait) / float64(m.items)
+		r.AvgBusyMs = ms(m.busy) / float64(m.items)
+	}
+	return r
+}
+
+// queuedLine is a line waiting in the input queue.
+type queuedLine struct {
+	line []byte
+	at   time.Time
+}
+
+// lineQueue is the bounded queue between the reader and the decoders. When
+// it is full the policy blocks the reader, drops the oldest or the newest
+// line, or spills lines to a file until the decoders catch up.
+type lineQueue struct {
+	mu       sync.Mutex
+	notEmpty *sync.Cond
+	notFull  *sync.Cond
+	items    []queuedLine
+	size     int
+	policy   string
+	spillDir string
+	spill    *spillFile
+	closed   bool
+	aborted  bool
+	m        *stageMetrics
+}
+
+func newLineQueue(opts stageOptions, m *stageMetrics) *lineQueue {
+	q := &lineQueue{size: opts.size, policy: opts.policy, spillDir: opts.spillDir, m: m}
+	q.notEmpty = sync.NewCond(&q.mu)
+	q.notFull = sync.NewCond(&q.mu)
+	return q
+}
+
+func (q *lineQueue) push(line []byte) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	defer func() { q.m.sample(q.depth()) }()
+	// once lines are spilled, later lines follow them to keep the order
+	if q.spill != nil && q.spill.pending > 0 {
+		return q.spillLine(line)
+	}
+	for len(q.items) >= q.size {
+		switch q.policy {
+		case policy_drop_newest:
+			q.dropped()
+			return nil
+		case policy_drop_oldest:
+			q.items = q.items[1:]
+			q.dropped()
+		case policy_spill:
+			return q.spillLine(line)
+		default:
+			if q.aborted {
+				return nil
+			}
+			q.notFull.Wait()
+		}
+	}
+	q.items = append(q.items, queuedLine{line, time.Now()})
+	q.notEmpty.Signal()
+	return nil
+}
+
+func (q *lineQueue) dropped() {
+	q.m.mu.Lock()
+	q.m.dropped++
+	q.m.mu.Unlock()
+}
+
+func (q *lineQueue) spillLine(line []byte) error {
+	if q.spill == nil {
+		s, err := newSpillFile(q.spillDir)
+		if err != nil {
+			return err
+		}
+		q.spill = s
+	}
+	if err := q.spill.write(line); err != nil {
+		return err
+	}
+	q.m.mu.Lock()
+	q.m.spilled++
+	q.m.mu.Unlock()
+	q.notEmpty.Signal()
+	return nil
+}
+
+func (q *lineQueue) depth() int {
+	n := len(q.items)
+	if q.spill != nil {
+		n += q.spill.pending
+	}
+	return n
+}
+
+// pop returns the oldest line, waiting for one. It returns false once the
+// queue is closed and empty.
+func (q *lineQueue) pop() (queuedLine, bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for q.depth() == 0 && !q.closed && !q.aborted {
+		q.notEmpty.Wait()
+	}
+	if q.aborted {
+		return queuedLine{}, false, nil
+	}
+	defer func() { q.m.sample(q.depth()) }()
+	if len(q.items) > 0 {
+		l := q.items[0]
+		q.items = q.items[1:]
+		q.notFull.Signal()
+		return l, true, nil
+	}
+	if q.spill != nil && q.spill.pending > 0 {
+		// only pop reads the spill file, pushes go on meanwhile
+		spill := q.spill
+		q.mu.Unlock()
+		line, err := spill.read()
+		q.mu.Lock()
+		if err == nil {
+			err = spill.taken()
+		}
+		return queuedLine{line, time.Now()}, err == nil, err
+	}
+	return queuedLine{}, false, nil
+}
+
+// close ends the queue once the lines in it are taken.
+func (q *lineQueue) close() {
+	q.mu.Lock()
+	q.closed = true
+	q.notEmpty.Broadcast()
+	q.mu.Unlock()
+}
+
+// abort ends the queue at once, lines in it are discarded and pushes no
+// longer block.
+func (q *lineQueue) abort() {
+	q.mu.Lock()
+	q.aborted = true
+	q.notEmpty.Broadcast()
+	q.notFull.Broadcast()
+	q.mu.Unlock()
+}
+
+func (q *lineQueue) remove() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.spill == nil {
+		return nil
+	}
+	return q.spill.remove()
+}
+
+// spillFile holds the lines the input queue had no room for, in order. The
+// file is emptied whenever all of its lines have been read back. Lines are
+// written under the lock of the queue and read back through a handle of
+// their own without it.
+type spillFile struct {
+	f       *os.File
+	w       int64
+	pending int
+	rf      *os.File
+	r       *bufio.Reader
+}
+
+func newSpillFile(dir string) (*spillFile, error) {
+	f, err := ioutil.TempFile(dir, "40fy-spill-")
+	if err != nil {
+		return nil, err
+	}
+	rf, err := os.Open(f.Name())
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return &spillFile{f: f, rf: rf, r: bufio.NewReaderSize(rf, 64*1024)}, nil
+}
+
+func (s *spillFile) write(line []byte) error {
+	if len(line) == 0 || line[len(line)-1] != '\n' {
+		line = append(append([]byte{}, line...), '\n')
+	}
+	n, err := s.f.WriteAt(line, s.w)
+	s.w += int64(n)
+	if err != nil {
+		return err
+	}
+	s.pending++
+	return nil
+}
+
+// read returns the oldest pending line, which was written whole before.
+func (s *spillFile) read() ([]byte, error) {
+	line, err := s.r.ReadBytes('\n')
+	if err != nil {
+		return nil, fmt.Errorf("spill file %s: %s", s.f.Name(), err.Error())
+	}
+	return line, nil
+}
+
+// taken counts a line read back, under the lock of the queue.
+func (s *spillFile) taken() error {
+	s.pending--
+	if s.pending > 0 {
+		return nil
+	}
+	s.w = 0
+	if err := s.f.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := s.rf.Seek(0, 0); err != nil {
+		return err
+	}
+	s.r.Reset(s.rf)
+	return nil
+}
+
+func (s *spillFile) remove() error {
+	s.rf.Close()
+	s.f.Close()
+	return os.Remove(s.f.Name())
+}
+
+// stages runs a pipeline as a reader, decoders, a processor and a sink
+// stage connected by bounded queues, so a slow output does not hold up
+// reading the stream until the queues are full. Lines leave in the order
+// they were read whatever the number of decoders.
+type stages struct {
+	opts   stageOptions
+	read   *stageMetrics
+	decode *stageMetrics
+	proc   *stageMetrics
+	sink   *stageMetrics
+	report io.Writer
+}
+
+func newStages(opts stageOptions, report io.Writer) (*stages, error) {
+	switch opts.policy {
+	case policy_block, policy_drop_oldest, policy_drop_newest, policy_spill:
+	default:
+		return nil, fmt.Errorf("unknown queue policy %q, use block, drop-oldest, drop-newest or spill", opts.policy)
+	}
+	if opts.size <= 0 || opts.decoders <= 0 {
+		return nil, fmt.Errorf("queue size and decoders must be positive")
+	}
+	return &stages{
+		opts:   opts,
+		read:   &stageMetrics{name: "read"},
+		decode: &stageMetrics{name: "decode"},
+		proc:   &stageMetrics{name: "process"},
+		sink:   &stageMetrics{name: "sink"},
+		report: report,
+	}, nil
+}
+
+func (s *stages) metrics() []*stageMetrics {
+	return []*stageMetrics{s.read, s.decode, s.proc, s.sink}
+}
+
+// stageItem is a line on its way through the stages.
+type stageItem struct {
+	line []byte
+	e    event
+	ok   bool
+	err  error
+	at   time.Time
+	done chan struct{}
+}
+
+// run feeds the stream to the pipeline until the stream ends or a stage
+// fails, then waits for the queued lines to be written. body is closed when
+// a stage fails so the reader stops.
+func (s *stages) run(body io.Reader, p *pipeline) error {
+	in := newLineQueue(s.opts, s.decode)
+	defer in.remove()
+	var mu sync.Mutex
+	var failure error
+	fail := func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if failure == nil {
+			failure = err
+			in.abort()
+			if c, ok := body.(io.Closer); ok {
+				c.Close()
+			}
+		}
+	}
+	failed := func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		return failure
+	}
+
+	ordered := make(chan *stageItem, s.opts.size)
+	work := make(chan *stageItem, s.opts.size)
+	emit := make(chan *stageItem, s.opts.size)
+	finished := make(chan struct{})
+
+	// hands the lines to the decoders, and in the same order to the processor
+	go func() {
+		defer close(ordered)
+		defer close(work)
+		for {
+			l, ok, err := in.pop()
+			if err != nil {
+				fail(err)
+				return
+			}
+			if !ok {
+				return
+			}
+			it := &stageItem{line: l.line, at: l.at, done: make(chan struct{})}
+			ordered <- it
+			work <- it
+		}
+	}()
+	var decoders sync.WaitGroup
+	for i := 0; i < s.opts.decoders; i++ {
+		decoders.Add(1)
+		go func() {
+			defer decoders.Done()
+			for it := range work {
+				start := time.Now()
+				it.e, it.ok, it.err = p.decode(it.line)
+				end := time.Now()
+				s.decode.observe(start.Sub(it.at), end.Sub(start))
+				it.at = end
+				close(it.done)
+			}
+		}()
+	}
+	go func() {
+		defer close(emit)
+		for it := range ordered {
+			<-it.done
+			s.proc.sample(len(ordered))
+			if it.err != nil {
+				fail(it.err)
+				continue
+			}
+			if !it.ok || failed() != nil {
+				continue
+			}
+			start := time.Now()
+			ok := p.process(it.e, len(it.line))
+			end := time.Now()
+			s.proc.observe(start.Sub(it.at), end.Sub(start))
+			if ok {
+				it.at = end
+				emit <- it
+			}
+		}
+	}()
+	go func() {
+		defer close(finished)
+		for it := range emit {
+			s.sink.sample(len(emit))
+			if failed() != nil {
+				continue
+			}
+			start := time.Now()
+			if err := p.emit(it.e, it.line); err != nil {
+				fail(err)
+			}
+			s.sink.observe(start.Sub(it.at), time.Since(start))
+		}
+	}()
+
+	lines := newLineReader(body, p.maxLine)
+	var rerr error
+	for failed() == nil {
+		byts, tooLong, err := lines.next()
+		start := time.Now()
+		if tooLong {
+			if jerr := p.reject(byts, reason_too_long); jerr != nil {
+				fail(jerr)
+			}
+		} else if len(byts) > 0 {
+			if err := p.record(byts); err != nil {
+				fail(err)
+			} else if err := in.push(byts); err != nil {
+				fail(err)
+			}
+			s.read.observe(0, time.Since(start))
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			rerr = err
+			break
+		}
+	}
+	in.close()
+	<-finished
+	decoders.Wait()
+	if err := failed(); err != nil {
+		return err
+	}
+	return rerr
+}
+
+// Close reports the lines dropped or spilled because the queue was full.
+func (s *stages) Close() error {
+	r := s.decode.report()
+	if r.Dropped > 0 {
+		fmt.Fprintf(s.report, "Queue full, dropped %d line(s)\n", r.Dropped)
+	}
+	if r.Spilled > 0 {
+		fmt.Fprintf(s.report, "Queue full, spilled %d line(s) to disk\n", r.Spilled)
+	}
+	return nil
+}
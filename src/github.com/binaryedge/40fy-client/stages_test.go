@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// slowWriter holds every write until release is closed.
+type slowWriter struct {
+	bytes.Buffer
+	release chan struct{}
+}
+
+func (w *slowWriter) Write(b []byte) (int, error) {
+	<-w.release
+	return w.Buffer.Write(b)
+}
+
+func testLines(n int) ([]byte, string) {
+	var body bytes.Buffer
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&body, `{"origin":{"job_id":"%d"},"target":{"port":%d}}`+"\n", i, i)
+	}
+	return body.Bytes(), body.String()
+}
+
+func TestStagesKeepOrder(t *testing.T) {
+	body, want := testLines(2000)
+	var out bytes.Buffer
+	st, err := newStages(stageOptions{size: 16, policy: policy_block, decoders: 8}, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	p := &pipeline{output: &out, stages: st}
+	p.filterBy("", "port >= 0")
+	if err := readFromResponse(bytes.NewReader(body), p); err != nil {
+		t.Fatal(err.Error())
+	}
+	if out.String() != want {
+		t.Fatal("lines out of order")
+	}
+	if r := st.decode.report(); r.Items != 2000 || r.MaxDepth > 16 {
+		t.Fatal("unexpected decode metrics", r)
+	}
+}
+
+func TestStagesPolicies(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stages")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	body, all := testLines(100)
+	lines := strings.SplitAfter(all, "\n")
+	for policy, check := range map[string]func(out string, r stageReport) bool{
+		policy_drop_newest: func(out string, r stageReport) bool {
+			return r.Dropped > 0 && strings.HasPrefix(all, out)
+		},
+		policy_drop_oldest: func(out string, r stageReport) bool {
+			return r.Dropped > 0 && strings.HasSuffix(out, lines[98]+lines[99])
+		},
+		policy_spill: func(out string, r stageReport) bool {
+			return r.Spilled > 0 && out == all
+		},
+	} {
+		st, err := newStages(stageOptions{size: 2, policy: policy, decoders: 1, spillDir: dir}, ioutil.Discard)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		w := &slowWriter{release: make(chan struct{})}
+		p := &pipeline{output: w, stages: st}
+		// the output is stuck until every line was read
+		go func() {
+			for st.read.report().Items < 100 {
+				time.Sleep(time.Millisecond)
+			}
+			close(w.release)
+		}()
+		if err := readFromResponse(bytes.NewReader(body), p); err != nil {
+			t.Fatal(err.Error())
+		}
+		if r := st.decode.report(); !check(w.String(), r) {
+			t.Fatal(policy, "unexpected result", r, w.String())
+		}
+		if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+			t.Fatal("spill file left behind")
+		}
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(b []byte) (int, error) { return 0, errors.New("disk full") }
+
+// endlessBody is a stream that never ends until it is closed.
+type endlessBody struct {
+	closed chan struct{}
+}
+
+func (b *endlessBody) Read(p []byte) (int, error) {
+	select {
+	case <-b.closed:
+		return 0, io.ErrClosedPipe
+	case <-time.After(time.Millisecond):
+	}
+	return copy(p, jobResult), nil
+}
+
+func (b *endlessBody) Close() error {
+	close(b.closed)
+	return nil
+}
+
+func TestStagesFailure(t *testing.T) {
+	st, err := newStages(stageOptions{size: 4, policy: policy_block, decoders: 2}, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	p := &pipeline{output: failingWriter{}, stages: st}
+	if err := readFromResponse(&endlessBody{closed: make(chan struct{})}, p); err == nil || err.Error() != "disk full" {
+		t.Fatal("unexpected error", err)
+	}
+}
+
+func TestSpillFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spill")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	s, err := newSpillFile(dir)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer s.remove()
+	long := strings.Repeat("x", 200*1024)
+	for round := 0; round < 2; round++ {
+		s.write([]byte("a\n"))
+		s.write([]byte(long))
+		if line, err := s.read(); err != nil || string(line) != "a\n" {
+			t.Fatal("unexpected line", string(line), err)
+		}
+		s.taken()
+		s.write([]byte("b\n"))
+		for _, want := range []string{long + "\n", "b\n"} {
+			if line, err := s.read(); err != nil || string(line) != want {
+				t.Fatal("unexpected line of", len(line), "bytes", err)
+			}
+			s.taken()
+		}
+		if fi, _ := s.f.Stat(); s.pending != 0 || fi.Size() != 0 {
+			t.Fatal("spill file not emptied", s.pending)
+		}
+	}
+}
@@ -0,0 +1,466 @@
+package main
+
+import (
+	"container/heap"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mitchellh/cli"
+)
+
+// top_capacity bounds the values a topCounter keeps, enough to count every
+// port or IPv4 /16 exactly.
+const top_capacity = 1 << 16
+
+type topEntry struct {
+	Value string `json:"value"`
+	Count uint64 `json:"count"`
+}
+
+type byCount []topEntry
+
+func (b byCount) Len() int      { return len(b) }
+func (b byCount) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b byCount) Less(i, j int) bool {
+	if b[i].Count != b[j].Count {
+		return b[i].Count > b[j].Count
+	}
+	return b[i].Value < b[j].Value
+}
+
+// topItem is a value counted by a topCounter, at index in its heap.
+type topItem struct {
+	value string
+	count uint64
+	index int
+}
+
+// topHeap orders the values of a topCounter least frequent first.
+type topHeap []*topItem
+
+func (h topHeap) Len() int           { return len(h) }
+func (h topHeap) Less(i, j int) bool { return h[i].count < h[j].count }
+func (h topHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index, h[j].index = i, j
+}
+
+func (h *topHeap) Push(x interface{}) {
+	it := x.(*topItem)
+	it.index = len(*h)
+	*h = append(*h, it)
+}
+
+func (h *topHeap) Pop() interface{} {
+	old := *h
+	it := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return it
+}
+
+// topCounter counts values to report the most frequent ones. Once it holds
+// capacity values a new value replaces the least frequent one and takes
+// over its count, as in the Space-Saving algorithm, so frequent values are
+// never lost and memory stays bounded. The values are kept in a min-heap
+// so the least frequent one is found at once.
+type topCounter struct {
+	capacity int
+	counts   map[string]*topItem
+	heap     topHeap
+}
+
+func newTopCounter(capacity int) *topCounter {
+	return &topCounter{capacity: capacity, counts: map[string]*topItem{}}
+}
+
+func (t *topCounter) add(v string) {
+	if len(v) == 0 {
+		return
+	}
+	if it, ok := t.counts[v]; ok {
+		it.count++
+		heap.Fix(&t.heap, it.index)
+		return
+	}
+	if len(t.heap) < t.capacity {
+		it := &topItem{value: v, count: 1}
+		heap.Push(&t.heap, it)
+		t.counts[v] = it
+		return
+	}
+	it := t.heap[0]
+	delete(t.counts, it.value)
+	it.value = v
+	it.count++
+	t.counts[v] = it
+	heap.Fix(&t.heap, 0)
+}
+
+func (t *topCounter) top(n int) []topEntry {
+	entries := make([]topEntry, 0, len(t.heap))
+	for _, it := range t.heap {
+		entries = append(entries, topEntry{it.value, it.count})
+	}
+	sort.Sort(byCount(entries))
+	if len(entries) > n {
+		entries = entries[:n]
+	}
+	return entries
+}
+
+// network returns the /16 of an IPv4 address or the /32 of an IPv6 one.
+func network(ip string) string {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return ""
+	}
+	if v4 := addr.To4(); v4 != nil {
+		return fmt.Sprintf("%d.%d.0.0/16", v4[0], v4[1])
+	}
+	return addr.Mask(net.CIDRMask(32, 128)).String() + "/32"
+}
+
+// streamStats accumulates statistics about the events of a stream. It is
+// safe to report from another goroutine while events are added.
+type streamStats struct {
+	mu   sync.Mutex
+	n    int
+	last time.Time
+
+	events, bytes, errors    uint64
+	errorReasons             map[string]uint64
+	lastEvents, lastBytes    uint64
+	ips                      hyperLogLog
+	ports, modules, networks *topCounter
+	jobs                     *topCounter
+	// stages are the stages of the pipeline, when it runs in stages
+	stages []*stageMetrics
+}
+
+func newStreamStats(n int) *streamStats {
+	return &streamStats{
+		n:        n,
+		last:     time.Now(),
+		ports:    newTopCounter(top_capacity),
+		modules:  newTopCounter(top_capacity),
+		networks: newTopCounter(top_capacity),
+		jobs:     newTopCounter(top_capacity),
+	}
+}
+
+func (s *streamStats) decodeError(reason string) {
+	s.mu.Lock()
+	s.errors++
+	if s.errorReasons == nil {
+		s.errorReasons = map[string]uint64{}
+	}
+	s.errorReasons[reason]++
+	s.mu.Unlock()
+}
+
+func (s *streamStats) add(e event, size int) {
+	ip := e.getString("target.ip")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events++
+	s.bytes += uint64(size)
+	if len(ip) > 0 {
+		s.ips.add(ip)
+		s.networks.add(network(ip))
+	}
+	s.ports.add(e.getString("target.port"))
+	s.modules.add(e.module())
+	s.jobs.add(e.jobID())
+}
+
+type statsTop struct {
+	Ports    []topEntry `json:"ports"`
+	Modules  []topEntry `json:"modules"`
+	Networks []topEntry `json:"networks"`
+	Jobs     []topEntry `json:"jobs"`
+}
+
+// statsReport covers the interval since the previous report, with totals
+// and top values since the start.
+type statsReport struct {
+	Time         time.Time `json:"time"`
+	Interval     float64   `json:"interval"`
+	Events       uint64    `json:"events"`
+	EventsPerSec float64   `json:"events_per_sec"`
+	Bytes        uint64    `json:"bytes"`
+	BytesPerSec  float64   `json:"bytes_per_sec"`
+	TotalEvents  uint64    `json:"total_events"`
+	TotalBytes   uint64    `json:"total_bytes"`
+	DecodeErrors uint64    `json:"decode_errors"`
+	// DecodeErrorReasons counts the decode errors by reason since the start
+	DecodeErrorReasons map[string]uint64 `json:"decode_error_reasons,omitempty"`
+	UniqueIPs          uint64            `json:"unique_ips"`
+	Top                statsTop          `json:"top"`
+	Stages             []stageReport     `json:"stages,omitempty"`
+}
+
+func (s *streamStats) report(now time.Time) statsReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r := statsReport{
+		Time:         now.UTC(),
+		Interval:     now.Sub(s.last).Seconds(),
+		Events:       s.events - s.lastEvents,
+		Bytes:        s.bytes - s.lastBytes,
+		TotalEvents:  s.events,
+		TotalBytes:   s.bytes,
+		DecodeErrors: s.errors,
+		UniqueIPs:    s.ips.count(),
+		Top: statsTop{
+			Ports:    s.ports.top(s.n),
+			Modules:  s.modules.top(s.n),
+			Networks: s.networks.top(s.n),
+			Jobs:     s.jobs.top(s.n),
+		},
+	}
+	for _, m := range s.stages {
+		r.Stages = append(r.Stages, m.report())
+	}
+	if len(s.errorReasons) > 0 {
+		r.DecodeErrorReasons = map[string]uint64{}
+		for reason, n := range s.errorReasons {
+			r.DecodeErrorReasons[reason] = n
+		}
+	}
+	if r.Interval > 0 {
+		r.EventsPerSec = float64(r.Events) / r.Interval
+		r.BytesPerSec = float64(r.Bytes) / r.Interval
+	}
+	s.last, s.lastEvents, s.lastBytes = now, s.events, s.bytes
+	return r
+}
+
+// formatSize renders a byte count with a K, M or G suffix.
+func formatSize(n float64) string {
+	switch {
+	case n >= 1<<30:
+		return strconv.FormatFloat(n/(1<<30), 'f', 1, 64) + "G"
+	case n >= 1<<20:
+		return strconv.FormatFloat(n/(1<<20), 'f', 1, 64) + "M"
+	case n >= 1<<10:
+		return strconv.FormatFloat(n/(1<<10), 'f', 1, 64) + "K"
+	}
+	return strconv.FormatFloat(n, 'f', 0, 64)
+}
+
+func (r statsReport) text() string {
+	lines := []string{fmt.Sprintf("%s  events %d (%.1f/s)  bytes %s (%s/s)  total %d  decode errors %d  unique ips ~%d",
+		r.Time.Format("2006-01-02 15:04:05"), r.Events, r.EventsPerSec, formatSize(float64(r.Bytes)),
+		formatSize(r.BytesPerSec), r.TotalEvents, r.DecodeErrors, r.UniqueIPs)}
+	for _, t := range []struct {
+		name    string
+		entries []topEntry
+	}{
+		{"ports", r.Top.Ports},
+		{"modules", r.Top.Modules},
+		{"networks", r.Top.Networks},
+		{"jobs", r.Top.Jobs},
+	} {
+		if len(t.entries) == 0 {
+			continue
+		}
+		values := make([]string, len(t.entries))
+		for i, e := range t.entries {
+			values[i] = fmt.Sprintf("%s (%d)", e.Value, e.Count)
+		}
+		lines = append(lines, fmt.Sprintf("  %-9s %s", t.name, strings.Join(values, "  ")))
+	}
+	for _, st := range r.Stages {
+		line := fmt.Sprintf("  %-9s depth %d (max %d)  wait %.1fms (max %.1fms)  busy %.2fms",
+			st.Name, st.Depth, st.MaxDepth, st.AvgWaitMs, st.MaxWaitMs, st.AvgBusyMs)
+		if st.Dropped > 0 || st.Spilled > 0 {
+			line += fmt.Sprintf("  dropped %d  spilled %d", st.Dropped, st.Spilled)
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// statsReporter writes a report of stats to w every interval, and a last
+// one when closed.
+type statsReporter struct {
+	stats *streamStats
+	w     io.Writer
+	json  bool
+	stop  chan struct{}
+	done  chan struct{}
+	once  sync.Once
+}
+
+func newStatsReporter(stats *streamStats, w io.Writer, interval time.Duration, asJSON bool) *statsReporter {
+	r := &statsReporter{
+		stats: stats,
+		w:     w,
+		json:  asJSON,
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	go func() {
+		defer close(r.done)
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-r.stop:
+				return
+			case now := <-t.C:
+				r.write(now)
+			}
+		}
+	}()
+	return r
+}
+
+func (r *statsReporter) write(now time.Time) error {
+	report := r.stats.report(now)
+	if r.json {
+		byts, err := json.Marshal(report)
+		if err != nil {
+			return err
+		}
+		_, err = r.w.Write(append(byts, '\n'))
+		return err
+	}
+	_, err := io.WriteString(r.w, report.text())
+	return err
+}
+
+func (r *statsReporter) Close() error {
+	var err error
+	r.once.Do(func() {
+		close(r.stop)
+		<-r.done
+		err = r.write(time.Now())
+	})
+	return err
+}
+
+type StatsCommand struct {
+	client  http.Client
+	output  io.Writer
+	config  map[string]interface{}
+	verbose bool
+}
+
+func (s *StatsCommand) Run(args []string) int {
+	fs := flag.NewFlagSet("stats", flag.ContinueOnError)
+	token := fs.String("token", "", "token for authenticating with api")
+	firehose := fs.Bool("firehose", false, "read the firehose instead of the user's stream")
+	jobID := fs.String("job-id", "", "only count events of this job, \"last\" or a label from the job history")
+	filter := fs.String("filter", "", "only count events matching this expression")
+	interval := fs.Duration("interval", 10*time.Second, "time between reports")
+	top := fs.Int("top", 10, "number of top values shown")
+	asJSON := fs.Bool("json", false, "print each report as a JSON object")
+	verbose := fs.Bool("verbose", false, "show request and response")
+	if err := fs.Parse(args); err != nil {
+		return -1
+	}
+	s.verbose = *verbose
+	if len(*token) == 0 {
+		if tok, ok := s.config["token"].(string); ok && len(tok) > 0 {
+			*token = tok
+		} else {
+			fmt.Println(s.Help())
+			return -1
+		}
+	}
+	if *interval <= 0 {
+		fmt.Fprintln(os.Stderr, "interval must be positive")
+		return -1
+	}
+	id, err := resolveJobID(historyPath(), *jobID)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to resolve job", err.Error())
+		return -1
+	}
+	p := &pipeline{output: ioutil.Discard}
+	if err := p.filterBy(id, *filter); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return -1
+	}
+	p.withStats(s.output, *interval, *top, *asJSON)
+	defer p.close()
+	p.closeOnInterrupt()
+
+	url := s.config["stream_url"].(string)
+	if *firehose {
+		url = s.config["firehose_url"].(string)
+	}
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to connect", err.Error())
+		return -1
+	}
+	req.Header.Add("X-Token", *token)
+	s.print("Request: %v\n", req)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to connect", err.Error())
+		return -1
+	}
+	defer resp.Body.Close()
+	s.print("Response: %v\n", resp)
+	if resp.StatusCode == 401 {
+		fmt.Fprintln(os.Stderr, "Invalid credentials")
+		return -1
+	}
+	err = readFromResponse(resp.Body, p)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to read stream", err.Error())
+	}
+	if cerr := p.close(); cerr != nil {
+		fmt.Fprintln(os.Stderr, "Failed to write stats", cerr.Error())
+		return -1
+	}
+	if err != nil {
+		return -1
+	}
+	return 0
+}
+
+func (s *StatsCommand) print(pattern string, v interface{}) {
+	if s.verbose {
+		fmt.Fprintf(os.Stderr, pattern, v)
+	}
+}
+
+func (s *StatsCommand) Synopsis() string {
+	return "Print live statistics of the stream or the firehose"
+}
+
+func (s *StatsCommand) Help() string {
+	return `
+Usage: 40fy-client stats -token=TOKEN [-firehose] [-job-id=JOBID] [-filter=FILTER] [-interval=10s] [-top=10] [-json]
+
+ Reads the stream, or the firehose with -firehose, and every INTERVAL prints the events and bytes per second,
+ the decode errors, an estimate of the unique IPs and the TOP most frequent ports, modules, /16 networks and
+ job ids seen so far. A last report is printed when the stream ends or on interrupt.
+ The "JOB-ID" and "FILTER" parameters restrict the events counted, as for stream.
+ The "json" flag prints every report as a JSON object on one line, for graphing.
+	`
+}
+
+func StatsCommandFactory() (cli.Command, error) {
+	s := &StatsCommand{
+		client: http.Client{},
+		output: os.Stdout,
+	}
+	s.config = loadConfig()
+	return s, nil
+}
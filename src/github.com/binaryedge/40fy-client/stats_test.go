@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestHyperLogLog(t *testing.T) {
+	for _, n := range []int{10, 1000, 100000} {
+		var h hyperLogLog
+		for i := 0; i < n; i++ {
+			ip := fmt.Sprintf("%d.%d.%d.%d", i>>24&255, i>>16&255, i>>8&255, i&255)
+			h.add(ip)
+			h.add(ip)
+		}
+		if got := float64(h.count()); math.Abs(got-float64(n))/float64(n) > 0.03 {
+			t.Error("estimated", got, "unique values of", n)
+		}
+	}
+}
+
+func TestTopCounter(t *testing.T) {
+	c := newTopCounter(3)
+	for _, v := range []string{"22", "22", "22", "80", "80", "443", "8080", "22"} {
+		c.add(v)
+	}
+	top := c.top(2)
+	if len(top) != 2 || top[0] != (topEntry{"22", 4}) || top[1].Value != "8080" && top[1].Value != "80" {
+		t.Fatal("unexpected top", top)
+	}
+	if len(c.counts) != 3 {
+		t.Fatal("counter grew to", len(c.counts))
+	}
+
+	// a frequent value survives many rare ones
+	c = newTopCounter(100)
+	for i := 0; i < 100000; i++ {
+		c.add(strconv.Itoa(i))
+		if i%10 == 0 {
+			c.add("frequent")
+		}
+	}
+	if top := c.top(1); top[0].Value != "frequent" || top[0].Count < 10000 {
+		t.Fatal("unexpected top", top)
+	}
+	if len(c.counts) != 100 || len(c.heap) != 100 {
+		t.Fatal("counter grew to", len(c.counts))
+	}
+}
+
+func TestPipelineStats(t *testing.T) {
+	var out bytes.Buffer
+	p := &pipeline{output: ioutil.Discard}
+	if err := p.filterBy("", "port != 25"); err != nil {
+		t.Fatal(err.Error())
+	}
+	p.withStats(&out, time.Hour, 1, true)
+	for _, l := range []string{
+		`{"origin":{"type":"ssh","job_id":"j1"},"target":{"ip":"10.1.0.1","port":22}}`,
+		`{"origin":{"type":"ssh","job_id":"j1"},"target":{"ip":"10.1.0.2","port":22}}`,
+		`{"origin":{"type":"http","job_id":"j2"},"target":{"ip":"10.2.0.1","port":80}}`,
+		`{"origin":{"type":"smtp","job_id":"j2"},"target":{"ip":"10.2.0.1","port":25}}`,
+		`{"origin":`,
+	} {
+		p.handle([]byte(l + "\n"))
+	}
+	p.close()
+	var r statsReport
+	if err := json.Unmarshal(out.Bytes(), &r); err != nil {
+		t.Fatal(err.Error(), out.String())
+	}
+	if r.Events != 3 || r.DecodeErrors != 1 || r.UniqueIPs != 3 {
+		t.Fatal("unexpected counts", out.String())
+	}
+	want := statsTop{
+		Ports:    []topEntry{{"22", 2}},
+		Modules:  []topEntry{{"ssh", 2}},
+		Networks: []topEntry{{"10.1.0.0/16", 2}},
+		Jobs:     []topEntry{{"j1", 2}},
+	}
+	if fmt.Sprint(r.Top) != fmt.Sprint(want) {
+		t.Fatal("unexpected top", r.Top)
+	}
+}
@@ -1,13 +1,12 @@
 package main
 
 import (
-	"bufio"
-	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
+	"time"
 
 	"github.com/mitchellh/cli"
 )
@@ -22,11 +21,47 @@ type StreamCommand struct {
 func (s *StreamCommand) Run(args []string) int {
 	stream := flag.NewFlagSet("stream", flag.ContinueOnError)
 	token := stream.String("token", "", "token for authenticating with api")
-	jobID := stream.String("job-id", "", "id of job that was created")
+	var jobIDs, jobLists stringList
+	stream.Var(&jobIDs, "job-id", "id of job that was created, \"last\", a label or label:NAME for every job with it, may be given more than once")
+	stream.Var(&jobLists, "job-ids", "comma separated job ids, or @FILE with one id per line")
+	jobOutputFile := stream.String("job-output", "", "also write the results of every job to files named after this pattern, {job} is the job id")
 	verbose := stream.Bool("verbose", false, "show request and response")
+	save := stream.Bool("save", false, "also append the results of the job to ~/.binaryedge/results/ for diff")
+	wait := stream.Bool("wait", false, "exit once the platform reports the job finished")
+	poll := stream.Duration("poll", 30*time.Second, "how often the job status is checked with -wait")
+	sample := stream.Int("sample", 0, "exit once this many results were received")
+	maxResults := stream.Int("max-results", 0, "exit after at most this many results")
+	idle := stream.Duration("idle-timeout", 0, "exit when no results were received for this long")
+	timeout := stream.Duration("timeout", 0, "give up and exit with an error after this long")
+	resume := stream.Bool("resume", false, "keep a checkpoint of the stream in ~/.binaryedge/checkpoints/ and resume from it")
+	showCP := stream.Bool("show-checkpoint", false, "print the checkpoint of the stream and exit")
+	flags := addStreamFlags(stream)
+	flags.config = s.config
 	if err := stream.Parse(args); err != nil {
 		return -1
 	}
+	jobs := &jobSet{}
+	if refs := jobRefs(jobIDs, jobLists); len(refs) > 0 {
+		h, err := openHistory(historyPath())
+		if err == nil {
+			jobs, err = resolveJobSet(h, refs)
+		}
+		if err != nil {
+			fmt.Println("Failed to resolve job ", err.Error())
+			return -1
+		}
+	}
+	streamURL := s.config["stream_url"].(string)
+	name, cpPath := subscription(streamURL, jobs.ids)
+	if *showCP {
+		cp, err := loadCheckpoint(cpPath)
+		if err != nil {
+			fmt.Println("Failed to read checkpoint ", err.Error())
+			return -1
+		}
+		showCheckpoint(s.output, name, cpPath, cp, time.Now())
+		return 0
+	}
 	// read file, load to token
 	if len(*token) == 0 {
 		if tok, ok := s.config["token"].(string); ok && len(tok) > 0 {
@@ -37,11 +72,111 @@ func (s *StreamCommand) Run(args []string) int {
 		}
 	}
 	s.verbose = *verbose
-	req, err := http.NewRequest("GET", s.config["stream_url"].(string), nil)
+	cp := checkpoint{Subscription: name, URL: streamURL, Jobs: jobs.ids, DedupeKey: *flags.dedupeKey}
+	var (
+		key     func(e event) uint64
+		overlap predicate
+	)
+	if *resume {
+		var err error
+		if key, err = dedupeKeyOf(cp.DedupeKey); err != nil {
+			fmt.Println(err.Error())
+			return -1
+		}
+		last, err := loadCheckpoint(cpPath)
+		if err != nil {
+			fmt.Println("Failed to read checkpoint ", err.Error())
+			return -1
+		}
+		if last != nil {
+			cp.LastEvent, cp.Events = last.LastEvent, last.Events
+			if last.DedupeKey == cp.DedupeKey {
+				cp.Recent = last.Recent
+			}
+			if param, _ := s.config["stream_resume_param"].(string); len(param) > 0 {
+				if streamURL, err = resumeURL(streamURL, param, last); err != nil {
+					fmt.Println("Failed to resume ", err.Error())
+					return -1
+				}
+				fmt.Fprintf(os.Stderr, "Resuming the stream of %s from %s\n", name, last.LastEvent.Format(time.RFC3339))
+			} else {
+				// the stream starts with what it has now, drop what was already written
+				lastKey, err := dedupeKeyOf(last.DedupeKey)
+				if err != nil {
+					fmt.Println("Failed to read checkpoint ", err.Error())
+					return -1
+				}
+				overlap = last.overlap(lastKey, *flags.dedupeWindow, time.Now)
+				fmt.Fprintf(os.Stderr, "Resuming the stream of %s after %s, dropping the events already written\n",
+					name, last.LastEvent.Format(time.RFC3339))
+			}
+		}
+	}
+	p, err := flags.build(s.output, jobs.ids...)
+	if err != nil {
+		fmt.Println(err.Error())
+		return -1
+	}
+	defer p.close()
+	if *resume {
+		if overlap != nil {
+			p.filters = append([]predicate{overlap}, p.filters...)
+		}
+		c := newCheckpointer(cpPath, cp, key, *flags.dedupeWindow, checkpoint_interval, os.Stderr)
+		p.written = c.observe
+		p.closers = append(p.closers, c)
+	}
+	if len(jobs.ids) > 1 {
+		p.tag = jobs.tag
+	}
+	if *save && len(jobs.ids) > 0 {
+		p.addSink(newJobRouter(func(id string) (io.WriteCloser, error) {
+			f, err := openResults(id)
+			if err != nil {
+				return nil, err
+			}
+			return f, nil
+		}))
+	}
+	if len(*jobOutputFile) > 0 {
+		r, err := jobOutput(*jobOutputFile)
+		if err != nil {
+			fmt.Println(err.Error())
+			return -1
+		}
+		p.addSink(r)
+	}
+	p.closeOnInterrupt()
+	var done *completionGroup
+	if *wait || *sample > 0 || *maxResults > 0 || *idle > 0 || *timeout > 0 {
+		var status func(id string) func() (string, error)
+		if *wait {
+			jc := &jobCommand{client: s.client, output: os.Stderr, config: s.config, verbose: s.verbose}
+			status = func(id string) func() (string, error) { return jobStatus(jc, *token, id) }
+		}
+		done = newCompletionGroup(jobs.ids, completionOptions{
+			sample:     *sample,
+			maxResults: *maxResults,
+			idle:       *idle,
+			timeout:    *timeout,
+			poll:       *poll,
+		}, status)
+		p.filters = append(p.filters, done.observe)
+	}
+	req, err := http.NewRequest("GET", streamURL, nil)
 	if err != nil {
 		fmt.Println("Failed to connect ", err.Error())
 		return -1
 	}
+	if len(jobs.ids) > 0 {
+		// the stream may send only the results of the jobs, they are still
+		// filtered here for streams that send everything
+		q := req.URL.Query()
+		for _, id := range jobs.ids {
+			q.Add("job_id", id)
+		}
+		req.URL.RawQuery = q.Encode()
+	}
 	req.Header.Add("X-Token", *token)
 	s.print("Request: %v\n", req)
 	resp, err := s.client.Do(req)
@@ -55,10 +190,33 @@ func (s *StreamCommand) Run(args []string) int {
 		fmt.Println(`Invalid credentials`)
 		return -1
 	}
-	if len(*jobID) == 0 {
-		io.Copy(s.output, resp.Body)
-	} else {
-		readFromResponse(resp.Body, *jobID)
+	if done != nil {
+		go done.run(func() { resp.Body.Close() })
+	}
+	err = readFromResponse(resp.Body, p)
+	if done != nil && done.stopped() {
+		// the stream was closed once the jobs were done
+		err = nil
+	}
+	failed := err != nil
+	if failed {
+		fmt.Println("Failed to read stream ", err.Error())
+	}
+	if done != nil {
+		// jobs still running when the stream ended did not finish
+		if err != nil {
+			done.finish("stream failed", true, err)
+		} else {
+			done.finish("stream ended", false, nil)
+		}
+		fmt.Fprint(os.Stderr, done.summary())
+	}
+	if err := p.close(); err != nil {
+		fmt.Println("Failed to close output ", err.Error())
+		return -1
+	}
+	if failed || done != nil && !done.succeeded() {
+		return -1
 	}
 	return 0
 }
@@ -69,22 +227,30 @@ func (s *StreamCommand) print(pattern string, v interface{}) {
 	}
 }
 
-type msg struct {
-	Origin origin `json:"origin"`
-}
-
-type origin struct {
-	JobID string `json:"job_id"`
-}
-
-func readFromResponse(body io.ReadCloser, jobid string) {
-	buf := bufio.NewReader(body)
-	msg := &msg{}
+// readFromResponse feeds the stream to the pipeline line by line until the
+// stream ends or the pipeline fails to write. Lines longer than the limit of
+// the pipeline are rejected without being read into memory.
+func readFromResponse(body io.Reader, p *pipeline) error {
+	if p.stages != nil {
+		return p.stages.run(body, p)
+	}
+	lines := newLineReader(body, p.maxLine)
 	for {
-		byts, _ := buf.ReadBytes('\n')
-		json.Unmarshal(byts, msg)
-		if jobid == msg.Origin.JobID {
-			fmt.Println(string(byts))
+		byts, tooLong, err := lines.next()
+		if tooLong {
+			if rerr := p.reject(byts, reason_too_long); rerr != nil {
+				return rerr
+			}
+		} else if len(byts) > 0 {
+			if werr := p.handle(byts); werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
 		}
 	}
 }
@@ -93,11 +259,32 @@ func (s *StreamCommand) Synopsis() string { return "receive stream from api" }
 
 func (s *StreamCommand) Help() string {
 	return `
-Usage: 40fy-client stream -token=TOKEN [-job-id=JOBID]
+Usage: 40fy-client stream -token=TOKEN [-job-id=JOBID]... [-job-ids=JOBIDS|@FILE] [-job-output=PATTERN] [-save] [-wait] [-sample=N] [-max-results=N] [-idle-timeout=DURATION] [-timeout=DURATION] [-resume] [-show-checkpoint] [OUTPUT OPTIONS]
 
  The "TOKEN" parameter is the token given to you by BinaryEdge, it is used as authentication.
  The "JOB-ID" parameter is optional, if it is present then the stream will be filtered for this specific job.
-	`
+ It can also be "last" or a label, which selects the most recent matching job from the local job history,
+ or label:NAME, which selects every job carrying the label, for example a batch of jobs created together.
+ It may be given more than once to follow several jobs, "JOBIDS" adds a comma separated list or the ids
+ listed in FILE, one per line. With several jobs every line is tagged with a "job" object holding the
+ id and labels of its job.
+ The "PATTERN" parameter also writes the results of every job as received to a file of its own, with {job}
+ replaced by the job id, for example results/{job}.ndjson.gz. Job ids other than letters, digits, _ and -
+ stop the stream rather than name a file.
+ The "save" flag also appends the results of every job to ~/.binaryedge/results/JOBID.ndjson, to be compared with diff.
+ Without the following the stream is read until it is closed, with them it ends once the job is done,
+ or every job is done, and a summary of the results of every job is printed to stderr:
+ The "wait" flag polls the status of the job every -poll (default 30s) and ends once it is finished.
+ The "sample" parameter ends once N results were received, "max-results" also shows no more than N.
+ The "idle-timeout" parameter ends when no results were received for DURATION, these all exit with 0.
+ The "timeout" parameter gives up after DURATION and exits with an error.
+ The "resume" flag keeps the time of the latest event written for the stream of these jobs in a checkpoint in
+ ~/.binaryedge/checkpoints/, with the -dedupe-key of the events written within -dedupe-window (default 1h),
+ and resumes from it when started again. If stream_resume_param is set in the config the stream is asked for
+ the events from the checkpoint on with that query parameter, in milliseconds, otherwise the events already
+ written are dropped for -dedupe-window after the restart, events that were not written still pass.
+ The "show-checkpoint" flag prints the checkpoint of the stream of these jobs and exits.
+` + streamFlagsHelp
 }
 
 func StreamCommandFactory() (cli.Command, error) {
@@ -105,15 +292,6 @@ func StreamCommandFactory() (cli.Command, error) {
 		client: http.Client{},
 		output: os.Stdout,
 	}
-	if contents, err := GetConfigContents(config_file_name); err == nil {
-		s.config = contents
-	} else {
-		s.config = DefaultConfig
-	}
-	for k, v := range DefaultConfig {
-		if _, ok := s.config[k]; !ok {
-			s.config[k] = v
-		}
-	}
+	s.config = loadConfig()
 	return s, nil
 }
@@ -2,12 +2,18 @@ package main
 
 import (
 	"bytes"
+	"flag"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 var (
@@ -16,11 +22,23 @@ var (
 	cmdWithJobID   = []string{"-token=" + token, "-job-id=" + jobID}
 	cmd            = []string{"-token=" + token}
 	serverResponse = []byte("test")
+	jobResult      = []byte(`{"origin":{"job_id":"1234"},"target":{"ip":"8.8.8.8","port":80}}` + "\n")
+	otherResult    = []byte(`{"origin":{"job_id":"4321"},"target":{"ip":"1.1.1.1","port":80}}` + "\n")
 )
 
+func testConfig(url, tok string) map[string]interface{} {
+	return map[string]interface{}{
+		"stream_url":   url,
+		"firehose_url": url,
+		"job_url":      url,
+		"token":        tok,
+	}
+}
+
 func TestCmdWithJobID(t *testing.T) {
 	handler := func(w http.ResponseWriter, r *http.Request) {
-		w.Write(serverResponse)
+		w.Write(otherResult)
+		w.Write(jobResult)
 		if h := r.Header.Get("X-Token"); h != token {
 			t.Fatal("Token is different", h, " != ", token)
 		}
@@ -32,13 +50,13 @@ func TestCmdWithJobID(t *testing.T) {
 	defer server.Close()
 
 	buffer := bytes.NewBuffer([]byte{})
-	c := StreamCommand{http.Client{}, server.URL, buffer, ""}
+	c := StreamCommand{http.Client{}, buffer, testConfig(server.URL, ""), false}
 
 	if status := c.Run(cmdWithJobID); status != 0 {
 		t.Fatal("Status not 0", status, " != ", 0)
 	}
-	if !reflect.DeepEqual(buffer.Bytes(), serverResponse) {
-		t.Fatal("Server Response is different ", buffer.Bytes(), " != ", serverResponse)
+	if !reflect.DeepEqual(buffer.Bytes(), jobResult) {
+		t.Fatal("Server Response is different ", buffer.String(), " != ", string(jobResult))
 	}
 
 }
@@ -58,7 +76,7 @@ func TestCmdWithoutJobID(t *testing.T) {
 	defer server.Close()
 
 	buffer := bytes.NewBuffer([]byte{})
-	c := StreamCommand{http.Client{}, server.URL, buffer, ""}
+	c := StreamCommand{http.Client{}, buffer, testConfig(server.URL, ""), false}
 
 	if status := c.Run(cmd); status != 0 {
 		t.Fatal("Status not 0 ", status, " != ", 0)
@@ -71,13 +89,9 @@ func TestCmdWithoutJobID(t *testing.T) {
 func TestCmdWithoutToken(t *testing.T) {
 	handler := func(w http.ResponseWriter, r *http.Request) {
 		w.Write(serverResponse)
-		if h := r.Header.Get("X-Token"); len(h) > 0 && h != token {
+		if h := r.Header.Get("X-Token"); h != token {
 			t.Fatal("Token is different", h, " != ", token)
 		}
-		t.Log("url ", r.URL)
-		if jobid := r.URL.Query().Get("job_id"); jobid != "" {
-			t.Fatal("URL doesnt contain jobID ", jobid)
-		}
 	}
 	server := httptest.NewServer(http.HandlerFunc(handler))
 	defer server.Close()
@@ -89,10 +103,176 @@ func TestCmdWithoutToken(t *testing.T) {
 	}
 	defer os.Remove(file.Name())
 
-	file.Write([]byte(token))
+	fmt.Fprintf(file, "token = %q\nstream_url = %q\n", token, server.URL)
+	file.Close()
+	config, err := GetConfigContents(file.Name())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
 
-	c := StreamCommand{http.Client{}, server.URL, buffer, file.Name()}
+	c := StreamCommand{http.Client{}, buffer, config, false}
 	if status := c.Run([]string{}); status != 0 {
 		t.Fatal("Status should be 0 ", status, " != ", 0)
 	}
 }
+
+func TestCmdWithFields(t *testing.T) {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		w.Write(otherResult)
+		w.Write(jobResult)
+	}
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+
+	buffer := bytes.NewBuffer([]byte{})
+	c := StreamCommand{http.Client{}, buffer, testConfig(server.URL, token), false}
+	if status := c.Run([]string{"-filter=port == 80", "-fields=target.ip,target.port,result.data.banner=none", "-delimiter=,"}); status != 0 {
+		t.Fatal("Status not 0 ", status, " != ", 0)
+	}
+	if want := "1.1.1.1,80,none\n8.8.8.8,80,none\n"; buffer.String() != want {
+		t.Fatal("Projection is different ", buffer.String(), " != ", want)
+	}
+
+	buffer.Reset()
+	if status := c.Run([]string{"-job-id=" + jobID, "-fields=target.ip,target.port,result.data.banner"}); status != 0 {
+		t.Fatal("Status not 0 ", status, " != ", 0)
+	}
+	if want := `{"target.ip":"8.8.8.8","target.port":80,"result.data.banner":null}` + "\n"; buffer.String() != want {
+		t.Fatal("Projection is different ", buffer.String(), " != ", want)
+	}
+}
+
+func TestCmdWithFormat(t *testing.T) {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		w.Write(otherResult)
+		w.Write(jobResult)
+	}
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+
+	buffer := bytes.NewBuffer([]byte{})
+	c := StreamCommand{http.Client{}, buffer, testConfig(server.URL, token), false}
+	formats := map[string]string{
+		"csv":    "target.ip,target.port\n1.1.1.1,80\n8.8.8.8,80\n",
+		"tsv":    "target.ip\ttarget.port\n1.1.1.1\t80\n8.8.8.8\t80\n",
+		"table":  "target.ip  target.port\n1.1.1.1    80\n8.8.8.8    80\n",
+		"ndjson": `{"target.ip":"1.1.1.1","target.port":80}` + "\n" + `{"target.ip":"8.8.8.8","target.port":80}` + "\n",
+	}
+	for format, want := range formats {
+		buffer.Reset()
+		if status := c.Run([]string{"-format=" + format, "-fields=target.ip,target.port"}); status != 0 {
+			t.Fatal("Status not 0 ", status, " != ", 0)
+		}
+		if buffer.String() != want {
+			t.Fatal(format, "output is different ", buffer.String(), " != ", want)
+		}
+	}
+}
+
+func TestCmdWriteFailure(t *testing.T) {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		w.Write(jobResult)
+	}
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+	config := testConfig(server.URL, token)
+	if status := (&StreamCommand{http.Client{}, failingWriter{}, config, false}).Run(cmdWithJobID); status != -1 {
+		t.Fatal("stream status", status)
+	}
+	if status := (&FirehoseCommand{http.Client{}, failingWriter{}, config, false}).Run(cmd); status != -1 {
+		t.Fatal("firehose status", status)
+	}
+}
+
+func TestBuildClosesOnError(t *testing.T) {
+	for _, args := range [][]string{
+		{"-fields=target.ip,=80"},
+		{"-format=cef", "-field-map=/nonexistent.toml"},
+	} {
+		dir, err := ioutil.TempDir("", "build")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		defer os.RemoveAll(dir)
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		flags := addStreamFlags(fs)
+		fs.Parse(append([]string{"-output-file=" + filepath.Join(dir, "out.ndjson")}, args...))
+		if _, err := flags.build(ioutil.Discard); err == nil {
+			t.Fatal("built with", args)
+		}
+		names, _ := filepath.Glob(filepath.Join(dir, "*.part"))
+		if len(names) > 0 {
+			t.Fatal("output left open with", args, names)
+		}
+	}
+}
+
+func TestTableFormat(t *testing.T) {
+	proj, err := parseProjection("a,b", "")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	var buf bytes.Buffer
+	f, err := newFormatter("table", &buf, formatOptions{proj: proj, maxWidth: 8})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	f.write(event{"a": "x", "b": "1"}, nil)
+	f.write(event{"a": "longer", "b": "2"}, nil)
+	if buf.Len() > 0 {
+		t.Fatal("rows printed before the columns were sized", buf.String())
+	}
+	for i := 2; i < table_sample_rows; i++ {
+		f.write(event{"a": "x", "b": "3"}, nil)
+	}
+	f.write(event{"a": "much longer", "b": "4"}, nil)
+	lines := strings.Split(buf.String(), "\n")
+	if lines[0] != "a       b" || lines[1] != "x       1" || lines[2] != "longer  2" || lines[table_sample_rows+1] != "much …  4" {
+		t.Fatal("unexpected table", buf.String())
+	}
+	// the rows of a slow stream are printed after table_sample_wait
+	buf.Reset()
+	f, _ = newFormatter("table", &buf, formatOptions{proj: proj})
+	f.write(event{"a": "x", "b": "1"}, nil)
+	time.Sleep(table_sample_wait + 100*time.Millisecond)
+	f.(io.Closer).Close()
+	if buf.String() != "a  b\nx  1\n" {
+		t.Fatal("unexpected table", buf.String())
+	}
+}
+
+func TestCmdStopsAtSample(t *testing.T) {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 3; i++ {
+			w.Write(jobResult)
+		}
+		w.(http.Flusher).Flush()
+		// keep the stream open like the platform does
+		<-w.(http.CloseNotifier).CloseNotify()
+	}
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+
+	buffer := bytes.NewBuffer([]byte{})
+	c := StreamCommand{http.Client{}, buffer, testConfig(server.URL, ""), false}
+	if status := c.Run(append(cmdWithJobID, "-sample=2", "-timeout=10s")); status != 0 {
+		t.Fatal("Status not 0", status)
+	}
+	if want := append(append([]byte{}, jobResult...), jobResult...); !reflect.DeepEqual(buffer.Bytes(), want) {
+		t.Fatal("Unexpected output", buffer.String())
+	}
+}
+
+func TestCmdTimeout(t *testing.T) {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		w.(http.Flusher).Flush()
+		<-w.(http.CloseNotifier).CloseNotify()
+	}
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+
+	c := StreamCommand{http.Client{}, bytes.NewBuffer([]byte{}), testConfig(server.URL, ""), false}
+	if status := c.Run(append(cmdWithJobID, "-timeout=1s")); status == 0 {
+		t.Fatal("Status 0 after timeout")
+	}
+}
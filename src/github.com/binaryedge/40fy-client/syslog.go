@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+func init() {
+	registerSink("syslog", newSyslogSink)
+}
+
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5, "lpr": 6, "news": 7,
+	"uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11, "local0": 16, "local1": 17, "local2": 18,
+	"local3": 19, "local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+var syslogSeverities = map[string]int{
+	"emerg": 0, "alert": 1, "crit": 2, "err": 3, "warning": 4, "notice": 5, "info": 6, "debug": 7,
+}
+
+// syslogSink sends events as RFC 5424 syslog messages.
+//
+//	syslog[+udp|+tcp|+tls]://host:514[?format=cef&facility=local0&severity=notice&app_name=40fy-client&field_map=FILE&ca=FILE&insecure=true&retries=5]
+//
+// The payload is written with one of the output formats, cef by default.
+// Over udp every message is a datagram, over tcp and tls messages are framed
+// with their length as in RFC 6587. Stream connections are opened again
+// when a write fails.
+type syslogSink struct {
+	network  string
+	addr     string
+	tls      *tls.Config
+	pri      int
+	hostname string
+	appName  string
+	retries  int
+
+	conn    net.Conn
+	buf     bytes.Buffer
+	payload formatter
+}
+
+func newSyslogSink(u *url.URL) (sink, error) {
+	if len(u.Host) == 0 {
+		return nil, fmt.Errorf("syslog sink needs a host")
+	}
+	q := u.Query()
+	s := &syslogSink{
+		network: transport(u, "udp"),
+		addr:    u.Host,
+		appName: "40fy-client",
+		retries: 5,
+	}
+	if _, _, err := net.SplitHostPort(s.addr); err != nil {
+		s.addr = net.JoinHostPort(s.addr, "514")
+	}
+	switch s.network {
+	case "udp", "tcp":
+	case "tls":
+		s.network = "tcp"
+		s.tls = &tls.Config{InsecureSkipVerify: q.Get("insecure") == "true"}
+		if ca := q.Get("ca"); len(ca) > 0 {
+			pem, err := ioutil.ReadFile(ca)
+			if err != nil {
+				return nil, err
+			}
+			s.tls.RootCAs = x509.NewCertPool()
+			if !s.tls.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates found in %s", ca)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unknown syslog transport %q, use udp, tcp or tls", s.network)
+	}
+
+	facility, severity := syslogFacilities["local0"], syslogSeverities["notice"]
+	if v := q.Get("facility"); len(v) > 0 {
+		var ok bool
+		if facility, ok = syslogFacilities[v]; !ok {
+			return nil, fmt.Errorf("unknown syslog facility %q", v)
+		}
+	}
+	if v := q.Get("severity"); len(v) > 0 {
+		var ok bool
+		if severity, ok = syslogSeverities[v]; !ok {
+			return nil, fmt.Errorf("unknown syslog severity %q", v)
+		}
+	}
+	s.pri = facility*8 + severity
+	if v := q.Get("app_name"); len(v) > 0 {
+		s.appName = v
+	}
+	if v := q.Get("retries"); len(v) > 0 {
+		var err error
+		if s.retries, err = strconv.Atoi(v); err != nil {
+			return nil, fmt.Errorf("invalid retries %q", v)
+		}
+	}
+	s.hostname, _ = os.Hostname()
+	if len(s.hostname) == 0 {
+		s.hostname = "-"
+	}
+
+	format := q.Get("format")
+	if len(format) == 0 {
+		format = "cef"
+	}
+	var err error
+	if s.payload, err = newFormatter(format, &s.buf, formatOptions{fieldMap: q.Get("field_map")}); err != nil {
+		return nil, err
+	}
+	if err = s.connect(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *syslogSink) connect() error {
+	var err error
+	if s.tls != nil {
+		s.conn, err = tls.DialWithDialer(&net.Dialer{Timeout: 10 * time.Second}, s.network, s.addr, s.tls)
+	} else {
+		s.conn, err = net.DialTimeout(s.network, s.addr, 10*time.Second)
+	}
+	return err
+}
+
+// syslog_time_format is RFC 3339 with at most the 6 fractional digits RFC
+// 5424 allows.
+const syslog_time_format = "2006-01-02T15:04:05.999999Z07:00"
+
+// message formats e as an RFC 5424 message with the time of the event.
+func (s *syslogSink) message(e event, line []byte) ([]byte, error) {
+	s.buf.Reset()
+	if err := s.payload.write(e, line); err != nil {
+		return nil, err
+	}
+	msg := bytes.TrimRight(s.buf.Bytes(), "\r\n")
+	header := fmt.Sprintf("<%d>1 %s %s %s - - - ", s.pri, e.time().Format(syslog_time_format), s.hostname, s.appName)
+	if s.network == "tcp" {
+		header = strconv.Itoa(len(header)+len(msg)) + " " + header
+	}
+	return append([]byte(header), msg...), nil
+}
+
+func (s *syslogSink) send(e event, line []byte) error {
+	msg, err := s.message(e, line)
+	if err != nil {
+		return err
+	}
+	if err := s.write(msg); err != nil {
+		fmt.Fprintln(os.Stderr, "Syslog: dropped event:", err.Error())
+	}
+	return nil
+}
+
+// sendAck sends the event and calls ack with the error when the server
+// could not be reached, so a queue sends it again.
+func (s *syslogSink) sendAck(e event, line []byte, ack func(err error)) error {
+	msg, err := s.message(e, line)
+	if err != nil {
+		return err
+	}
+	ack(s.write(msg))
+	return nil
+}
+
+// write sends msg, reconnecting up to retries times.
+func (s *syslogSink) write(msg []byte) error {
+	var err error
+	b := newBackoff(200*time.Millisecond, 10*time.Second)
+	for attempt := 0; ; attempt++ {
+		if s.conn == nil {
+			err = s.connect()
+		}
+		if s.conn != nil {
+			if _, err = s.conn.Write(msg); err == nil {
+				return nil
+			}
+			s.conn.Close()
+			s.conn = nil
+		}
+		if attempt >= s.retries {
+			return err
+		}
+		time.Sleep(b.next())
+	}
+}
+
+func (s *syslogSink) close() error {
+	if s.conn == nil {
+		return nil
+	}
+	return s.conn.Close()
+}
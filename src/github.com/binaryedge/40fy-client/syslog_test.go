@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const siemEvent = `{"origin":{"type":"ssh","job_id":"j1","ts":1456790400000},"target":{"ip":"10.0.0.1","port":22,"protocol":"tcp"},"result":{"data":{"banner":"SSH-2.0-OpenSSH_7.2 a=b|c"}}}`
+
+func TestCEFFormat(t *testing.T) {
+	e, _ := decodeEvent([]byte(siemEvent))
+	var buf bytes.Buffer
+	f, err := newFormatter("cef", &buf, formatOptions{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	f.write(e, nil)
+	want := `CEF:0|BinaryEdge|40fy-client|1.0|ssh|ssh result|3|dst=10.0.0.1 dpt=22 app=ssh rt=1456790400000 cs1Label=jobId cs1=j1 cs2Label=banner cs2=SSH-2.0-OpenSSH_7.2 a\=b|c` + "\n"
+	if buf.String() != want {
+		t.Fatalf("got\n%s\nwant\n%s", buf.String(), want)
+	}
+	service, _ := decodeEvent([]byte(`{"origin":{"type":"http"},"target":{"ip":"10.0.0.2","port":80},"result":{"data":{"service":{"name":"http"}}}}`))
+	buf.Reset()
+	f.write(service, nil)
+	want = "CEF:0|BinaryEdge|40fy-client|1.0|http|http result|3|dst=10.0.0.2 dpt=80 app=http cs3Label=service cs3=http\n"
+	if buf.String() != want {
+		t.Fatalf("got\n%s\nwant\n%s", buf.String(), want)
+	}
+
+	dir, err := ioutil.TempDir("", "cef")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "map.toml")
+	ioutil.WriteFile(path, []byte("[cef]\ncs1Label = \"\"\ncs1 = \"\"\ncs2Label = \"\"\ncs2 = \"\"\ncs3Label = \"\"\nproto = \"target.protocol\"\n"), 0600)
+	buf.Reset()
+	if f, err = newFormatter("cef", &buf, formatOptions{fieldMap: path}); err != nil {
+		t.Fatal(err.Error())
+	}
+	f.write(e, nil)
+	want = "CEF:0|BinaryEdge|40fy-client|1.0|ssh|ssh result|3|dst=10.0.0.1 dpt=22 app=ssh rt=1456790400000 proto=tcp\n"
+	if buf.String() != want {
+		t.Fatalf("got\n%s\nwant\n%s", buf.String(), want)
+	}
+}
+
+func TestLEEFFormat(t *testing.T) {
+	e, _ := decodeEvent([]byte(siemEvent))
+	var buf bytes.Buffer
+	f, err := newFormatter("leef", &buf, formatOptions{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	f.write(e, nil)
+	want := "LEEF:1.0|BinaryEdge|40fy-client|1.0|ssh|dst=10.0.0.1\tdstPort=22\tproto=tcp\tdevTime=1456790400000\tmodule=ssh\tjobId=j1\tbanner=SSH-2.0-OpenSSH_7.2 a=b|c\n"
+	if buf.String() != want {
+		t.Fatalf("got\n%q\nwant\n%q", buf.String(), want)
+	}
+}
+
+func TestSyslogSinkTCP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer l.Close()
+	got := make(chan string, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			got <- err.Error()
+			return
+		}
+		defer c.Close()
+		r := bufio.NewReader(c)
+		n, _ := r.ReadString(' ')
+		size, _ := strconv.Atoi(strings.TrimSpace(n))
+		msg := make([]byte, size)
+		if _, err := io.ReadFull(r, msg); err != nil {
+			got <- err.Error()
+			return
+		}
+		got <- string(msg)
+	}()
+
+	s, err := newSink("syslog+tcp://" + l.Addr().String() + "?facility=local4&severity=info&app_name=test")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	e, _ := decodeEvent([]byte(siemEvent))
+	if err := s.send(e, []byte(siemEvent)); err != nil {
+		t.Fatal(err.Error())
+	}
+	s.close()
+	msg := <-got
+	prefix := "<166>1 2016-03-01T00:00:00Z "
+	if !strings.HasPrefix(msg, prefix) || !strings.Contains(msg, " test - - - CEF:0|BinaryEdge|") {
+		t.Fatal("unexpected message", msg)
+	}
+	if ts := time.Unix(1456790400, 123456789).UTC().Format(syslog_time_format); ts != "2016-03-01T00:00:00.123456Z" {
+		t.Fatal("unexpected timestamp", ts)
+	}
+	// events without a time are sent with the current one
+	e, _ = decodeEvent([]byte(`{"target":{"ip":"10.0.0.1"}}`))
+	byts, err := s.(*syslogSink).message(e, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if ts := strings.Fields(string(byts))[2]; strings.Contains(ts, ".") && len(ts)-strings.Index(ts, ".")-2 > 6 {
+		t.Fatal("more than 6 fractional digits", ts)
+	}
+}
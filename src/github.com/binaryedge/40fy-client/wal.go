@@ -0,0 +1,518 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	wal_segment_suffix = ".seg"
+	wal_cursor_file    = "cursor.json"
+	// a record is its length, the CRC-32C of its data, the time it was
+	// written in nanoseconds and the data
+	wal_header_size = 16
+)
+
+var walTable = crc32.MakeTable(crc32.Castagnoli)
+
+// errWALEnd is returned when reading past the last record written.
+var errWALEnd = errors.New("end of queue")
+
+// errWALFull is returned when appending would make the queue larger than
+// its maximum size.
+var errWALFull = errors.New("queue is full")
+
+// walPos is the position of a record: a segment and an offset in it.
+type walPos struct {
+	Segment uint64 `json:"segment"`
+	Offset  int64  `json:"offset"`
+}
+
+func (p walPos) before(o walPos) bool {
+	return p.Segment < o.Segment || p.Segment == o.Segment && p.Offset < o.Offset
+}
+
+type walRecord struct {
+	pos  walPos
+	next walPos
+	ts   time.Time
+	data []byte
+}
+
+// wal is a queue of records in segment files in a directory. Records are
+// appended to the last segment, a new segment is started once it is
+// segmentSize long. The cursor is the position of the first record not
+// acknowledged yet, it is kept in cursor.json and segments before it are
+// removed. Opening a queue truncates a partly written last record.
+type wal struct {
+	dir         string
+	segmentSize int64
+	maxSize     int64
+
+	mu       sync.Mutex
+	changed  *sync.Cond
+	segments []uint64
+	sizes    map[uint64]int64
+	w        *os.File
+	r        *os.File
+	rID      uint64
+	cursor   walPos
+	saved    walPos
+	pending  int
+	closed   bool
+}
+
+func segmentName(id uint64) string {
+	return fmt.Sprintf("%020d%s", id, wal_segment_suffix)
+}
+
+// listSegments returns the ids of the segments in dir, in order.
+func listSegments(dir string) ([]uint64, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var ids []uint64
+	for _, fi := range infos {
+		name := fi.Name()
+		if !strings.HasSuffix(name, wal_segment_suffix) {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(name, wal_segment_suffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Sort(uint64s(ids))
+	return ids, nil
+}
+
+type uint64s []uint64
+
+func (u uint64s) Len() int           { return len(u) }
+func (u uint64s) Swap(i, j int)      { u[i], u[j] = u[j], u[i] }
+func (u uint64s) Less(i, j int) bool { return u[i] < u[j] }
+
+func readCursor(dir string) (walPos, error) {
+	var pos walPos
+	byts, err := ioutil.ReadFile(filepath.Join(dir, wal_cursor_file))
+	if os.IsNotExist(err) {
+		return pos, nil
+	}
+	if err != nil {
+		return pos, err
+	}
+	if err := json.Unmarshal(byts, &pos); err != nil {
+		return pos, fmt.Errorf("corrupt queue cursor in %s: %s", dir, err.Error())
+	}
+	return pos, nil
+}
+
+// openWAL opens or creates the queue in dir, recovering from a crash while
+// a record was written.
+func openWAL(dir string, segmentSize, maxSize int64) (*wal, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	q := &wal{dir: dir, segmentSize: segmentSize, maxSize: maxSize, sizes: map[uint64]int64{}}
+	q.changed = sync.NewCond(&q.mu)
+	var err error
+	if q.cursor, err = readCursor(dir); err != nil {
+		return nil, err
+	}
+	q.saved = q.cursor
+	if q.segments, err = listSegments(dir); err != nil {
+		return nil, err
+	}
+	for _, id := range q.segments {
+		fi, err := os.Stat(filepath.Join(dir, segmentName(id)))
+		if err != nil {
+			return nil, err
+		}
+		q.sizes[id] = fi.Size()
+	}
+	if len(q.segments) == 0 {
+		id := q.cursor.Segment
+		if id == 0 {
+			id = 1
+		}
+		q.segments = []uint64{id}
+	}
+	last := q.segments[len(q.segments)-1]
+	if err := q.recover(last); err != nil {
+		return nil, err
+	}
+	if q.w, err = os.OpenFile(filepath.Join(dir, segmentName(last)), os.O_CREATE|os.O_WRONLY, 0600); err != nil {
+		return nil, err
+	}
+	if q.cursor.Segment < q.segments[0] {
+		q.cursor = walPos{Segment: q.segments[0]}
+	}
+	q.pending, err = q.count(q.cursor)
+	if err != nil {
+		q.w.Close()
+		return nil, err
+	}
+	return q, nil
+}
+
+// recover truncates the segment after its last complete record.
+func (q *wal) recover(id uint64) error {
+	path := filepath.Join(q.dir, segmentName(id))
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var off int64
+	for {
+		r, err := readRecord(f, off, q.sizes[id])
+		if err != nil {
+			break
+		}
+		off = r.next.Offset
+	}
+	if off != q.sizes[id] {
+		if err := f.Truncate(off); err != nil {
+			return err
+		}
+	}
+	q.sizes[id] = off
+	return nil
+}
+
+// readRecord reads the record at off in f, which is end bytes long, and
+// checks it.
+func readRecord(f io.ReaderAt, off, end int64) (walRecord, error) {
+	var header [wal_header_size]byte
+	if off+wal_header_size > end {
+		return walRecord{}, io.ErrUnexpectedEOF
+	}
+	if _, err := f.ReadAt(header[:], off); err != nil {
+		return walRecord{}, err
+	}
+	size := binary.BigEndian.Uint32(header[0:4])
+	sum := binary.BigEndian.Uint32(header[4:8])
+	ts := int64(binary.BigEndian.Uint64(header[8:16]))
+	if off+wal_header_size+int64(size) > end {
+		return walRecord{}, io.ErrUnexpectedEOF
+	}
+	data := make([]byte, size)
+	if _, err := f.ReadAt(data, off+wal_header_size); err != nil {
+		return walRecord{}, err
+	}
+	if crc32.Checksum(data, walTable) != sum {
+		return walRecord{}, fmt.Errorf("checksum mismatch at offset %d", off)
+	}
+	return walRecord{
+		pos:  walPos{Offset: off},
+		next: walPos{Offset: off + wal_header_size + int64(size)},
+		ts:   time.Unix(0, ts),
+		data: data,
+	}, nil
+}
+
+// count returns the number of records from pos to the end.
+func (q *wal) count(pos walPos) (int, error) {
+	n := 0
+	for {
+		r, err := q.read(pos)
+		if err == errWALEnd {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+		n++
+		pos = r.next
+	}
+}
+
+// size returns the number of bytes of the records from the cursor on.
+func (q *wal) size() int64 {
+	var n int64
+	for id, s := range q.sizes {
+		switch {
+		case id > q.cursor.Segment:
+			n += s
+		case id == q.cursor.Segment && s > q.cursor.Offset:
+			n += s - q.cursor.Offset
+		}
+	}
+	return n
+}
+
+// append writes a record at the end of the queue.
+func (q *wal) append(data []byte, ts time.Time) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return errClosed
+	}
+	rec := make([]byte, wal_header_size+len(data))
+	binary.BigEndian.PutUint32(rec[0:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(rec[4:8], crc32.Checksum(data, walTable))
+	binary.BigEndian.PutUint64(rec[8:16], uint64(ts.UnixNano()))
+	copy(rec[wal_header_size:], data)
+	if q.maxSize > 0 && q.size()+int64(len(rec)) > q.maxSize {
+		return errWALFull
+	}
+	last := q.segments[len(q.segments)-1]
+	if q.sizes[last] > 0 && q.sizes[last]+int64(len(rec)) > q.segmentSize {
+		if err := q.roll(); err != nil {
+			return err
+		}
+		last = q.segments[len(q.segments)-1]
+	}
+	n, err := q.w.WriteAt(rec, q.sizes[last])
+	if err != nil {
+		// leave no partial record behind for the readers
+		q.w.Truncate(q.sizes[last])
+		return err
+	}
+	q.sizes[last] += int64(n)
+	q.pending++
+	q.changed.Broadcast()
+	return nil
+}
+
+// roll syncs the last segment and starts a new one.
+func (q *wal) roll() error {
+	if err := q.w.Sync(); err != nil {
+		return err
+	}
+	return q.startSegment()
+}
+
+func (q *wal) startSegment() error {
+	q.w.Close()
+	id := q.segments[len(q.segments)-1] + 1
+	w, err := os.OpenFile(filepath.Join(q.dir, segmentName(id)), os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	q.w = w
+	q.segments = append(q.segments, id)
+	q.sizes[id] = 0
+	return nil
+}
+
+// read returns the record at pos, or errWALEnd when there is none yet.
+// pos may be the end of a segment, the record is then the first of the next.
+func (q *wal) read(pos walPos) (walRecord, error) {
+	for i, id := range q.segments {
+		if id < pos.Segment {
+			continue
+		}
+		if id > pos.Segment {
+			pos = walPos{Segment: id}
+		}
+		if pos.Offset >= q.sizes[id] {
+			if i == len(q.segments)-1 {
+				return walRecord{}, errWALEnd
+			}
+			continue
+		}
+		if q.r == nil || q.rID != id {
+			if q.r != nil {
+				q.r.Close()
+			}
+			f, err := os.Open(filepath.Join(q.dir, segmentName(id)))
+			if err != nil {
+				q.r = nil
+				return walRecord{}, err
+			}
+			q.r, q.rID = f, id
+		}
+		r, err := readRecord(q.r, pos.Offset, q.sizes[id])
+		if err != nil {
+			return walRecord{}, fmt.Errorf("queue segment %s: %s", segmentName(id), err.Error())
+		}
+		r.pos.Segment, r.next.Segment = id, id
+		return r, nil
+	}
+	return walRecord{}, errWALEnd
+}
+
+// next returns the record at pos, waiting for one to be appended until stop
+// is closed.
+func (q *wal) next(pos walPos, stop <-chan struct{}) (walRecord, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for {
+		r, err := q.read(pos)
+		if err != errWALEnd {
+			return r, err
+		}
+		select {
+		case <-stop:
+			return r, err
+		default:
+		}
+		if q.closed {
+			return r, err
+		}
+		q.changed.Wait()
+	}
+}
+
+// wake wakes the readers waiting in next, for example to stop.
+func (q *wal) wake() {
+	q.mu.Lock()
+	q.changed.Broadcast()
+	q.mu.Unlock()
+}
+
+// ack moves the cursor to pos, after n more acknowledged records, and
+// removes the segments before it.
+func (q *wal) ack(pos walPos, n int) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.cursor.before(pos) {
+		return nil
+	}
+	q.cursor = pos
+	q.pending -= n
+	last := q.segments[len(q.segments)-1]
+	if pos.Segment == last && pos.Offset >= q.sizes[last] && q.sizes[last] > 0 {
+		// every record was acknowledged, start a new segment instead of
+		// growing this one, it is removed below without being synced
+		if err := q.startSegment(); err != nil {
+			return err
+		}
+		q.cursor = walPos{Segment: q.segments[len(q.segments)-1]}
+	}
+	for len(q.segments) > 1 && q.segments[0] < q.cursor.Segment {
+		id := q.segments[0]
+		if err := os.Remove(filepath.Join(q.dir, segmentName(id))); err != nil {
+			return err
+		}
+		delete(q.sizes, id)
+		q.segments = q.segments[1:]
+		if q.r != nil && q.rID == id {
+			q.r.Close()
+			q.r = nil
+		}
+	}
+	q.changed.Broadcast()
+	return nil
+}
+
+// sync writes the last segment and the cursor to disk.
+func (q *wal) sync() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.syncLocked()
+}
+
+func (q *wal) syncLocked() error {
+	if err := q.w.Sync(); err != nil {
+		return err
+	}
+	if q.cursor == q.saved {
+		return nil
+	}
+	byts, err := json.Marshal(q.cursor)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(q.dir, wal_cursor_file)
+	if err := ioutil.WriteFile(path+".tmp", byts, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+	q.saved = q.cursor
+	return nil
+}
+
+// depth returns the number of records not acknowledged yet.
+func (q *wal) depth() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.pending
+}
+
+func (q *wal) close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return nil
+	}
+	err := q.syncLocked()
+	q.closed = true
+	q.changed.Broadcast()
+	if cerr := q.w.Close(); err == nil {
+		err = cerr
+	}
+	if q.r != nil {
+		q.r.Close()
+	}
+	return err
+}
+
+// walStats describes a queue on disk.
+type walStats struct {
+	Dir      string    `json:"dir"`
+	Sink     string    `json:"sink,omitempty"`
+	Records  int       `json:"records"`
+	Bytes    int64     `json:"bytes"`
+	Segments int       `json:"segments"`
+	Oldest   time.Time `json:"oldest,omitempty"`
+}
+
+// inspectWAL reads the state of the queue in dir without changing it.
+func inspectWAL(dir string) (walStats, error) {
+	s := walStats{Dir: dir}
+	cursor, err := readCursor(dir)
+	if err != nil {
+		return s, err
+	}
+	q := &wal{dir: dir, sizes: map[uint64]int64{}}
+	if q.segments, err = listSegments(dir); err != nil {
+		return s, err
+	}
+	for _, id := range q.segments {
+		fi, err := os.Stat(filepath.Join(dir, segmentName(id)))
+		if err != nil {
+			return s, err
+		}
+		q.sizes[id] = fi.Size()
+	}
+	if byts, err := ioutil.ReadFile(filepath.Join(dir, sink_spec_file)); err == nil {
+		s.Sink = strings.TrimSpace(string(byts))
+	}
+	s.Segments = len(q.segments)
+	pos := cursor
+	for {
+		r, err := q.read(pos)
+		if err != nil {
+			// a partly written last record is not counted
+			break
+		}
+		if s.Records == 0 {
+			s.Oldest = r.ts
+		}
+		s.Records++
+		s.Bytes += r.next.Offset - r.pos.Offset
+		pos = r.next
+	}
+	if q.r != nil {
+		q.r.Close()
+	}
+	return s, nil
+}
@@ -0,0 +1,719 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/mitchellh/cli"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+const (
+	// watch_max_results bounds the results kept for the list, the oldest
+	// tenth is dropped when it is reached.
+	watch_max_results = 10000
+	watch_rate_window = 10
+
+	ansi_reverse = "\x1b[7m"
+	ansi_bold    = "\x1b[1m"
+	ansi_reset   = "\x1b[0m"
+)
+
+// summaryFields are tried in order for the one line summary of a result.
+var summaryFields = [][]string{
+	splitPath("result.data.service.banner"),
+	splitPath("result.data.banner"),
+	splitPath("result.data.title"),
+	splitPath("result.data.response.title"),
+	splitPath("result.data.service.product"),
+	splitPath("result.data.service.name"),
+	splitPath("result.error"),
+}
+
+type watchResult struct {
+	e       event
+	line    []byte
+	summary string
+}
+
+// summarize describes a result on one line as ip:port, module and the first
+// line of its banner, title or service name.
+func summarize(e event) string {
+	target := e.getString("target.ip")
+	if port := e.getString("target.port"); len(port) > 0 {
+		target += ":" + port
+	}
+	var info string
+	for _, path := range summaryFields {
+		if v, ok := lookup(e, path); ok && v != nil {
+			if info = strings.TrimSpace(valueString(v)); len(info) > 0 {
+				break
+			}
+		}
+	}
+	if i := strings.IndexAny(info, "\r\n"); i >= 0 {
+		info = info[:i]
+	}
+	return fmt.Sprintf("%-21s  %-10s  %s", target, e.module(), info)
+}
+
+// clip makes s safe to print on one line no wider than width.
+func clip(s string, width int) string {
+	s = strings.Map(func(r rune) rune {
+		if r < ' ' || r == 0x7f {
+			return ' '
+		}
+		return r
+	}, s)
+	if width <= 0 {
+		return ""
+	}
+	if utf8.RuneCountInString(s) > width {
+		s = string([]rune(s)[:width-1]) + "…"
+	}
+	return s
+}
+
+// watchModel is the state of the watch screen. Results are added from the
+// stream while keys are handled and the screen is drawn, all under mu.
+type watchModel struct {
+	mu sync.Mutex
+
+	jobID  string
+	meta   []string
+	sample int
+	start  time.Time
+	now    func() time.Time
+
+	results []*watchResult
+	view    []int
+	total   int
+	bytes   int64
+	rates   [watch_rate_window]struct {
+		sec int64
+		n   int
+	}
+
+	selected int
+	top      int
+	follow   bool
+	paused   bool
+	filter   predicate
+	expr     string
+
+	mode     string
+	input    string
+	status   string
+	saveFile string
+	ended    string
+	quit     bool
+}
+
+func newWatchModel(jobID string, meta []string, sample int) *watchModel {
+	m := &watchModel{
+		jobID:  jobID,
+		meta:   meta,
+		sample: sample,
+		now:    time.Now,
+		follow: true,
+	}
+	m.start = m.now()
+	m.saveFile = "watch.ndjson"
+	if len(jobID) > 0 {
+		m.saveFile = "watch-" + jobID + ".ndjson"
+	}
+	return m
+}
+
+// add records a line of the stream, lines that are not events or are
+// events of other jobs are skipped.
+func (m *watchModel) add(line []byte) {
+	e, err := decodeEvent(line)
+	if err != nil || len(m.jobID) > 0 && e.jobID() != m.jobID {
+		return
+	}
+	r := &watchResult{e: e, line: append([]byte(nil), line...), summary: summarize(e)}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.total++
+	m.bytes += int64(len(line))
+	sec := m.now().Unix()
+	b := &m.rates[sec%watch_rate_window]
+	if b.sec != sec {
+		b.sec, b.n = sec, 0
+	}
+	b.n++
+	m.results = append(m.results, r)
+	if len(m.results) > watch_max_results {
+		trimmed := watch_max_results / 10
+		m.results = append([]*watchResult(nil), m.results[trimmed:]...)
+		if m.paused {
+			// the view stays as it is, without the trimmed results
+			m.shift(trimmed)
+		} else {
+			m.rebuild()
+		}
+		return
+	}
+	if !m.paused && (m.filter == nil || m.filter(e)) {
+		m.view = append(m.view, len(m.results)-1)
+		if m.follow {
+			m.selected = len(m.view) - 1
+		}
+	}
+}
+
+// end marks the stream as finished, reason is shown in the status line.
+func (m *watchModel) end(reason string) {
+	m.mu.Lock()
+	m.ended = reason
+	m.mu.Unlock()
+}
+
+func (m *watchModel) done() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.quit
+}
+
+func (m *watchModel) current() *watchResult {
+	if m.selected < 0 || m.selected >= len(m.view) {
+		return nil
+	}
+	return m.results[m.view[m.selected]]
+}
+
+// rebuild recomputes the visible results, keeping the selection on the same
+// result when it is still visible.
+func (m *watchModel) rebuild() {
+	sel := m.current()
+	m.view = m.view[:0]
+	m.selected = -1
+	for i, r := range m.results {
+		if m.filter != nil && !m.filter(r.e) {
+			continue
+		}
+		m.view = append(m.view, i)
+		if r == sel {
+			m.selected = len(m.view) - 1
+		}
+	}
+	if m.selected < 0 || m.follow {
+		m.selected = len(m.view) - 1
+	}
+}
+
+// shift drops the first n results from the view and moves the rest down
+// by n, once the first n results were trimmed.
+func (m *watchModel) shift(n int) {
+	view := m.view[:0]
+	selected := -1
+	for i, idx := range m.view {
+		if idx < n {
+			continue
+		}
+		if i == m.selected {
+			selected = len(view)
+		}
+		view = append(view, idx-n)
+	}
+	m.view = view
+	if selected < 0 && len(view) > 0 {
+		selected = 0
+	}
+	m.selected = selected
+}
+
+func (m *watchModel) move(n int) {
+	m.selected += n
+	if m.selected >= len(m.view) {
+		m.selected = len(m.view) - 1
+	}
+	if m.selected < 0 {
+		m.selected = 0
+	}
+	m.follow = m.selected == len(m.view)-1
+}
+
+// key handles one key press as returned by parseKeys.
+func (m *watchModel) key(k string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.mode) > 0 {
+		switch k {
+		case "enter":
+			mode, input := m.mode, strings.TrimSpace(m.input)
+			m.mode, m.input = "", ""
+			if mode == "filter" {
+				m.applyFilter(input)
+			} else if len(input) > 0 {
+				m.saveFile = input
+				m.save()
+			}
+		case "esc", "ctrl-c":
+			m.mode, m.input = "", ""
+		case "backspace":
+			if n := len(m.input); n > 0 {
+				_, size := utf8.DecodeLastRuneInString(m.input)
+				m.input = m.input[:n-size]
+			}
+		default:
+			if utf8.RuneCountInString(k) == 1 {
+				m.input += k
+			}
+		}
+		return
+	}
+	m.status = ""
+	switch k {
+	case "q", "ctrl-c":
+		m.quit = true
+	case "up", "k":
+		m.move(-1)
+	case "down", "j":
+		m.move(1)
+	case "pgup":
+		m.move(-10)
+	case "pgdn":
+		m.move(10)
+	case "home", "g":
+		m.move(-len(m.view))
+	case "end", "G":
+		m.move(len(m.view))
+	case "p", " ":
+		m.paused = !m.paused
+		if !m.paused {
+			m.rebuild()
+		}
+	case "/":
+		m.mode, m.input = "filter", m.expr
+	case "s":
+		if m.current() == nil {
+			m.status = "Nothing selected"
+			return
+		}
+		m.mode, m.input = "save", m.saveFile
+	}
+}
+
+func (m *watchModel) applyFilter(expr string) {
+	if len(expr) == 0 {
+		m.filter, m.expr = nil, ""
+		m.rebuild()
+		return
+	}
+	pred, err := compileFilter(expr)
+	if err != nil {
+		m.status = "Invalid filter: " + err.Error()
+		return
+	}
+	m.filter, m.expr = pred, expr
+	m.rebuild()
+}
+
+// save appends the selected result, as received, to the save file.
+func (m *watchModel) save() {
+	r := m.current()
+	if r == nil {
+		return
+	}
+	f, err := os.OpenFile(m.saveFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		m.status = "Failed to save: " + err.Error()
+		return
+	}
+	defer f.Close()
+	line := append(append([]byte(nil), bytes.TrimRight(r.line, "\r\n")...), '\n')
+	if _, err := f.Write(line); err != nil {
+		m.status = "Failed to save: " + err.Error()
+		return
+	}
+	m.status = "Saved " + r.e.getString("target.ip") + " to " + m.saveFile
+}
+
+// recentRate is the results per second over the last seconds of the window,
+// not counting the one still running.
+func (m *watchModel) recentRate() float64 {
+	now := m.now().Unix()
+	n := 0
+	for _, b := range m.rates {
+		if b.sec < now && b.sec >= now-watch_rate_window+1 {
+			n += b.n
+		}
+	}
+	return float64(n) / float64(watch_rate_window-1)
+}
+
+func (m *watchModel) progress(width int) string {
+	if m.sample <= 0 {
+		return fmt.Sprintf("%d results", m.total)
+	}
+	label := fmt.Sprintf(" %d/%d %3d%%", m.total, m.sample, m.total*100/m.sample)
+	bar := width - len(label) - 2
+	if bar < 10 {
+		return strings.TrimSpace(label)
+	}
+	filled := bar * m.total / m.sample
+	if filled > bar {
+		filled = bar
+	}
+	return "[" + strings.Repeat("#", filled) + strings.Repeat("-", bar-filled) + "]" + label
+}
+
+// render draws the screen as height lines no wider than width.
+func (m *watchModel) render(width, height int) []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var lines []string
+	title := "Watching the stream"
+	if len(m.jobID) > 0 {
+		title = "Job " + m.jobID
+	}
+	lines = append(lines, ansi_bold+clip(title, width)+ansi_reset)
+	for _, l := range m.meta {
+		lines = append(lines, clip(l, width))
+	}
+	lines = append(lines, m.progress(width))
+
+	elapsed := m.now().Sub(m.start)
+	state := ""
+	switch {
+	case m.sample > 0 && m.total >= m.sample:
+		state = "  complete"
+	case len(m.ended) > 0:
+		state = "  " + m.ended
+	}
+	if m.paused {
+		state += "  PAUSED"
+	}
+	avg := 0.0
+	if elapsed > 0 {
+		avg = float64(m.total) / elapsed.Seconds()
+	}
+	lines = append(lines, clip(fmt.Sprintf("%.1f results/s now  %.1f/s average  %s received  %s elapsed%s",
+		m.recentRate(), avg, formatSize(float64(m.bytes)), (elapsed/time.Second)*time.Second, state), width))
+
+	listTitle := fmt.Sprintf("── Results (%d shown)", len(m.view))
+	if len(m.expr) > 0 {
+		listTitle += " filter: " + m.expr
+	}
+	lines = append(lines, clip(listTitle+" "+strings.Repeat("─", width), width))
+
+	rest := height - len(lines) - 2
+	listHeight := rest / 2
+	if listHeight < 1 {
+		listHeight = 1
+	}
+	if m.selected < m.top {
+		m.top = m.selected
+	}
+	if m.selected >= m.top+listHeight {
+		m.top = m.selected - listHeight + 1
+	}
+	if m.top < 0 {
+		m.top = 0
+	}
+	for i := m.top; i < m.top+listHeight; i++ {
+		if i >= len(m.view) {
+			lines = append(lines, "")
+			continue
+		}
+		row := clip(m.results[m.view[i]].summary, width)
+		if i == m.selected {
+			row = ansi_reverse + row + strings.Repeat(" ", width-utf8.RuneCountInString(row)) + ansi_reset
+		}
+		lines = append(lines, row)
+	}
+
+	lines = append(lines, clip("── Detail "+strings.Repeat("─", width), width))
+	detailHeight := height - len(lines) - 1
+	if r := m.current(); r != nil {
+		byts, _ := json.MarshalIndent(r.e, "", "  ")
+		for _, l := range strings.Split(string(byts), "\n") {
+			if detailHeight <= 0 {
+				break
+			}
+			lines = append(lines, clip(l, width))
+			detailHeight--
+		}
+	}
+	for ; detailHeight > 0; detailHeight-- {
+		lines = append(lines, "")
+	}
+
+	switch {
+	case m.mode == "filter":
+		lines = append(lines, clip("Filter: "+m.input, width))
+	case m.mode == "save":
+		lines = append(lines, clip("Save to: "+m.input, width))
+	case len(m.status) > 0:
+		lines = append(lines, clip(m.status, width))
+	default:
+		lines = append(lines, clip("q quit  ↑/↓ select  p pause  / filter  s save selection", width))
+	}
+	if len(lines) > height {
+		lines = lines[:height]
+	}
+	return lines
+}
+
+// parseKeys splits what was read from the terminal into key names: a single
+// character, or one of up, down, pgup, pgdn, home, end, enter, backspace,
+// esc and ctrl-c.
+func parseKeys(b []byte) []string {
+	var keys []string
+	for len(b) > 0 {
+		switch {
+		case b[0] == 0x1b && len(b) >= 3 && (b[1] == '[' || b[1] == 'O'):
+			n := 3
+			name := ""
+			switch b[2] {
+			case 'A':
+				name = "up"
+			case 'B':
+				name = "down"
+			case 'H':
+				name = "home"
+			case 'F':
+				name = "end"
+			case '5', '6', '1', '4':
+				if len(b) >= 4 && b[3] == '~' {
+					n = 4
+					name = map[byte]string{'5': "pgup", '6': "pgdn", '1': "home", '4': "end"}[b[2]]
+				}
+			}
+			if len(name) > 0 {
+				keys = append(keys, name)
+			}
+			b = b[n:]
+			continue
+		case b[0] == 0x1b:
+			keys = append(keys, "esc")
+		case b[0] == '\r' || b[0] == '\n':
+			keys = append(keys, "enter")
+		case b[0] == 0x7f || b[0] == 0x08:
+			keys = append(keys, "backspace")
+		case b[0] == 0x03:
+			keys = append(keys, "ctrl-c")
+		case b[0] >= 0x80:
+			r, size := utf8.DecodeRune(b)
+			keys = append(keys, string(r))
+			b = b[size:]
+			continue
+		case b[0] >= ' ':
+			keys = append(keys, string(b[0]))
+		}
+		b = b[1:]
+	}
+	return keys
+}
+
+// jobMeta describes a job of the history for the watch header, with the
+// sample it was created with.
+func jobMeta(r *jobRecord) ([]string, int) {
+	var (
+		req    jobRequest
+		sample int
+		ports  []string
+		mods   []string
+		target []string
+	)
+	json.Unmarshal(r.Request, &req)
+	for _, o := range req.Options {
+		target = append(target, o.Targets...)
+		for _, p := range o.Ports {
+			sample += p.Sample
+			ports = append(ports, strconv.Itoa(p.Port))
+			mods = append(mods, p.Modules...)
+		}
+	}
+	meta := []string{fmt.Sprintf("Created %s  status %s  labels %s",
+		r.CreatedAt.Local().Format("2006-01-02 15:04:05"), r.Outcome, strings.Join(r.Labels, ","))}
+	meta = append(meta, fmt.Sprintf("Targets %s  ports %s  modules %s",
+		strings.Join(target, ","), strings.Join(ports, ","), strings.Join(mods, ",")))
+	return meta, sample
+}
+
+type WatchCommand struct {
+	client  http.Client
+	input   *os.File
+	output  *os.File
+	config  map[string]interface{}
+	history string
+}
+
+func (w *WatchCommand) Run(args []string) int {
+	fs := flag.NewFlagSet("watch", flag.ContinueOnError)
+	token := fs.String("token", "", "token for authenticating with api")
+	jobID := fs.String("job-id", "", "id of the job to watch, \"last\" or a label from the job history")
+	sample := fs.Int("sample", 0, "number of results expected, taken from the job history when not given")
+	filter := fs.String("filter", "", "only list results matching this expression")
+	if err := fs.Parse(args); err != nil {
+		return -1
+	}
+	if len(*token) == 0 {
+		if tok, ok := w.config["token"].(string); ok && len(tok) > 0 {
+			*token = tok
+		} else {
+			fmt.Println(w.Help())
+			return -1
+		}
+	}
+	if !terminal.IsTerminal(int(w.input.Fd())) || !terminal.IsTerminal(int(w.output.Fd())) {
+		fmt.Fprintln(os.Stderr, "watch needs a terminal, use stream instead")
+		return -1
+	}
+	h, err := openHistory(w.history)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to read job history", err.Error())
+		return -1
+	}
+	id, err := h.resolve(*jobID)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to resolve job", err.Error())
+		return -1
+	}
+	var meta []string
+	if r := h.get(id); r != nil {
+		var n int
+		meta, n = jobMeta(r)
+		if *sample == 0 {
+			*sample = n
+		}
+	}
+	m := newWatchModel(id, meta, *sample)
+	if len(*filter) > 0 {
+		m.applyFilter(*filter)
+		if len(m.status) > 0 {
+			fmt.Fprintln(os.Stderr, m.status)
+			return -1
+		}
+	}
+
+	req, err := http.NewRequest("GET", w.config["stream_url"].(string), nil)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to connect", err.Error())
+		return -1
+	}
+	req.Header.Add("X-Token", *token)
+	resp, err := w.client.Do(req)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to connect", err.Error())
+		return -1
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == 401 {
+		fmt.Fprintln(os.Stderr, "Invalid credentials")
+		return -1
+	}
+
+	state, err := terminal.MakeRaw(int(w.input.Fd()))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to set up terminal", err.Error())
+		return -1
+	}
+	defer terminal.Restore(int(w.input.Fd()), state)
+	io.WriteString(w.output, "\x1b[?1049h\x1b[?25l")
+	defer io.WriteString(w.output, "\x1b[?25h\x1b[?1049l")
+
+	go func() {
+		lines := newLineReader(resp.Body, default_max_line_size)
+		for {
+			line, tooLong, err := lines.next()
+			if len(line) > 0 && !tooLong {
+				m.add(line)
+			}
+			if err != nil {
+				m.end("stream ended")
+				return
+			}
+		}
+	}()
+	keys := make(chan []byte)
+	go func() {
+		for {
+			b := make([]byte, 64)
+			n, err := w.input.Read(b)
+			if err != nil {
+				return
+			}
+			keys <- b[:n]
+		}
+	}()
+	tick := time.NewTicker(250 * time.Millisecond)
+	defer tick.Stop()
+	for !m.done() {
+		width, height, err := terminal.GetSize(int(w.output.Fd()))
+		if err != nil || width <= 0 || height <= 0 {
+			width, height = 80, 24
+		}
+		w.draw(m.render(width, height))
+		select {
+		case b := <-keys:
+			for _, k := range parseKeys(b) {
+				m.key(k)
+			}
+		case <-tick.C:
+		}
+	}
+	return 0
+}
+
+func (w *WatchCommand) draw(lines []string) {
+	var b []byte
+	b = append(b, "\x1b[H"...)
+	for i, l := range lines {
+		if i > 0 {
+			b = append(b, "\r\n"...)
+		}
+		b = append(b, l...)
+		b = append(b, "\x1b[K"...)
+	}
+	b = append(b, "\x1b[J"...)
+	w.output.Write(b)
+}
+
+func (w *WatchCommand) Synopsis() string {
+	return "Watch the results of a job in a full-screen dashboard"
+}
+
+func (w *WatchCommand) Help() string {
+	return `
+Usage: 40fy-client watch -token=TOKEN [-job-id=JOBID] [-sample=N] [-filter=FILTER]
+
+ Shows the results of a job as they arrive: the job details from the local job history, a progress bar
+ toward the sample, result rates, a scrolling list of results and the detail of the selected one.
+ The "JOB-ID" parameter is a job id, "last" or a label from the local job history, without it the whole
+ stream is shown.
+ The "sample" parameter is the number of results expected, taken from the job history when not given.
+ The "filter" parameter only lists results matching FILTER, as for stream.
+
+ Keys:
+   up/down, k/j, page up/down, home/end   select a result
+   p or space                             pause the list, results are still counted
+   /                                      filter the list, an empty filter shows everything
+   s                                      append the selected result to a file
+   q                                      quit
+	`
+}
+
+func WatchCommandFactory() (cli.Command, error) {
+	w := &WatchCommand{
+		client:  http.Client{},
+		input:   os.Stdin,
+		output:  os.Stdout,
+		history: historyPath(),
+	}
+	w.config = loadConfig()
+	return w, nil
+}
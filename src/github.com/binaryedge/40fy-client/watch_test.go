@@ -0,0 +1,94 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseKeys(t *testing.T) {
+	keys := parseKeys([]byte("q\x1b[A\x1b[B\x1b[5~\x1b/\r\x7fé"))
+	want := []string{"q", "up", "down", "pgup", "esc", "/", "enter", "backspace", "é"}
+	if !reflect.DeepEqual(keys, want) {
+		t.Fatal("got", keys, "want", want)
+	}
+}
+
+func TestWatchModel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "watch")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	m := newWatchModel("j1", []string{"Targets 10.0.0.0/24"}, 4)
+	now := time.Unix(1000, 0)
+	m.now = func() time.Time { return now }
+	for _, l := range []string{
+		`{"origin":{"type":"ssh","job_id":"j1"},"target":{"ip":"10.0.0.1","port":22},"result":{"data":{"banner":"SSH-2.0-OpenSSH_7.2\r\n"}}}`,
+		`{"origin":{"type":"http","job_id":"j2"},"target":{"ip":"10.0.0.9","port":80}}`,
+		`{"origin":{"type":"http","job_id":"j1"},"target":{"ip":"10.0.0.2","port":80},"result":{"data":{"title":"Welcome"}}}`,
+	} {
+		m.add([]byte(l + "\n"))
+	}
+	if m.total != 2 || m.selected != 1 {
+		t.Fatal("unexpected state", m.total, m.selected)
+	}
+
+	screen := strings.Join(m.render(80, 24), "\n")
+	for _, want := range []string{"Job j1", "Targets 10.0.0.0/24", " 2/4  50%", "10.0.0.1:22", "SSH-2.0-OpenSSH_7.2", "Welcome", `"title": "Welcome"`} {
+		if !strings.Contains(screen, want) {
+			t.Error("screen does not show", want, "\n", screen)
+		}
+	}
+
+	for _, k := range parseKeys([]byte("/module == \"ssh\"\r")) {
+		m.key(k)
+	}
+	if len(m.view) != 1 || m.current().e.getString("target.ip") != "10.0.0.1" {
+		t.Fatal("filter not applied", m.view, m.status)
+	}
+
+	m.key("p")
+	m.add([]byte(`{"origin":{"type":"ssh","job_id":"j1"},"target":{"ip":"10.0.0.3","port":22}}`))
+	if len(m.view) != 1 || m.total != 3 {
+		t.Fatal("paused list changed", m.view)
+	}
+	m.key("p")
+	if len(m.view) != 2 {
+		t.Fatal("resumed list not updated", m.view)
+	}
+
+	m.key("up")
+	path := filepath.Join(dir, "saved.ndjson")
+	m.key("s")
+	m.input = path
+	m.key("enter")
+	byts, _ := ioutil.ReadFile(path)
+	if !strings.Contains(string(byts), `"10.0.0.1"`) || strings.Count(string(byts), "\n") != 1 {
+		t.Fatal("unexpected saved file", string(byts), m.status)
+	}
+	m.key("q")
+	if !m.done() {
+		t.Fatal("q did not quit")
+	}
+
+	// results trimmed while paused
+	m = newWatchModel("", nil, 0)
+	line := []byte(`{"target":{"ip":"10.0.0.1","port":22}}`)
+	for i := 0; i < watch_max_results-5; i++ {
+		m.add(line)
+	}
+	m.key("p")
+	sel := m.current()
+	for i := 0; i < 10; i++ {
+		m.add(line)
+	}
+	if len(m.view) != watch_max_results-5-watch_max_results/10 || m.current() != sel {
+		t.Fatal("paused view changed", len(m.view), m.selected)
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+func init() {
+	registerSink("webhook", newWebhookSink)
+}
+
+// webhookOptions are the query parameters read by the webhook sink, any
+// other parameter is part of the URL the events are posted to.
+var webhookOptions = map[string]bool{
+	"batch": true, "flush": true, "retries": true, "template": true, "header": true,
+	"secret": true, "secret_env": true, "signature_header": true, "dead_letter": true,
+}
+
+// webhookData is what a body template is executed with. Events holds the
+// whole batch, Event and Line the first event of it, which is the only one
+// when events are sent singly.
+type webhookData struct {
+	Event  event
+	Line   string
+	Events []event
+	Lines  []string
+}
+
+type webhookItem struct {
+	e    event
+	line []byte
+	// ack, when set, is told whether the event was delivered
+	ack func(err error)
+}
+
+// webhookSink posts events to an HTTP endpoint, singly or in batches.
+//
+//	webhook://host/path[?batch=1&flush=5s&retries=5&template=FILE&header=Name:Value&secret_env=VAR&dead_letter=FILE]
+//
+// Use webhook+https to post with TLS. Without a template single events are
+// posted as received and batches as a JSON array. With secret, or the
+// secret read from the environment variable secret_env, the body is signed
+// with HMAC-SHA256 in the signature_header header (X-Signature-256 by
+// default) as "sha256=HEX". Events still failing after the retries are
+// appended to the dead_letter file.
+type webhookSink struct {
+	client          http.Client
+	endpoint        string
+	headers         http.Header
+	tmpl            *template.Template
+	secret          []byte
+	signatureHeader string
+	retries         int
+	batch           int
+	deadLetter      string
+	batcher         *batcher
+	deadMu          sync.Mutex
+}
+
+func newWebhookSink(u *url.URL) (sink, error) {
+	if len(u.Host) == 0 {
+		return nil, fmt.Errorf("webhook sink needs a host")
+	}
+	q := u.Query()
+	s := &webhookSink{
+		headers:         http.Header{},
+		signatureHeader: "X-Signature-256",
+		retries:         5,
+		batch:           1,
+		deadLetter:      q.Get("dead_letter"),
+	}
+	target := *u
+	target.Scheme = transport(u, "http")
+	passed := url.Values{}
+	for k, v := range q {
+		if !webhookOptions[k] {
+			passed[k] = v
+		}
+	}
+	target.RawQuery = passed.Encode()
+	s.endpoint = target.String()
+
+	var err error
+	if v := q.Get("batch"); len(v) > 0 {
+		if s.batch, err = strconv.Atoi(v); err != nil || s.batch <= 0 {
+			return nil, fmt.Errorf("invalid batch %q", v)
+		}
+	}
+	flushAge := 5 * time.Second
+	if v := q.Get("flush"); len(v) > 0 {
+		if flushAge, err = time.ParseDuration(v); err != nil {
+			return nil, err
+		}
+	}
+	if v := q.Get("retries"); len(v) > 0 {
+		if s.retries, err = strconv.Atoi(v); err != nil {
+			return nil, fmt.Errorf("invalid retries %q", v)
+		}
+	}
+	for _, h := range q["header"] {
+		i := strings.Index(h, ":")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid header %q, use Name:Value", h)
+		}
+		s.headers.Add(strings.TrimSpace(h[:i]), strings.TrimSpace(h[i+1:]))
+	}
+	if s.headers.Get("Content-Type") == "" {
+		s.headers.Set("Content-Type", "application/json")
+	}
+	if v := q.Get("template"); len(v) > 0 {
+		byts, err := ioutil.ReadFile(v)
+		if err != nil {
+			return nil, err
+		}
+		if s.tmpl, err = template.New(v).Funcs(templateFuncs).Parse(string(byts)); err != nil {
+			return nil, err
+		}
+	}
+	if v := q.Get("secret"); len(v) > 0 {
+		s.secret = []byte(v)
+	}
+	if v := q.Get("secret_env"); len(v) > 0 {
+		s.secret = []byte(os.Getenv(v))
+		if len(s.secret) == 0 {
+			return nil, fmt.Errorf("environment variable %s is empty", v)
+		}
+	}
+	if v := q.Get("signature_header"); len(v) > 0 {
+		s.signatureHeader = v
+	}
+	s.batcher = newBatcher(s.batch, flushAge, s.flush)
+	return s, nil
+}
+
+var templateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		byts, err := json.Marshal(v)
+		return string(byts), err
+	},
+	"get": func(e event, path string) interface{} {
+		v, _ := e.get(path)
+		return v
+	},
+}
+
+func (s *webhookSink) send(e event, line []byte) error {
+	return s.sendAck(e, line, nil)
+}
+
+// sendAck queues the event and calls ack once it was delivered or given up
+// on, or with the error when the endpoint stayed unavailable.
+func (s *webhookSink) sendAck(e event, line []byte, ack func(err error)) error {
+	s.batcher.add(webhookItem{e, append([]byte(nil), bytes.TrimRight(line, "\r\n")...), ack})
+	return nil
+}
+
+func (s *webhookSink) body(items []webhookItem) ([]byte, error) {
+	if s.tmpl == nil {
+		if s.batch == 1 {
+			return items[0].line, nil
+		}
+		var buf bytes.Buffer
+		buf.WriteByte('[')
+		for i, it := range items {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			buf.Write(it.line)
+		}
+		buf.WriteByte(']')
+		return buf.Bytes(), nil
+	}
+	data := webhookData{Event: items[0].e, Line: string(items[0].line)}
+	for _, it := range items {
+		data.Events = append(data.Events, it.e)
+		data.Lines = append(data.Lines, string(it.line))
+	}
+	var buf bytes.Buffer
+	if err := s.tmpl.Execute(&buf, data); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (s *webhookSink) flush(batch []interface{}) {
+	items := make([]webhookItem, len(batch))
+	for i, it := range batch {
+		items[i] = it.(webhookItem)
+	}
+	body, err := s.body(items)
+	if err != nil {
+		s.dead(items, err)
+		return
+	}
+	b := newBackoff(500*time.Millisecond, 30*time.Second)
+	for attempt := 0; ; attempt++ {
+		retry, err := s.post(body)
+		if err == nil {
+			for _, it := range items {
+				if it.ack != nil {
+					it.ack(nil)
+				}
+			}
+			return
+		}
+		if retry && attempt >= s.retries && items[0].ack != nil {
+			// queued events are sent again once the endpoint is back
+			for _, it := range items {
+				it.ack(err)
+			}
+			return
+		}
+		if !retry || attempt >= s.retries {
+			s.dead(items, err)
+			return
+		}
+		time.Sleep(b.next())
+	}
+}
+
+// post sends one body and reports whether a failure is worth retrying.
+func (s *webhookSink) post(body []byte) (bool, error) {
+	req, err := http.NewRequest("POST", s.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	for k, v := range s.headers {
+		req.Header[k] = v
+	}
+	if len(s.secret) > 0 {
+		mac := hmac.New(sha256.New, s.secret)
+		mac.Write(body)
+		req.Header.Set(s.signatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode == 429 || resp.StatusCode >= 500 {
+		return true, fmt.Errorf("%s", resp.Status)
+	}
+	if resp.StatusCode >= 300 {
+		return false, fmt.Errorf("%s", resp.Status)
+	}
+	return false, nil
+}
+
+// dead reports events that could not be delivered and keeps them in the
+// dead letter file when there is one. They are done with as far as a queue
+// is concerned.
+func (s *webhookSink) dead(items []webhookItem, err error) {
+	defer func() {
+		for _, it := range items {
+			if it.ack != nil {
+				it.ack(nil)
+			}
+		}
+	}()
+	fmt.Fprintf(os.Stderr, "Webhook: failed to deliver %d event(s): %s\n", len(items), err.Error())
+	if len(s.deadLetter) == 0 {
+		return
+	}
+	s.deadMu.Lock()
+	defer s.deadMu.Unlock()
+	f, ferr := os.OpenFile(s.deadLetter, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if ferr != nil {
+		fmt.Fprintln(os.Stderr, "Webhook: failed to open dead letter file", ferr.Error())
+		return
+	}
+	defer f.Close()
+	for _, it := range items {
+		f.Write(it.line)
+		f.Write([]byte{'\n'})
+	}
+}
+
+func (s *webhookSink) close() error {
+	s.batcher.close()
+	return nil
+}
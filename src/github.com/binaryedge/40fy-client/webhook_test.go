@@ -0,0 +1,141 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWebhookSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "webhook")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	tmpl := filepath.Join(dir, "slack.tmpl")
+	ioutil.WriteFile(tmpl, []byte(`{"text":"{{range $i, $e := .Events}}{{if $i}} {{end}}{{get $e "target.ip"}}:{{$e.target.port}}{{end}}"}`), 0600)
+
+	var (
+		mu     sync.Mutex
+		bodies []string
+	)
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		body, _ := ioutil.ReadAll(r.Body)
+		mac := hmac.New(sha256.New, []byte("key"))
+		mac.Write(body)
+		if sig := r.Header.Get("X-Signature-256"); sig != "sha256="+hex.EncodeToString(mac.Sum(nil)) {
+			t.Error("bad signature", sig)
+		}
+		if r.Header.Get("X-Team") != "soc" || r.URL.Query().Get("channel") != "alerts" {
+			t.Error("missing header or query", r.Header, r.URL)
+		}
+		bodies = append(bodies, string(body))
+	}
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+
+	s, err := newSink("webhook://" + strings.TrimPrefix(server.URL, "http://") + "/hook?channel=alerts&batch=2&secret=key&header=X-Team:soc&template=" + tmpl)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, l := range []string{
+		`{"target":{"ip":"10.0.0.1","port":22}}`,
+		`{"target":{"ip":"10.0.0.2","port":22}}`,
+		`{"target":{"ip":"10.0.0.3","port":80}}`,
+	} {
+		e, _ := decodeEvent([]byte(l))
+		s.send(e, []byte(l))
+	}
+	s.close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := []string{`{"text":"10.0.0.1:22 10.0.0.2:22"}`, `{"text":"10.0.0.3:80"}`}
+	if len(bodies) != len(want) || bodies[0] != want[0] || bodies[1] != want[1] {
+		t.Fatal("bodies", bodies, "want", want)
+	}
+}
+
+func TestWebhookDeadLetter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "webhook")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(400)
+	}))
+	defer server.Close()
+
+	dead := filepath.Join(dir, "dead.ndjson")
+	s, err := newSink("webhook://" + strings.TrimPrefix(server.URL, "http://") + "/?dead_letter=" + dead)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	line := `{"target":{"ip":"10.0.0.1","port":22}}`
+	e, _ := decodeEvent([]byte(line))
+	s.send(e, []byte(line+"\n"))
+	s.close()
+	if byts, _ := ioutil.ReadFile(dead); string(byts) != line+"\n" {
+		t.Fatal("dead letter", string(byts))
+	}
+}
+
+func TestBatcher(t *testing.T) {
+	release := make(chan struct{})
+	var got []interface{}
+	b := newBatcher(2, time.Hour, func(items []interface{}) {
+		<-release
+		got = append(got, items...)
+	})
+	added := make(chan struct{})
+	go func() {
+		// the first batch is being flushed, max_pending_batches more wait
+		for i := 0; i < 2*(max_pending_batches+1); i++ {
+			b.add(i)
+		}
+		close(added)
+	}()
+	select {
+	case <-added:
+	case <-time.After(5 * time.Second):
+		t.Fatal("add blocked by a flush")
+	}
+	blocked := make(chan struct{})
+	go func() {
+		b.add(100)
+		b.add(101)
+		close(blocked)
+	}()
+	select {
+	case <-blocked:
+		t.Fatal("add not blocked with every batch pending")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+	<-blocked
+	b.add(102)
+	b.close()
+	if len(got) != 2*(max_pending_batches+1)+3 {
+		t.Fatal("unexpected items", got)
+	}
+	for i, v := range got[:2*(max_pending_batches+1)] {
+		if v != i {
+			t.Fatal("batches out of order", got)
+		}
+	}
+	if got[len(got)-1] != 102 {
+		t.Fatal("pending items not flushed on close", got)
+	}
+}